@@ -0,0 +1,129 @@
+package stun
+
+import (
+	"net"
+	"net/netip"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const batchSize = 64
+
+// batchConn reads and writes many datagrams per syscall. It is recvmmsg and sendmmsg
+// on linux, other systems fall back to a datagram per syscall.
+type batchConn interface {
+	ReadBatch(ms []ipv4.Message, flags int) (int, error)
+	WriteBatch(ms []ipv4.Message, flags int) (int, error)
+}
+
+func newBatchConn(conn *net.UDPConn) batchConn {
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+		return ipv4.NewPacketConn(conn)
+	}
+	return ipv6.NewPacketConn(conn)
+}
+
+// batchReader reads datagrams into pooled buffers.
+type batchReader struct {
+	msgs []ipv4.Message
+	size int
+}
+
+func newBatchReader(size int) *batchReader {
+	r := &batchReader{
+		msgs: make([]ipv4.Message, batchSize),
+		size: size,
+	}
+	for i := range r.msgs {
+		r.msgs[i].Buffers = [][]byte{getBuffer(size)}
+	}
+	return r
+}
+
+// read calls fn for every received datagram, fn owns the buffer.
+func (r *batchReader) read(conn batchConn, fn func(buf []byte, addr netip.AddrPort)) error {
+	n, err := conn.ReadBatch(r.msgs, 0)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		m := &r.msgs[i]
+		buf := m.Buffers[0][:m.N]
+		var addr netip.AddrPort
+		if udpAddr, ok := m.Addr.(*net.UDPAddr); ok {
+			addr = udpAddr.AddrPort()
+			addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+		}
+		m.Buffers[0] = getBuffer(r.size)
+		fn(buf, addr)
+	}
+	return nil
+}
+
+// batchWriter collects datagrams and sends them with one syscall.
+type batchWriter struct {
+	conn  batchConn
+	msgs  []ipv4.Message
+	addrs [batchSize]net.UDPAddr
+	ips   [batchSize][net.IPv6len]byte
+	// buffers are returned to the pool after flush
+	buffers [][]byte
+}
+
+func newBatchWriter(conn batchConn) *batchWriter {
+	w := &batchWriter{
+		conn: conn,
+		msgs: make([]ipv4.Message, 0, batchSize),
+	}
+	return w
+}
+
+// write queues the datagram, the destination of a connected socket is invalid. The
+// batch is sent when it is full or on flush.
+func (w *batchWriter) write(datagram []byte, dst netip.AddrPort) {
+	i := len(w.msgs)
+	w.msgs = w.msgs[:i+1]
+	m := &w.msgs[i]
+	if m.Buffers == nil {
+		m.Buffers = make([][]byte, 1)
+	}
+	m.Buffers[0] = datagram
+	m.Addr = nil
+	if dst.IsValid() {
+		w.ips[i] = dst.Addr().As16()
+		w.addrs[i] = net.UDPAddr{IP: w.ips[i][:], Port: int(dst.Port())}
+		m.Addr = &w.addrs[i]
+	}
+
+	if len(w.msgs) == batchSize {
+		w.flush()
+	}
+}
+
+// release returns the buffer to the pool after queued datagrams are sent.
+func (w *batchWriter) release(buf []byte) {
+	w.buffers = append(w.buffers, buf)
+}
+
+func (w *batchWriter) flush() {
+	for sent := 0; sent < len(w.msgs); {
+		n, err := w.conn.WriteBatch(w.msgs[sent:], 0)
+		if err != nil {
+			log.Warn("batch write error", "error", err)
+			break
+		}
+		sent += n
+	}
+
+	for i := range w.msgs {
+		w.msgs[i].Buffers[0] = nil
+	}
+	w.msgs = w.msgs[:0]
+	for i, buf := range w.buffers {
+		putBuffer(buf)
+		w.buffers[i] = nil
+	}
+	w.buffers = w.buffers[:0]
+}
@@ -0,0 +1,139 @@
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/ipv4"
+)
+
+const benchmarkDatagramSize = 1280
+
+func testUDPPair(t testing.TB) (*net.UDPConn, *net.UDPConn) {
+	receiver, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	sender, err := net.DialUDP("udp4", nil, receiver.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		sender.Close()
+		receiver.Close()
+	})
+	return sender, receiver
+}
+
+func TestBatchReadWrite(t *testing.T) {
+	sender, receiver := testUDPPair(t)
+
+	w := newBatchWriter(newBatchConn(sender))
+	for i := 0; i < 3; i++ {
+		w.write([]byte{byte(i)}, netip.AddrPort{})
+	}
+	w.flush()
+	require.Empty(t, w.msgs)
+
+	r := newBatchReader(DeviceBufferSize)
+	var received [][]byte
+	for len(received) < 3 {
+		require.NoError(t, r.read(newBatchConn(receiver), func(buf []byte, addr netip.AddrPort) {
+			require.Equal(t, sender.LocalAddr().(*net.UDPAddr).AddrPort(), addr)
+			received = append(received, buf)
+		}))
+	}
+	require.Equal(t, [][]byte{{0}, {1}, {2}}, received)
+
+	// unconnected socket writes to the destination of each datagram
+	w = newBatchWriter(newBatchConn(receiver))
+	w.write([]byte{3}, sender.LocalAddr().(*net.UDPAddr).AddrPort())
+	w.flush()
+	buf := make([]byte, 1)
+	_, err := sender.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, []byte{3}, buf)
+}
+
+// Throughput per core is reported by running the benchmarks with -cpu 1.
+
+func BenchmarkWriteSingle(b *testing.B) {
+	sender, receiver := testUDPPair(b)
+	go drain(receiver)
+
+	datagram := make([]byte, benchmarkDatagramSize)
+	b.SetBytes(benchmarkDatagramSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := sender.Write(datagram); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	sender, receiver := testUDPPair(b)
+	go drain(receiver)
+
+	w := newBatchWriter(newBatchConn(sender))
+	datagram := make([]byte, benchmarkDatagramSize)
+	b.SetBytes(benchmarkDatagramSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.write(datagram, netip.AddrPort{})
+	}
+	w.flush()
+}
+
+func BenchmarkReadSingle(b *testing.B) {
+	sender, receiver := testUDPPair(b)
+	go flood(sender)
+
+	b.SetBytes(benchmarkDatagramSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf := getBuffer(DeviceBufferSize)
+		if _, _, err := receiver.ReadFromUDPAddrPort(buf); err != nil {
+			b.Fatal(err)
+		}
+		putBuffer(buf)
+	}
+}
+
+func BenchmarkReadBatch(b *testing.B) {
+	sender, receiver := testUDPPair(b)
+	go flood(sender)
+
+	r := newBatchReader(DeviceBufferSize)
+	conn := newBatchConn(receiver)
+	b.SetBytes(benchmarkDatagramSize)
+	b.ResetTimer()
+	for n := 0; n < b.N; {
+		if err := r.read(conn, func(buf []byte, _ netip.AddrPort) {
+			putBuffer(buf)
+			n++
+		}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func drain(conn *net.UDPConn) {
+	buf := make([]byte, DeviceBufferSize)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func flood(conn *net.UDPConn) {
+	batch := newBatchConn(conn)
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, benchmarkDatagramSize)}
+	}
+	for {
+		if _, err := batch.WriteBatch(msgs, 0); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package stun
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	// packetHeadroom is reserved before a packet for the envelope and message headers.
+	packetHeadroom = envelopeHeaderSize + tmsgMaxHeaderSize
+	// packetTailroom is reserved after a packet for the authentication tag.
+	packetTailroom = chacha20poly1305.Overhead
+)
+
+// packetBuf holds a packet at buf[off:]. Headers are written into the room before the
+// packet and the packet is encrypted in place, so it is never copied on the way
+// between the device and the socket.
+type packetBuf struct {
+	buf []byte
+	off int
+}
+
+var bufferPool sync.Pool
+
+// getBuffer returns a buffer of the size, preferably a pooled one.
+func getBuffer(size int) []byte {
+	if b, ok := bufferPool.Get().(*[]byte); ok && cap(*b) >= size {
+		return (*b)[:size]
+	}
+	return make([]byte, size)
+}
+
+// putBuffer returns the buffer to the pool, nothing may reference it afterwards.
+func putBuffer(b []byte) {
+	b = b[:0]
+	bufferPool.Put(&b)
+}
+
+// getPacketBuf returns a buffer for a packet of the size with the full headroom.
+func getPacketBuf(size int) packetBuf {
+	b := getBuffer(packetHeadroom + size + packetTailroom)
+	return packetBuf{buf: b[:packetHeadroom+size], off: packetHeadroom}
+}
+
+func putPacketBuf(p packetBuf) {
+	putBuffer(p.buf)
+}
+
+// receivedPacket returns the payload of the message opened in place from the datagram.
+func receivedPacket(datagram []byte, msg tmsg) packetBuf {
+	off := envelopeHeaderSize + msg.headerSize()
+	return packetBuf{buf: datagram[:off+len(msg.payload)], off: off}
+}
+
+func (p packetBuf) payload() []byte {
+	return p.buf[p.off:]
+}
+
+// truncate sets the packet length.
+func (p packetBuf) truncate(n int) packetBuf {
+	p.buf = p.buf[:p.off+n]
+	return p
+}
+
+// frame returns the packet prefixed with the tun frame header.
+func (p packetBuf) frame() []byte {
+	if p.off < tunFrameHeaderSize {
+		return tunFrameEncode(p.payload())
+	}
+	res := p.buf[p.off-tunFrameHeaderSize:]
+	copy(res, tunFrameHeaderOf(p.payload()))
+	return res
+}
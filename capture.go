@@ -0,0 +1,194 @@
+package stun
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// capture interfaces, packets read from the device and packets received from the tunnel
+const (
+	captureDevice = iota
+	captureTunnel
+)
+
+const captureQueueSize = 1024
+
+// activeCapture is the running capture, packets are tapped only while it's set.
+var activeCapture atomic.Pointer[capture]
+
+type capturedPacket struct {
+	iface int
+	ts    time.Time
+	data  []byte
+}
+
+// capture copies packets matching the filter to the writer of the capture request.
+// Packets are dropped if the writer doesn't keep up.
+type capture struct {
+	// filter are networks of the source or destination address, empty matches all
+	filter  []netip.Prefix
+	packets chan capturedPacket
+	dropped atomic.Uint64
+}
+
+func (c *capture) matches(pkt rawPacket) bool {
+	if len(c.filter) == 0 {
+		return true
+	}
+	src, dst := ipSrc(pkt), ipDst(pkt)
+	for _, p := range c.filter {
+		if p.Contains(src) || p.Contains(dst) {
+			return true
+		}
+	}
+	return false
+}
+
+// capturePacket taps the IP packet if a capture is running.
+func capturePacket(iface int, pkt rawPacket) {
+	c := activeCapture.Load()
+	if c == nil || !validIPPacket(pkt) || !c.matches(pkt) {
+		return
+	}
+	select {
+	case c.packets <- capturedPacket{iface: iface, ts: time.Now(), data: append([]byte(nil), pkt...)}:
+	default:
+		c.dropped.Add(1)
+	}
+}
+
+// serveCapture streams captured packets as pcapng for the duration of the request. The
+// filter is taken from addr parameters, which are addresses or networks, and peer
+// parameters resolved by peer.
+func serveCapture(w http.ResponseWriter, r *http.Request, peer func(ref string) ([]netip.Prefix, error)) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	duration := CaptureDuration
+	if d := query.Get("duration"); d != "" {
+		var err error
+		if duration, err = time.ParseDuration(d); err != nil || duration <= 0 || duration > CaptureMaxDuration {
+			http.Error(w, fmt.Sprintf("duration %q is not in (0, %s]", d, CaptureMaxDuration), http.StatusBadRequest)
+			return
+		}
+	}
+
+	c := &capture{packets: make(chan capturedPacket, captureQueueSize)}
+	for _, a := range query["addr"] {
+		prefix, err := parseAllowedIP(a)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("addr %q: %s", a, err), http.StatusBadRequest)
+			return
+		}
+		c.filter = append(c.filter, prefix)
+	}
+	for _, ref := range query["peer"] {
+		prefixes, err := peer(ref)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		c.filter = append(c.filter, prefixes...)
+	}
+
+	if !activeCapture.CompareAndSwap(nil, c) {
+		http.Error(w, "capture is already running", http.StatusConflict)
+		return
+	}
+	defer activeCapture.Store(nil)
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	device, tunnel := pcapgo.DefaultNgInterface, pcapgo.DefaultNgInterface
+	device.Name, device.Description, device.LinkType = "device", "packets read from the tunnel device", layers.LinkTypeRaw
+	tunnel.Name, tunnel.Description, tunnel.LinkType = "tunnel", "packets received from the tunnel", layers.LinkTypeRaw
+	pw, err := pcapgo.NewNgWriterInterface(w, device, pcapgo.DefaultNgWriterOptions)
+	if err == nil {
+		_, err = pw.AddInterface(tunnel)
+	}
+	if err != nil {
+		log.Warn("capture", "error", err)
+		return
+	}
+	flusher, _ := w.(http.Flusher)
+	if err := pw.Flush(); err != nil {
+		log.Debug("capture", "error", err)
+		return
+	}
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	log.Infof("start capture for %s", duration)
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			log.Infof("capture finished, %d packets dropped", c.dropped.Load())
+			if err := pw.Flush(); err != nil {
+				log.Debug("capture", "error", err)
+			}
+			return
+		case <-r.Context().Done():
+			log.Infof("capture canceled, %d packets dropped", c.dropped.Load())
+			return
+		case p := <-c.packets:
+			ci := gopacket.CaptureInfo{
+				Timestamp:      p.ts,
+				CaptureLength:  len(p.data),
+				Length:         len(p.data),
+				InterfaceIndex: p.iface,
+			}
+			if err := pw.WritePacket(ci, p.data); err != nil {
+				log.Debug("capture", "error", err)
+				return
+			}
+			// packets are written as they come unless more are waiting
+			if len(c.packets) == 0 {
+				if err := pw.Flush(); err != nil {
+					log.Debug("capture", "error", err)
+					return
+				}
+				if flusher != nil {
+					flusher.Flush()
+				}
+			}
+		}
+	}
+}
+
+// capturePeer returns networks of the connected peer and the addresses it may use.
+func (s *server) capturePeer(ref string) ([]netip.Prefix, error) {
+	p := s.findPeer(ref)
+	if p == nil {
+		return nil, fmt.Errorf("peer %s is not connected", ref)
+	}
+	res := append([]netip.Prefix(nil), p.identity.allowedIPs...)
+	for _, addr := range []netip.Addr{p.peerAddress, p.peerAddress6} {
+		if addr.IsValid() {
+			res = append(res, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return res, nil
+}
+
+// capturePeer returns the overlay address of another client.
+func (c *client) capturePeer(ref string) ([]netip.Prefix, error) {
+	addr, err := netip.ParseAddr(ref)
+	if err != nil {
+		return nil, fmt.Errorf("peer %s is not an overlay address", ref)
+	}
+	return []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}, nil
+}
@@ -0,0 +1,53 @@
+package stun
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCapture(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serveCapture(w, r, (&client{}).capturePeer)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"?duration=300ms&addr=192.168.50.3", "", nil)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.NotNil(t, activeCapture.Load())
+
+	conflict, err := http.Post(srv.URL+"?peer=192.168.50.4", "", nil)
+	require.NoError(t, err)
+	conflict.Body.Close()
+	require.Equal(t, http.StatusConflict, conflict.StatusCode)
+
+	src := netip.MustParseAddrPort("192.168.50.2:1000")
+	matched := testNATPacket(t, src, netip.MustParseAddrPort("192.168.50.3:53"), &layers.UDP{})
+	capturePacket(captureDevice, testNATPacket(t, src, netip.MustParseAddrPort("192.168.50.4:53"), &layers.UDP{}))
+	capturePacket(captureTunnel, matched)
+
+	r, err := pcapgo.NewNgReader(resp.Body, pcapgo.DefaultNgReaderOptions)
+	require.NoError(t, err)
+	data, ci, err := r.ReadPacketData()
+	require.NoError(t, err)
+	require.Equal(t, matched, data)
+	require.Equal(t, captureTunnel, ci.InterfaceIndex)
+	intf, err := r.Interface(ci.InterfaceIndex)
+	require.NoError(t, err)
+	require.Equal(t, "tunnel", intf.Name)
+
+	require.Eventually(t, func() bool { return activeCapture.Load() == nil }, time.Second, 10*time.Millisecond)
+
+	resp, err = http.Post(srv.URL+"?duration=1h", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
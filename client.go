@@ -1,11 +1,15 @@
 package stun
 
 import (
+	"crypto/ecdh"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/netip"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -13,56 +17,124 @@ import (
 )
 
 type client struct {
-	mu         sync.RWMutex
-	conn       *net.UDPConn
-	device     Device
-	ackChannel chan struct{}
+	mu           sync.RWMutex
+	conn         *net.UDPConn
+	batch        batchConn
+	endpoint     netip.AddrPort
+	session      *session
+	keys         clientKeys
+	device       Device
+	requested    netip.Addr
+	requested6   netip.Addr
+	capabilities capabilities
+	ackChannel   chan struct{}
+	// closed is signaled when the server forgets the session
+	closed chan struct{}
+	done   chan struct{}
+	server string
+	// source is the local address of the route to the endpoint, the client roams when
+	// it changes
+	source netip.Addr
+	// connChanged is signaled when a new connection replaces the closed one
+	connChanged chan struct{}
+	// lastSeen is the time of the last server response in unix nanoseconds
+	lastSeen atomic.Int64
+	// keepAliveSent is the time of the unanswered keep alive message in unix nanoseconds
+	keepAliveSent atomic.Int64
+	keepAliveRTT  atomic.Int64
+	rxPackets     atomic.Uint64
+	txPackets     atomic.Uint64
+	rxBytes       atomic.Uint64
+	txBytes       atomic.Uint64
+	deviceQueues  []chan packetBuf
+	// paths are direct paths to other clients by overlay addresses and sessions
+	paths        map[netip.Addr]*directPath
+	pathSessions map[uint32]*directPath
+	acks         ackWaiters
 }
 
-func RunClient(ctx context.Context, tun TunDevice, config ClientConfig) error {
-	if err := configureClientTunnelDevice(tun, config); err != nil {
-		return err
-	}
-
+// RunClient connects to the server and forwards traffic of the tunnel device. The returned
+// channel is closed when the client has said goodbye to the server after ctx cancellation.
+func RunClient(ctx context.Context, tun TunDevice, config ClientConfig) (<-chan struct{}, error) {
 	conn, err := newClientConnection(ctx, tun, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	tunDeviceCh := make(chan []byte, 1)
+	// every device queue is read and sent by its own loop
+	for _, q := range tun.Queues() {
+		tunDeviceCh := make(chan packetBuf, 1)
+		conn.deviceQueues = append(conn.deviceQueues, tunDeviceCh)
 
-	go conn.readDevicePackets(ctx, tun, tunDeviceCh)
+		go conn.readDevicePackets(ctx, q, tunDeviceCh)
 
-	go conn.processPacketsFromDevice(ctx, tunDeviceCh)
+		go conn.processPacketsFromDevice(ctx, tunDeviceCh)
+	}
 
 	go conn.processPacketsFromConnection(ctx, tun)
 
-	return nil
+	if config.ControlSocket != "" {
+		if err := serveControl(ctx, config.ControlSocket, conn.controlHandler()); err != nil {
+			return nil, fmt.Errorf("control api: %w", err)
+		}
+	}
+	if config.MetricsAddress != "" {
+		if err := serveMetrics(ctx, config.MetricsAddress, conn.writeMetrics); err != nil {
+			return nil, fmt.Errorf("metrics: %w", err)
+		}
+	}
+
+	return conn.done, nil
 }
 
 func newClientConnection(ctx context.Context, tun TunDevice, config ClientConfig) (*client, error) {
-	networkChanges, err := NotifyNetworkAddressesChanges(ctx)
+	networkChanges, err := NotifyNetworkAddressesChanges(ctx, tun.LinkName())
 	if err != nil {
 		return nil, err
 	}
 
-	udpConnection, err := dial(config)
+	keys, err := parseClientKeys(config)
 	if err != nil {
 		return nil, err
 	}
 
+	var requested, requested6 netip.Addr
+	if config.NetworkCIDR != "" {
+		prefix, err := netip.ParsePrefix(config.NetworkCIDR)
+		if err != nil {
+			return nil, err
+		}
+		requested = prefix.Addr()
+	}
+	if config.NetworkCIDR6 != "" {
+		prefix, err := netip.ParsePrefix(config.NetworkCIDR6)
+		if err != nil {
+			return nil, err
+		}
+		requested6 = prefix.Addr()
+	}
+
 	c := &client{
-		conn:       udpConnection,
-		device:     tun.LookupDeviceInfo(),
-		ackChannel: make(chan struct{}, 1),
+		keys:        keys,
+		device:      tun.LookupDeviceInfo(),
+		requested:   requested,
+		requested6:  requested6,
+		ackChannel:  make(chan struct{}, 1),
+		closed:      make(chan struct{}, 1),
+		connChanged: make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		server:      config.ServerInternetAddress,
 	}
 
-	if err := c.handshake(tun, config); err != nil {
+	err = c.handshake(tun, config)
+	countHandshake(err == nil)
+	if err != nil {
 		log.Error("error on handshake", err)
 		return nil, err
 	}
 
 	go func() {
+		defer close(c.done)
 		var retry <-chan time.Time
 
 		forceReconnect := time.NewTicker(KeepAliveMaxDuration)
@@ -72,6 +144,9 @@ func newClientConnection(ctx context.Context, tun TunDevice, config ClientConfig
 		for {
 			select {
 			case <-ctx.Done():
+				if err := c.disconnect("client shutdown"); err != nil {
+					log.Warn("error on disconnect", "error", err)
+				}
 				if c := c.get(); c != nil {
 					c.Close()
 				}
@@ -87,12 +162,28 @@ func newClientConnection(ctx context.Context, tun TunDevice, config ClientConfig
 				forceReconnect.Reset(KeepAliveMaxDuration)
 				keepAlive.Reset(KeepAliveRequestDuration)
 				continue
-			case <-retry:
 			case <-networkChanges:
+				// session survives changes of the internet address, the server
+				// follows the client by session id
+				if !c.sourceChanged() {
+					continue
+				}
+				if err := c.roam(config); err != nil {
+					log.Warn("error on roaming", "error", err)
+					retry = time.After(RetryDelay)
+				}
+				continue
+			case <-c.closed:
+				// the session is gone, so the client connects again after a pause
+				retry = time.After(RetryDelay)
+				continue
+			case <-retry:
 			case <-forceReconnect.C:
 			}
 
-			if err := c.handshake(tun, config); err != nil {
+			err := c.handshake(tun, config)
+			countHandshake(err == nil)
+			if err != nil {
 				log.Error("error on handshake", err)
 				retry = time.After(RetryDelay)
 			}
@@ -102,84 +193,251 @@ func newClientConnection(ctx context.Context, tun TunDevice, config ClientConfig
 	return c, nil
 }
 
-func (c *client) handshake(tun TunDevice, config ClientConfig) error {
+// sourceChanged reports whether the local address of the route to the server changed,
+// other changes of the network don't break the connection.
+func (c *client) sourceChanged() bool {
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	source, err := routeSource(c.endpoint)
+	if err != nil {
+		log.Debugf("no route to %s: %s", c.endpoint, err)
+		return false
+	}
+	if source == c.source {
+		return false
+	}
+	c.source = source
+	return true
+}
 
+func (c *client) roam(config ClientConfig) error {
+	c.mu.Lock()
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	cc, err := listen(config, c.endpoint)
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.setConnLocked(cc)
+	c.mu.Unlock()
+
+	log.Infof("network changed, resume session from %s", cc.LocalAddr())
+	return c.keepAlive()
+}
 
-	cc, err := dial(config)
+// handshake connects to the server. The lock is taken only to install the new session,
+// so traffic, direct paths and the control api aren't blocked while the server is
+// resolved and the handshake waits for the response.
+func (c *client) handshake(tun TunDevice, config ClientConfig) error {
+	// the port of the connection may be fixed, so it is released for the new one
+	if conn := c.get(); conn != nil {
+		conn.Close()
+	}
+
+	endpoints, err := resolveServer(config)
 	if err != nil {
 		return err
 	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no addresses of %s", config.ServerInternetAddress)
+	}
 
-	c.device = tun.LookupDeviceInfo()
+	device := tun.LookupDeviceInfo()
+	connect := hello{capabilities: supportedCapabilities, addr6: c.requested6}
+	if device.Prefix6.IsValid() {
+		connect.addr6 = device.Prefix6.Addr()
+	}
+	payload, err := connect.MarshalBinary()
+	if err != nil {
+		return err
+	}
 	request := tmsg{
-		tp:   msgTypeConnect,
-		addr: c.device.Addr,
+		tp:      msgTypeConnect,
+		addr:    c.requested,
+		payload: payload,
+	}
+	if device.Addr.IsValid() {
+		request.addr = device.Addr
 	}
 
-	buf, err := request.MarshalBinary()
+	// every endpoint gets the same init, the server answers a repeated init with the
+	// same session, so the session doesn't depend on the endpoint which answers first
+	hs := newInitiatorHandshake(c.keys.private, c.keys.server, c.keys.psk)
+	init, err := hs.initEnvelope(request)
 	if err != nil {
 		return err
 	}
-	if _, err := cc.Write(buf); err != nil {
+	endpoint, cc, buf, err := connectFirst(config, endpoints, init)
+	if err != nil {
 		return err
 	}
 
-	var response tmsg
-	buf = make([]byte, DeviceMTU)
+	var e envelope
+	if err := e.UnmarshalBinary(buf); err != nil {
+		var versionErr versionError
+		if errors.As(err, &versionErr) {
+			return &RejectError{
+				Code:   ErrorUnsupportedVersion,
+				Reason: fmt.Sprintf("server protocol version %d, client %d", versionErr.version, protocolVersion),
+			}
+		}
+		return fmt.Errorf("server response: %w", err)
+	}
 
-	// handshake timeout
-	if err := cc.SetReadDeadline(time.Now().Add(HandshakeDelay)); err != nil {
-		return err
+	if e.kind == envelopeReject {
+		// not authenticated, so it is only reported and never acted upon
+		var msg tmsg
+		if err := msg.UnmarshalBinary(e.body); err != nil {
+			return fmt.Errorf("server error response: %w", err)
+		}
+		return parseReject(msg.payload)
 	}
 
-	n, err := cc.Read(buf)
+	sess, response, err := hs.consumeResponse(e)
 	if err != nil {
 		return err
 	}
 
-	if err := response.UnmarshalBinary(buf[:n:n]); err != nil {
-		return err
+	if response.tp == msgTypeError {
+		return parseReject(response.payload)
 	}
 
 	if response.tp != msgTypeAck {
 		return errors.New(fmt.Sprintf("unexpected message type %d instead %d in handshake.", response.tp, msgTypeAck))
 	}
 
-	if err := cc.SetReadDeadline(time.Time{}); err != nil {
+	var ack hello
+	if err := ack.UnmarshalBinary(response.payload); err != nil {
 		return err
 	}
+	lease := netip.PrefixFrom(response.addr, int(ack.prefixBits))
+	var lease6 netip.Prefix
+	if ack.capabilities.has(capIPv6) {
+		lease6 = netip.PrefixFrom(ack.addr6, int(ack.prefixBits6))
+	}
+	if lease.Addr() != device.Addr || lease6 != device.Prefix6 {
+		log.Infof("lease address %s %s", lease, lease6)
+		if err := configureClientTunnelDevice(tun, lease, lease6); err != nil {
+			return err
+		}
+		device = tun.LookupDeviceInfo()
+	}
+
+	// the route is looked up with a socket of its own, the connection may listen on an
+	// unspecified address
+	source, err := routeSource(endpoint)
+	if err != nil {
+		log.Debugf("no route to %s: %s", endpoint, err)
+	}
 
-	c.conn = cc
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.device = device
+	// direct paths were offered in the previous session, the server forgot them
+	for _, d := range c.pathSessions {
+		c.removeDirectPathLocked(d)
+	}
+	c.setConnLocked(cc)
+	c.endpoint = endpoint
+	c.source = source
+	c.session = sess
+	c.capabilities = ack.capabilities
+	c.lastSeen.Store(time.Now().UnixNano())
 
-	log.Infof("connection to %s established", config.ServerInternetAddress)
+	log.Infof("connection to %s (%s) established", config.ServerInternetAddress, endpoint)
 
 	return nil
 }
 
+func parseReject(payload []byte) error {
+	res := &RejectError{}
+	if err := res.UnmarshalBinary(payload); err != nil {
+		return fmt.Errorf("server error response: %w", err)
+	}
+	return res
+}
+
+type clientKeys struct {
+	private *ecdh.PrivateKey
+	server  *ecdh.PublicKey
+	psk     []byte
+}
+
+func parseClientKeys(config ClientConfig) (clientKeys, error) {
+	var res clientKeys
+	var err error
+	if res.private, err = parsePrivateKey(config.PrivateKey); err != nil {
+		return res, fmt.Errorf("private key: %w", err)
+	}
+	if res.server, err = parsePublicKey(config.ServerPublicKey); err != nil {
+		return res, fmt.Errorf("server public key: %w", err)
+	}
+	if res.psk, err = parsePresharedKey(config.PreSharedKey); err != nil {
+		return res, fmt.Errorf("pre-shared key: %w", err)
+	}
+	return res, nil
+}
+
 func (c *client) keepAlive() error {
 	log.Debugf("send keep alive message")
+	c.keepAliveSent.Store(time.Now().UnixNano())
 
-	request := tmsg{
+	return c.send(tmsg{
 		tp:   msgTypeKeepAlive,
-		addr: c.device.Addr,
-	}
+		addr: c.deviceInfo().Addr,
+	})
+}
+
+func (c *client) disconnect(reason string) error {
+	log.Infof("disconnect from server: %s", reason)
+
+	return c.send(tmsg{
+		tp:      msgTypeDisconnect,
+		addr:    c.deviceInfo().Addr,
+		payload: []byte(reason),
+	})
+}
 
-	bts, err := request.MarshalBinary()
+func (c *client) send(msg tmsg) error {
+	c.mu.RLock()
+	conn, sess, endpoint := c.conn, c.session, c.endpoint
+	c.mu.RUnlock()
+
+	bts, err := sess.seal(msg)
 	if err != nil {
 		return err
 	}
 
-	conn := c.get()
+	if _, err := conn.WriteToUDPAddrPort(bts, endpoint); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// sendPacket seals the data packet in place and queues it to out, the caller releases
+// the packet to out. The packet goes directly to the peer if the path is up, otherwise
+// the server relays it.
+func (c *client) sendPacket(p packetBuf, out *batchWriter) error {
+	c.mu.RLock()
+	batch, sess, endpoint, addr := c.batch, c.session, c.endpoint, c.device.Addr
+	c.mu.RUnlock()
 
-	if _, err := conn.Write(bts); err != nil {
+	if d := c.directPathTo(ipDst(p.payload())); d != nil {
+		sess, endpoint = d.session, *d.endpoint.Load()
+	}
+	c.txPackets.Add(1)
+	c.txBytes.Add(uint64(len(p.payload())))
+
+	bts, err := sess.sealPacket(p, msgTypeData, addr)
+	if err != nil {
 		return err
 	}
 
+	out.conn = batch
+	out.write(bts, endpoint)
 	return nil
 }
 
@@ -189,13 +447,35 @@ func (c *client) get() *net.UDPConn {
 	return c.conn
 }
 
-func (c *client) set(cc *net.UDPConn) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.conn = cc
+// deviceInfo returns the device, it changes when the client gets a new lease.
+func (c *client) deviceInfo() Device {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.device
+}
+
+func (c *client) getSession() *session {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.session
+}
+
+func (c *client) setConnLocked(cc *net.UDPConn) {
+	c.conn, c.batch = cc, newBatchConn(cc)
+	select {
+	case c.connChanged <- struct{}{}:
+	default:
+	}
+}
+
+func (c *client) getBatch() batchConn {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.batch
 }
 
 func (c *client) processPacketsFromConnection(ctx context.Context, tun TunDevice) {
+	reader := newBatchReader(c.bufSize() + tunnelOverhead)
 	for {
 		select {
 		case <-ctx.Done():
@@ -203,38 +483,101 @@ func (c *client) processPacketsFromConnection(ctx context.Context, tun TunDevice
 		default:
 
 		}
-		buf := make([]byte, c.bufSize())
-		n, addr, err := c.get().ReadFromUDP(buf)
+		err := reader.read(c.getBatch(), func(buf []byte, addr netip.AddrPort) {
+			c.receivePacket(tun, buf, addr)
+			putBuffer(buf)
+		})
+		// packets of the batch are coalesced by the device
+		if err := tun.Flush(); err != nil {
+			log.Warn("write to device", "error", err)
+		}
 		if errors.Is(err, net.ErrClosed) {
+			// the connection stays closed until a handshake or roaming replaces it
+			select {
+			case <-c.connChanged:
+			case <-c.done:
+				return
+			case <-ctx.Done():
+				return
+			}
 			continue
 		}
 		if err != nil {
 			log.Warn("read socket", "error", err)
-			continue
 		}
+	}
+}
 
-		log.Debugf("receive packet from %s", addr.IP)
+func (c *client) receivePacket(tun TunDevice, buf []byte, addr netip.AddrPort) {
+	log.Debugf("receive packet from %s", addr.Addr())
 
-		buf = buf[:n:n]
-		var msg tmsg
-		if err = msg.UnmarshalBinary(buf); err != nil {
-			log.Warn("deserialize device packet", "error", err)
-			continue
-		}
+	var e envelope
+	if err := e.UnmarshalBinary(buf); err != nil {
+		log.Warn("deserialize device packet", "error", err)
+		return
+	}
 
-		if msg.tp == msgTypeAck {
-			c.ackChannel <- struct{}{}
-			continue
-		}
+	sess := c.getSession()
+	if e.session != sess.id {
+		c.receiveDirect(tun, buf, e, addr)
+		return
+	}
 
-		if _, err := tun.Write(tunFrameEncode(msg.payload)); err != nil {
-			log.Warn("write to device", "error", err)
-			continue
+	msg, err := sess.open(e)
+	if err != nil {
+		log.Debug("drop packet", "from", addr, "error", err)
+		return
+	}
+
+	switch msg.tp {
+	case msgTypeAck:
+		now := time.Now().UnixNano()
+		c.lastSeen.Store(now)
+		if sent := c.keepAliveSent.Swap(0); sent != 0 {
+			c.keepAliveRTT.Store(now - sent)
+		}
+		c.acks.notify(sess.id, now)
+		// acks of pings may come while the keep alive loop is busy
+		select {
+		case c.ackChannel <- struct{}{}:
+		default:
+		}
+		return
+	case msgTypeDisconnect:
+		log.Warnf("server closed the session: %s", msg.payload)
+		select {
+		case c.closed <- struct{}{}:
+		default:
+		}
+		return
+	case msgTypePeer:
+		var offer peerOffer
+		if err := offer.UnmarshalBinary(msg.payload); err != nil {
+			log.Warn("peer offer", "error", err)
+			return
+		}
+		if err := c.addDirectPath(msg.addr, offer); err != nil {
+			log.Warn("direct path", "error", err)
+		}
+		return
+	case msgTypeUnpeer:
+		if len(msg.payload) < 4 {
+			log.Warn("path withdrawal", "error", errMalformedMessage)
+			return
 		}
+		c.withdrawDirectPath(msg.addr, binary.BigEndian.Uint32(msg.payload))
+		return
+	}
+
+	c.rxPackets.Add(1)
+	c.rxBytes.Add(uint64(len(msg.payload)))
+	capturePacket(captureTunnel, msg.payload)
+	if _, err := tun.Write(receivedPacket(buf, msg).frame()); err != nil {
+		log.Warn("write to device", "error", err)
 	}
 }
 
-func (c *client) readDevicePackets(ctx context.Context, tun TunDevice, tunDeviceCh chan<- []byte) {
+func (c *client) readDevicePackets(ctx context.Context, tun io.Reader, tunDeviceCh chan<- packetBuf) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -242,18 +585,27 @@ func (c *client) readDevicePackets(ctx context.Context, tun TunDevice, tunDevice
 		default:
 
 		}
-		buf := make([]byte, c.bufSize())
-		n, err := tun.Read(buf)
+		p := getPacketBuf(c.deviceInfo().MTU)
+		// frame header is read into the headroom
+		n, err := tun.Read(p.buf[p.off-tunFrameHeaderSize:])
 		if err != nil {
+			putPacketBuf(p)
 			log.Warn("read device", "error", err)
 			continue
 		}
+		if n < tunFrameHeaderSize {
+			putPacketBuf(p)
+			continue
+		}
+		p = p.truncate(n - tunFrameHeaderSize)
+		capturePacket(captureDevice, p.payload())
 
-		tunDeviceCh <- buf[tunFrameHeaderSize:n:n]
+		tunDeviceCh <- p
 	}
 }
 
-func (c *client) processPacketsFromDevice(ctx context.Context, tunDeviceCh <-chan []byte) {
+func (c *client) processPacketsFromDevice(ctx context.Context, tunDeviceCh <-chan packetBuf) {
+	out := newBatchWriter(nil)
 	for {
 		select {
 		case <-ctx.Done():
@@ -261,38 +613,189 @@ func (c *client) processPacketsFromDevice(ctx context.Context, tunDeviceCh <-cha
 		default:
 		}
 
-		buf, ok := <-tunDeviceCh
+		p, ok := <-tunDeviceCh
 		if !ok {
 			break
 		}
 
-		log.Debugf("send packet to %s", ipv4Dst(buf))
-
-		msg := tmsg{
-			tp:      msgTypeData,
-			addr:    c.device.Addr,
-			payload: buf,
-		}
-
-		outBytes, err := msg.MarshalBinary()
-		if err != nil {
-			log.Warn("client marshal data", "error", err)
+		if !validIPPacket(p.payload()) {
+			putPacketBuf(p)
 			continue
 		}
 
-		if _, err := c.get().Write(outBytes); err != nil {
+		log.Debugf("send packet to %s", ipDst(p.payload()))
+
+		if err := c.sendPacket(p, out); err != nil {
 			log.Warn("client write", "error", err)
-			continue
+		}
+		out.release(p.buf)
+
+		// send the batch once the device has no more packets ready
+		if len(tunDeviceCh) == 0 {
+			out.flush()
 		}
 	}
 }
 
 func (c *client) bufSize() int {
-	return c.device.MTU + tunFrameHeaderSize
+	return c.deviceInfo().MTU + tunFrameHeaderSize
 }
 
-func dial(config ClientConfig) (*net.UDPConn, error) {
-	return net.DialUDP("udp",
-		net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr("0.0.0.0"), uint16(config.ClientPort))),
-		net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr(config.ServerInternetAddress), uint16(config.ServerPort))))
+// datagram is received by one of the sockets of the handshake.
+type datagram struct {
+	conn *net.UDPConn
+	from netip.AddrPort
+	buf  []byte
+}
+
+// connectFirst sends the handshake init to the endpoints in the order of attempts, each
+// one HappyEyeballsDelay after the previous one or right away if the previous one can't
+// be sent, see RFC 8305. The first response of a started endpoint wins and the other
+// attempts are abandoned. Endpoints of an address family share a socket, so a fixed
+// client port is bound once.
+func connectFirst(config ClientConfig, endpoints []netip.AddrPort, init []byte) (netip.AddrPort, *net.UDPConn, []byte, error) {
+	received := make(chan datagram)
+	done := make(chan struct{})
+	conns := map[bool]*net.UDPConn{}
+	var readers sync.WaitGroup
+	read := func(cc *net.UDPConn) {
+		defer readers.Done()
+		for {
+			buf := make([]byte, DeviceBufferSize)
+			n, from, err := cc.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case received <- datagram{conn: cc, from: unmapAddrPort(from), buf: buf[:n:n]}:
+			case <-done:
+				return
+			}
+		}
+	}
+
+	send := func(endpoint netip.AddrPort) error {
+		is6 := endpoint.Addr().Is6()
+		cc := conns[is6]
+		if cc == nil {
+			var err error
+			if cc, err = listen(config, endpoint); err != nil {
+				return err
+			}
+			conns[is6] = cc
+			readers.Add(1)
+			go read(cc)
+		}
+		_, err := cc.WriteToUDPAddrPort(init, endpoint)
+		return err
+	}
+
+	var winner *net.UDPConn
+	defer func() {
+		// readers are stopped before the socket of the winner is used by the client
+		close(done)
+		for _, cc := range conns {
+			_ = cc.SetReadDeadline(time.Now())
+		}
+		readers.Wait()
+		for _, cc := range conns {
+			if cc != winner {
+				cc.Close()
+			}
+		}
+	}()
+
+	started := map[netip.AddrPort]bool{}
+	next := time.NewTimer(0)
+	defer next.Stop()
+	var expired <-chan time.Time
+	var err error
+	for i := 0; ; {
+		select {
+		case <-next.C:
+			endpoint := endpoints[i]
+			i++
+			delay := HappyEyeballsDelay
+			if err = send(endpoint); err != nil {
+				log.Debugf("can't send handshake to %s: %s", endpoint, err)
+				delay = 0
+			} else {
+				started[endpoint] = true
+			}
+
+			switch {
+			case i < len(endpoints):
+				next.Reset(delay)
+			case len(started) == 0:
+				return netip.AddrPort{}, nil, nil, err
+			default:
+				expired = time.After(HandshakeDelay)
+			}
+		case d := <-received:
+			// the sockets aren't connected, datagrams of others are ignored
+			if !started[d.from] {
+				continue
+			}
+			winner = d.conn
+			return d.from, d.conn, d.buf, nil
+		case <-expired:
+			return netip.AddrPort{}, nil, nil, fmt.Errorf("no handshake response in %s", HandshakeDelay)
+		}
+	}
+}
+
+// resolveServer returns the server endpoints in the order of connection attempts,
+// address families are interleaved starting with IPv6, see RFC 8305.
+func resolveServer(config ClientConfig) ([]netip.AddrPort, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), HandshakeDelay)
+	defer cancel()
+
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", config.ServerInternetAddress)
+	if err != nil {
+		return nil, err
+	}
+	return happyEyeballsOrder(addrs, uint16(config.ServerPort)), nil
+}
+
+func happyEyeballsOrder(addrs []netip.Addr, port uint16) []netip.AddrPort {
+	var v4, v6 []netip.Addr
+	for _, a := range addrs {
+		if a = a.Unmap(); a.Is4() {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+
+	res := make([]netip.AddrPort, 0, len(addrs))
+	for i := 0; i < len(v4) || i < len(v6); i++ {
+		if i < len(v6) {
+			res = append(res, netip.AddrPortFrom(v6[i], port))
+		}
+		if i < len(v4) {
+			res = append(res, netip.AddrPortFrom(v4[i], port))
+		}
+	}
+	return res
+}
+
+// listen opens the socket of the endpoint family. It isn't connected to the server, so
+// peers can reach the client directly through the same NAT mapping.
+// routeSource returns the local address the system chooses for packets to the endpoint,
+// connecting a udp socket sends nothing.
+func routeSource(endpoint netip.AddrPort) (netip.Addr, error) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(endpoint))
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+func listen(config ClientConfig, endpoint netip.AddrPort) (*net.UDPConn, error) {
+	network, local := "udp4", netip.IPv4Unspecified()
+	if endpoint.Addr().Is6() {
+		network, local = "udp6", netip.IPv6Unspecified()
+	}
+	return net.ListenUDP(network, net.UDPAddrFromAddrPort(netip.AddrPortFrom(local, uint16(config.ClientPort))))
 }
@@ -0,0 +1,74 @@
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHappyEyeballsOrder(t *testing.T) {
+	actual := happyEyeballsOrder([]netip.Addr{
+		netip.MustParseAddr("192.0.2.1"),
+		netip.MustParseAddr("192.0.2.2"),
+		netip.MustParseAddr("::ffff:192.0.2.3"),
+		netip.MustParseAddr("2001:db8::1"),
+	}, 1300)
+
+	require.Equal(t, []netip.AddrPort{
+		netip.MustParseAddrPort("[2001:db8::1]:1300"),
+		netip.MustParseAddrPort("192.0.2.1:1300"),
+		netip.MustParseAddrPort("192.0.2.2:1300"),
+		netip.MustParseAddrPort("192.0.2.3:1300"),
+	}, actual)
+}
+
+func TestConnectFirst(t *testing.T) {
+	listen := func() *net.UDPConn {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	slow, silent := listen(), listen()
+	endpoints := []netip.AddrPort{
+		slow.LocalAddr().(*net.UDPAddr).AddrPort(),
+		silent.LocalAddr().(*net.UDPAddr).AddrPort(),
+	}
+
+	// the first endpoint answers after the second one got the init
+	go func() {
+		buf := make([]byte, 16)
+		_, from, err := slow.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		time.Sleep(2 * HappyEyeballsDelay)
+		_, _ = slow.WriteToUDPAddrPort([]byte("response"), from)
+	}()
+
+	start := time.Now()
+	endpoint, cc, buf, err := connectFirst(ClientConfig{}, endpoints, []byte("init"))
+	require.NoError(t, err)
+	defer cc.Close()
+	require.Less(t, time.Since(start), HandshakeDelay)
+	require.Equal(t, endpoints[0], endpoint)
+	require.Equal(t, []byte("response"), buf)
+
+	require.NoError(t, silent.SetReadDeadline(time.Now().Add(time.Second)))
+	init := make([]byte, 16)
+	n, _, err := silent.ReadFromUDPAddrPort(init)
+	require.NoError(t, err)
+	require.Equal(t, []byte("init"), init[:n])
+
+	// the socket of the winner is left to the client
+	local := netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), cc.LocalAddr().(*net.UDPAddr).AddrPort().Port())
+	_, err = slow.WriteToUDPAddrPort([]byte("data"), local)
+	require.NoError(t, err)
+	require.NoError(t, cc.SetReadDeadline(time.Now().Add(time.Second)))
+	n, _, err = cc.ReadFromUDPAddrPort(init)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), init[:n])
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/patsak/stun"
+)
+
+const defaultControlSocket = "/var/run/stun.sock"
+
+var (
+	jsonOutput   bool
+	pingCount    int
+	pingInterval time.Duration
+	pingServer   bool
+)
+
+func statusFlags(fs *flag.FlagSet) {
+	fs.StringVar(&controlSocket, "control", defaultControlSocket, "unix socket of the control api")
+	fs.BoolVar(&jsonOutput, "json", false, "print the response of the control api")
+}
+
+func pingFlags(fs *flag.FlagSet) {
+	fs.StringVar(&controlSocket, "control", defaultControlSocket, "unix socket of the control api")
+	fs.IntVar(&pingCount, "c", 4, "number of messages, 0 pings until interrupt")
+	fs.DurationVar(&pingInterval, "i", time.Second, "interval between messages")
+	fs.BoolVar(&pingServer, "server", false, "ping the server instead of a peer")
+}
+
+// controlClient sends requests to the control api of the running server or client.
+type controlClient struct {
+	http.Client
+}
+
+func newControlClient(path string) *controlClient {
+	return &controlClient{http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}}
+}
+
+// errNotFound is the answer of the control api without the resource.
+var errNotFound = errors.New("not found")
+
+// get decodes the JSON response of the path into v.
+func (c *controlClient) get(ctx context.Context, path string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://stun"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case resp.StatusCode != http.StatusOK:
+		msg, _ := io.ReadAll(resp.Body)
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// runStatus prints the client status, or peers if the control api belongs to a server.
+func runStatus(args []string) error {
+	if len(args) > 0 {
+		return usageError(fmt.Sprintf("unexpected argument %s", args[0]))
+	}
+	c := newControlClient(controlSocket)
+	ctx := context.Background()
+
+	var status stun.ClientStatus
+	err := c.get(ctx, "/status", &status)
+	if errors.Is(err, errNotFound) {
+		var peers []stun.PeerStatus
+		if err := c.get(ctx, "/peers", &peers); err != nil {
+			return err
+		}
+		if jsonOutput {
+			return printJSON(peers)
+		}
+		printPeers(peers)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if jsonOutput {
+		err = printJSON(status)
+	} else {
+		printClientStatus(status)
+	}
+	if err == nil && status.State != "connected" {
+		return exitError(exitNotConnected)
+	}
+	return err
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func printPeers(peers []stun.PeerStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tADDRESS\tADDRESS6\tENDPOINT\tLAST SEEN\tRX\tTX")
+	for _, p := range peers {
+		name := p.Name
+		if name == "" {
+			name = p.PublicKey
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\n", name, addrOrDash(p.Address), addrOrDash(p.Address6),
+			p.InetAddress, since(p.LastSeen), p.RxBytes, p.TxBytes)
+	}
+	w.Flush()
+}
+
+func printClientStatus(s stun.ClientStatus) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "state:\t%s\n", s.State)
+	fmt.Fprintf(w, "server:\t%s (%s)\n", s.Server, s.Endpoint)
+	fmt.Fprintf(w, "address:\t%s\n", addrOrDash(s.Address))
+	if s.Address6.IsValid() {
+		fmt.Fprintf(w, "address6:\t%s\n", s.Address6)
+	}
+	fmt.Fprintf(w, "last seen:\t%s\n", since(s.LastSeen))
+	fmt.Fprintf(w, "routes:\t%d\n", len(s.Routes))
+	w.Flush()
+
+	if len(s.DirectPaths) == 0 {
+		return
+	}
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PEER\tENDPOINT\tSTATE")
+	for _, d := range s.DirectPaths {
+		state := "down"
+		if d.Up {
+			state = "up"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", d.Peer, d.Endpoint, state)
+	}
+	w.Flush()
+}
+
+func addrOrDash(addr netip.Addr) string {
+	if !addr.IsValid() {
+		return "-"
+	}
+	return addr.String()
+}
+
+func since(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Round(time.Second).String() + " ago"
+}
+
+// runPing asks the running client to send keep alive messages to the overlay address
+// or to the server.
+func runPing(args []string) error {
+	query, from := "/ping", "server"
+	switch {
+	case pingServer && len(args) > 0:
+		return usageError(fmt.Sprintf("unexpected argument %s", args[0]))
+	case !pingServer && len(args) != 1:
+		return usageError("overlay address is required")
+	case !pingServer:
+		addr, err := netip.ParseAddr(args[0])
+		if err != nil {
+			return usageError(fmt.Sprintf("overlay address: %s", err))
+		}
+		query, from = "/ping?addr="+url.QueryEscape(addr.String()), addr.String()
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	c := newControlClient(controlSocket)
+
+	var sent, received int
+	var lo, hi, total time.Duration
+	for sent = 0; pingCount == 0 || sent < pingCount; sent++ {
+		if sent > 0 {
+			select {
+			case <-ctx.Done():
+			case <-time.After(pingInterval):
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		var res stun.PingResult
+		if err := c.get(ctx, query, &res); err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			if errors.Is(err, errNotFound) {
+				return errors.New("ping is answered by a running client only")
+			}
+			fmt.Printf("%s: %s\n", from, err)
+			continue
+		}
+		fmt.Printf("ack from %s: time=%s\n", from, res.RTT.Round(time.Microsecond))
+
+		received++
+		total += res.RTT
+		if received == 1 || res.RTT < lo {
+			lo = res.RTT
+		}
+		if res.RTT > hi {
+			hi = res.RTT
+		}
+	}
+
+	fmt.Printf("\n%d sent, %d received", sent, received)
+	if received > 0 {
+		avg := total / time.Duration(received)
+		fmt.Printf(", min/avg/max = %s/%s/%s", lo.Round(time.Microsecond), avg.Round(time.Microsecond), hi.Round(time.Microsecond))
+	}
+	fmt.Println()
+	if received == 0 {
+		return exitError(exitFailure)
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/patsak/stun"
+)
+
+func runGenKey(args []string) error {
+	if len(args) > 0 {
+		return usageError(fmt.Sprintf("unexpected argument %s", args[0]))
+	}
+	key, err := stun.GenerateKey()
+	if err != nil {
+		return err
+	}
+	fmt.Println(key)
+	return nil
+}
+
+func runPubKey(args []string) error {
+	if len(args) > 0 {
+		return usageError(fmt.Sprintf("unexpected argument %s", args[0]))
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return fmt.Errorf("read private key: %w", err)
+	}
+	key, err := stun.PublicKey(strings.TrimSpace(line))
+	if err != nil {
+		return fmt.Errorf("private key: %w", err)
+	}
+	fmt.Println(key)
+	return nil
+}
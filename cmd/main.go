@@ -1,141 +1,130 @@
 package main
 
 import (
-	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
-	"os/signal"
-	"strconv"
 	"strings"
-
-	"github.com/charmbracelet/log"
-	"github.com/patsak/stun"
 )
 
+// exit codes of commands
 const (
-	serverFlag = "server"
-)
-
-var (
-	tunN              int
-	clientPort        int
-	networkCIDR       string
-	peerEndpoint      string
-	forceRouteDomains string
-	verbose           bool
-	server            bool
-	dnsServer         string
+	exitOK = iota
+	exitFailure
+	exitUsage
+	// exitNotConnected is the status of a client which doesn't reach the server
+	exitNotConnected
 )
 
-func init() {
-	flag.BoolVar(&server, serverFlag, false, "server mode")
-	flag.BoolVar(&verbose, "v", false, "verbose output")
-	flag.BoolVar(&verbose, "verbose", false, "verbose output")
-	flag.IntVar(&tunN, "tun-number", 5, "tunnel device id")
-	flag.IntVar(&clientPort, "client-port", 1200, "client port")
-	flag.IntVar(&clientPort, "cp", 1200, "client port")
-	flag.StringVar(&networkCIDR, "n", "192.168.50.1/24", "vpn network")
-	flag.StringVar(&networkCIDR, "network-cidr", "192.168.50.1/24", "vpn network")
-	flag.StringVar(&peerEndpoint, "p", ":1300", "public peer in format ip:port")
-	flag.StringVar(&peerEndpoint, "peer-endpoint", ":1300", "public peer in format ip:port")
-	flag.StringVar(&forceRouteDomains, "f", "", "file with domains to force redirecting traffic via tunnel")
-	flag.StringVar(&forceRouteDomains, "force-route-domains", "", "file with domains to force redirecting traffic via tunnel")
-	flag.StringVar(&dnsServer, "dns-server", "8.8.8.8", "dns server")
+type command struct {
+	name string
+	// args is the synopsis of arguments after flags
+	args  string
+	help  string
+	flags func(fs *flag.FlagSet)
+	run   func(args []string) error
 }
 
-func main() {
-	flag.Parse()
-
-	if verbose {
-		log.Default().SetLevel(log.DebugLevel)
-	}
-
-	tun, err := stun.InitTunDevice(tunN)
-	if err != nil {
-		panic(err)
-	}
-	defer tun.Close()
+var commands = []command{
+	{"server", "", "Run the server.", serverFlags, runServer},
+	{"client", "", "Run the client.", clientFlags, runClient},
+	{"status", "", "Show peers of the running server or the connection of the running client. It exits with 3 if\nthe client doesn't reach the server.", statusFlags, runStatus},
+	{"genkey", "", "Print a new base64 encoded private key.", nil, runGenKey},
+	{"pubkey", "", "Read a private key from stdin and print its public key.", nil, runPubKey},
+	{"ping", "[<overlay address>]", "Measure the round trip time of keep alive messages of the running client over the direct\npath to the peer, or to the server with -server. It exits with 1 if no message is answered.", pingFlags, runPing},
+}
 
-	serverIP, serverPort, err := parseHostAndPort(peerEndpoint)
-	if err != nil {
-		panic(err)
-	}
+// commandFlags are flags of the running command.
+var commandFlags *flag.FlagSet
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	if server {
-		cfg := stun.ServerConfig{
-			ServerPort:  serverPort,
-			NetworkCIDR: networkCIDR,
-		}
-		err := stun.RunServer(ctx, tun, cfg)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		runClient(ctx, tun, serverIP, serverPort, clientPort, networkCIDR, dnsServer)
-	}
+// usageError is a wrong invocation, the command prints its usage.
+type usageError string
 
-	handleInterrupt(cancel)
-
-	<-ctx.Done()
+func (e usageError) Error() string {
+	return string(e)
+}
 
-	log.Info("shutdown")
+// exitError ends the command with the code without a message.
+type exitError int
 
-	if err := ctx.Err(); err != nil && err != context.Canceled {
-		panic(err)
-	}
+func (e exitError) Error() string {
+	return fmt.Sprintf("exit code %d", int(e))
 }
 
-func parseHostAndPort(peerEndpoint string) (string, int, error) {
-	var ip string
-	var port int
-	var err error
-	parts := strings.SplitN(peerEndpoint, ":", 2)
-	ip = parts[0]
-	if len(parts) > 1 {
-		port, err = strconv.Atoi(parts[1])
-		if err != nil {
-			return "", 0, err
-		}
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: stun <command> [flags]\n\ncommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", c.name, summary(c.help))
 	}
-	return ip, port, nil
+	fmt.Fprintf(os.Stderr, "\nRun stun <command> -h for flags of the command.\n")
 }
 
-func handleInterrupt(cancel context.CancelFunc) {
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt)
-	go func() {
-		for sig := range sigCh {
-			if sig == os.Interrupt {
-				cancel()
-			}
-		}
-	}()
+// summary is the first sentence of the help.
+func summary(help string) string {
+	if i := strings.IndexByte(help, '.'); i >= 0 {
+		help = help[:i]
+	}
+	return strings.ReplaceAll(help, "\n", " ")
 }
 
-func runClient(ctx context.Context, tun stun.TunDevice, serverIP string, serverPort int, clientPort int, networkCIDR string, dnsServer string) {
-	cfg := stun.ClientConfig{
-		ServerPort:            serverPort,
-		ServerInternetAddress: serverIP,
-		ClientPort:            clientPort,
-		NetworkCIDR:           networkCIDR,
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
 	}
-	err := stun.RunClient(ctx, tun, cfg)
-	if err != nil {
-		panic(err)
+	name := os.Args[1]
+	switch name {
+	case "help", "-h", "-help", "--help":
+		usage()
+		os.Exit(exitOK)
 	}
 
-	if len(forceRouteDomains) > 0 {
-		f, err := os.Open(forceRouteDomains)
-		if err != nil {
-			panic(err)
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == name {
+			cmd = &commands[i]
 		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(exitUsage)
+	}
 
-		if err := stun.KeepRoutesToDomains(ctx, tun, dnsServer, f); err != nil {
-			f.Close()
-			panic(err)
+	commandFlags = flag.NewFlagSet("stun "+name, flag.ExitOnError)
+	commandFlags.Usage = func() {
+		out := commandFlags.Output()
+		synopsis := "stun " + name
+		if cmd.flags != nil {
+			synopsis += " [flags]"
 		}
-		f.Close()
+		fmt.Fprintf(out, "usage: %s\n\n%s\n", strings.TrimSpace(synopsis+" "+cmd.args), cmd.help)
+		if cmd.flags != nil {
+			fmt.Fprintf(out, "\nflags:\n")
+			commandFlags.PrintDefaults()
+		}
+	}
+	if cmd.flags != nil {
+		cmd.flags(commandFlags)
+	}
+	// flag.ExitOnError exits with 2 on wrong flags and 0 on -h
+	_ = commandFlags.Parse(os.Args[2:])
+
+	err := cmd.run(commandFlags.Args())
+	var usageErr usageError
+	var exitErr exitError
+	switch {
+	case err == nil:
+		os.Exit(exitOK)
+	case errors.As(err, &usageErr):
+		fmt.Fprintf(os.Stderr, "%s\n\n", err)
+		commandFlags.Usage()
+		os.Exit(exitUsage)
+	case errors.As(err, &exitErr):
+		os.Exit(int(exitErr))
+	default:
+		fmt.Fprintf(os.Stderr, "stun %s: %s\n", name, err)
+		os.Exit(exitFailure)
 	}
 }
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/charmbracelet/log"
+	"github.com/patsak/stun"
+)
+
+const defaultNetworkCIDR = "192.168.50.1/24"
+
+var (
+	tunN              int
+	tunQueues         int
+	clientPort        int
+	networkCIDR       string
+	networkCIDR6      string
+	peerEndpoint      string
+	forceRouteDomains string
+	verbose           bool
+	server            bool
+	dnsServer         string
+	preSharedKey      string
+	privateKey        string
+	serverPublicKey   string
+	peers             string
+	nat               bool
+	egressAddress     string
+	aclFile           string
+	controlSocket     string
+	metricsAddress    string
+	configFile        string
+	// filePeers, filePolicy and routeDomains are settings of the config file without flags.
+	filePeers    []stun.PeerConfig
+	filePolicy   stun.PolicyConfig
+	routeDomains []string
+)
+
+// tunnelFlags are flags shared by the server and the client.
+func tunnelFlags(fs *flag.FlagSet) {
+	fs.BoolVar(&verbose, "v", false, "verbose output")
+	fs.BoolVar(&verbose, "verbose", false, "verbose output")
+	fs.StringVar(&configFile, "c", "", "YAML config file, flags override its settings")
+	fs.StringVar(&configFile, "config", "", "YAML config file, flags override its settings")
+	fs.IntVar(&tunN, "tun-number", 5, "tunnel device id")
+	fs.IntVar(&tunQueues, "tun-queues", runtime.NumCPU(), "number of tunnel device queues, linux only")
+	fs.StringVar(&networkCIDR6, "n6", "", "optional IPv6 vpn network, client gets address from server if empty")
+	fs.StringVar(&networkCIDR6, "network-cidr6", "", "optional IPv6 vpn network, client gets address from server if empty")
+	fs.StringVar(&privateKey, "k", "", "base64 encoded private key")
+	fs.StringVar(&privateKey, "private-key", "", "base64 encoded private key")
+	fs.StringVar(&controlSocket, "control", defaultControlSocket, "unix socket of the control api, disabled if empty")
+	fs.StringVar(&metricsAddress, "metrics", "", "listen address of prometheus metrics like localhost:9100, disabled if empty")
+}
+
+func serverFlags(fs *flag.FlagSet) {
+	tunnelFlags(fs)
+	fs.StringVar(&networkCIDR, "n", defaultNetworkCIDR, "vpn network")
+	fs.StringVar(&networkCIDR, "network-cidr", defaultNetworkCIDR, "vpn network")
+	fs.StringVar(&peerEndpoint, "p", ":1300", "listen endpoint, only the port is used")
+	fs.StringVar(&peerEndpoint, "peer-endpoint", ":1300", "listen endpoint, only the port is used")
+	fs.StringVar(&peers, "peers", "", "comma separated allowed clients in format <public key>[@<allowed ip>[@<pre-shared key>]]")
+	fs.BoolVar(&nat, "nat", false, "server masquerades traffic of clients to the internet")
+	fs.StringVar(&egressAddress, "egress-address", "", "IPv4 address of masqueraded traffic, source address of the default route if empty")
+	fs.StringVar(&aclFile, "acl", "", "file with policy rules of traffic forwarded by the server, everything is allowed if empty")
+}
+
+func clientFlags(fs *flag.FlagSet) {
+	tunnelFlags(fs)
+	fs.StringVar(&networkCIDR, "n", "", "requested vpn address, client gets address from server if empty")
+	fs.StringVar(&networkCIDR, "network-cidr", "", "requested vpn address, client gets address from server if empty")
+	fs.StringVar(&peerEndpoint, "p", ":1300", "server endpoint in format host:port or [ipv6]:port")
+	fs.StringVar(&peerEndpoint, "peer-endpoint", ":1300", "server endpoint in format host:port or [ipv6]:port")
+	fs.IntVar(&clientPort, "client-port", 1200, "client port")
+	fs.IntVar(&clientPort, "cp", 1200, "client port")
+	fs.StringVar(&serverPublicKey, "server-public-key", "", "base64 encoded server public key")
+	fs.StringVar(&preSharedKey, "psk", "", "optional base64 encoded 32 bytes pre-shared key")
+	fs.StringVar(&preSharedKey, "pre-shared-key", "", "optional base64 encoded 32 bytes pre-shared key")
+	fs.StringVar(&forceRouteDomains, "f", "", "file with domains to force redirecting traffic via tunnel")
+	fs.StringVar(&forceRouteDomains, "force-route-domains", "", "file with domains to force redirecting traffic via tunnel")
+	fs.StringVar(&dnsServer, "dns-server", "8.8.8.8", "dns server")
+}
+
+func runServer(args []string) error {
+	server = true
+	return runTunnel(args)
+}
+
+func runClient(args []string) error {
+	return runTunnel(args)
+}
+
+// runTunnel runs the server or the client until interrupt.
+func runTunnel(args []string) error {
+	if len(args) > 0 {
+		return usageError(fmt.Sprintf("unexpected argument %s", args[0]))
+	}
+	if configFile != "" {
+		cfg, err := readConfigFile(configFile)
+		if err != nil {
+			return err
+		}
+		applyConfigFile(cfg)
+	}
+
+	if verbose {
+		log.Default().SetLevel(log.DebugLevel)
+	}
+
+	tun, err := stun.InitTunDevice(tunN, tunQueues)
+	if err != nil {
+		return err
+	}
+	defer tun.Close()
+
+	serverIP, serverPort, err := parseHostAndPort(peerEndpoint)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var done <-chan struct{}
+	var reload func() error
+	if server {
+		cfg, err := serverConfig(serverPort)
+		if err != nil {
+			return err
+		}
+		reloadServer, err := stun.RunServer(ctx, tun, cfg)
+		if err != nil {
+			return err
+		}
+		reload = func() error {
+			if err := reloadConfigFile(); err != nil {
+				return err
+			}
+			cfg, err := serverConfig(serverPort)
+			if err != nil {
+				return err
+			}
+			return reloadServer(cfg)
+		}
+	} else {
+		if done, reload, err = startClient(ctx, tun, serverIP, serverPort); err != nil {
+			return err
+		}
+	}
+
+	handleSignals(cancel, reload)
+
+	<-ctx.Done()
+
+	log.Info("shutdown")
+
+	if done != nil {
+		<-done
+	}
+	return nil
+}
+
+// parseHostAndPort accepts host, host:port, [ipv6]:port and bare IPv6 literals, port is 0 if missing.
+func parseHostAndPort(peerEndpoint string) (string, int, error) {
+	host, port, err := net.SplitHostPort(peerEndpoint)
+	if err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(peerEndpoint, "["), "]")
+		if _, perr := netip.ParseAddr(host); perr == nil || !strings.Contains(peerEndpoint, ":") {
+			return host, 0, nil
+		}
+		return "", 0, err
+	}
+	if port == "" {
+		return host, 0, nil
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil {
+		return "", 0, err
+	}
+	return host, p, nil
+}
+
+func parsePeers(s string) ([]stun.PeerConfig, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var res []stun.PeerConfig
+	for _, p := range strings.Split(s, ",") {
+		parts := strings.Split(p, "@")
+		if len(parts) > 3 {
+			return nil, fmt.Errorf("peer %q not in format <public key>[@<allowed ip>[@<pre-shared key>]]", p)
+		}
+		peer := stun.PeerConfig{
+			PublicKey: parts[0],
+		}
+		if len(parts) > 1 && parts[1] != "" {
+			peer.AllowedIPs = []string{parts[1]}
+		}
+		if len(parts) == 3 {
+			peer.PreSharedKey = parts[2]
+		}
+		res = append(res, peer)
+	}
+	return res, nil
+}
+
+// serverConfig collects settings of the server from flags, the config file and files
+// they point to.
+func serverConfig(serverPort int) (stun.ServerConfig, error) {
+	peers, err := parsePeers(peers)
+	if err != nil {
+		return stun.ServerConfig{}, err
+	}
+	if peers == nil {
+		peers = filePeers
+	}
+	policy := filePolicy
+	if aclFile != "" {
+		if policy, err = readPolicy(aclFile); err != nil {
+			return stun.ServerConfig{}, err
+		}
+	}
+	return stun.ServerConfig{
+		ServerPort:     serverPort,
+		NetworkCIDR:    networkCIDR,
+		NetworkCIDR6:   networkCIDR6,
+		PrivateKey:     privateKey,
+		Peers:          peers,
+		NAT:            nat,
+		EgressAddress:  egressAddress,
+		Policy:         policy,
+		ControlSocket:  controlSocket,
+		MetricsAddress: metricsAddress,
+	}, nil
+}
+
+func readPolicy(path string) (stun.PolicyConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return stun.PolicyConfig{}, err
+	}
+	defer f.Close()
+	return stun.ReadPolicy(f)
+}
+
+func readConfigFile(path string) (*stun.FileConfig, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := stun.ReadFileConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// reloadConfigFile applies the config file again.
+func reloadConfigFile() error {
+	if configFile == "" {
+		return nil
+	}
+	cfg, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+	applyConfigFile(cfg)
+	return nil
+}
+
+// isFlagSet reports whether any of the flags is given on the command line.
+func isFlagSet(names ...string) bool {
+	set := false
+	commandFlags.Visit(func(f *flag.Flag) {
+		for _, n := range names {
+			set = set || f.Name == n
+		}
+	})
+	return set
+}
+
+// applyConfigFile sets flag variables from the config file, flags given on the command
+// line keep their values. Settings of a reloaded file replace the previous ones, so
+// settings removed from the file are reset first.
+func applyConfigFile(cfg *stun.FileConfig) {
+	unset := func(names ...string) bool {
+		return !isFlagSet(names...)
+	}
+	filePeers, filePolicy, routeDomains = nil, stun.PolicyConfig{}, nil
+	if unset("f", "force-route-domains") {
+		forceRouteDomains = ""
+	}
+	str := func(dst *string, v string, names ...string) {
+		if v != "" && unset(names...) {
+			*dst = v
+		}
+	}
+	num := func(dst *int, v int, names ...string) {
+		if v != 0 && unset(names...) {
+			*dst = v
+		}
+	}
+
+	if cfg.Verbose && unset("v", "verbose") {
+		verbose = true
+	}
+	if cfg.Tun.Number != nil && unset("tun-number") {
+		tunN = *cfg.Tun.Number
+	}
+	num(&tunQueues, cfg.Tun.Queues, "tun-queues")
+	if cfg.Control != nil && unset("control") {
+		controlSocket = *cfg.Control
+	}
+	str(&metricsAddress, cfg.Metrics, "metrics")
+
+	if server {
+		sc := cfg.ServerConfig()
+		if sc.ServerPort != 0 {
+			str(&peerEndpoint, ":"+strconv.Itoa(sc.ServerPort), "p", "peer-endpoint")
+		}
+		str(&networkCIDR, sc.NetworkCIDR, "n", "network-cidr")
+		str(&networkCIDR6, sc.NetworkCIDR6, "n6", "network-cidr6")
+		str(&privateKey, sc.PrivateKey, "k", "private-key")
+		if sc.NAT && unset("nat") {
+			nat = true
+		}
+		str(&egressAddress, sc.EgressAddress, "egress-address")
+		if unset("peers") {
+			filePeers = sc.Peers
+		}
+		if unset("acl") {
+			filePolicy = sc.Policy
+		}
+		return
+	}
+
+	cc := cfg.ClientConfig()
+	if cc.ServerInternetAddress != "" {
+		str(&peerEndpoint, net.JoinHostPort(cc.ServerInternetAddress, strconv.Itoa(cc.ServerPort)), "p", "peer-endpoint")
+	}
+	num(&clientPort, cc.ClientPort, "client-port", "cp")
+	str(&networkCIDR, cc.NetworkCIDR, "n", "network-cidr")
+	str(&networkCIDR6, cc.NetworkCIDR6, "n6", "network-cidr6")
+	str(&privateKey, cc.PrivateKey, "k", "private-key")
+	str(&serverPublicKey, cc.ServerPublicKey, "server-public-key")
+	str(&preSharedKey, cc.PreSharedKey, "psk", "pre-shared-key")
+	if cfg.Client != nil {
+		str(&dnsServer, cfg.Client.DNS, "dns-server")
+		if unset("f", "force-route-domains") {
+			forceRouteDomains = cfg.Client.Routes.DomainsFile
+			routeDomains = cfg.Client.Routes.Domains
+		}
+	}
+}
+
+// handleSignals cancels on interrupt and reloads settings on SIGHUP.
+func handleSignals(cancel context.CancelFunc, reload func() error) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGHUP)
+	go func() {
+		for sig := range sigCh {
+			switch sig {
+			case os.Interrupt:
+				cancel()
+			case syscall.SIGHUP:
+				log.Info("reload settings")
+				if err := reload(); err != nil {
+					log.Warn("reload", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+func startClient(ctx context.Context, tun stun.TunDevice, serverIP string, serverPort int) (<-chan struct{}, func() error, error) {
+	cfg := stun.ClientConfig{
+		ServerPort:            serverPort,
+		ServerInternetAddress: serverIP,
+		ClientPort:            clientPort,
+		NetworkCIDR:           networkCIDR,
+		NetworkCIDR6:          networkCIDR6,
+		PrivateKey:            privateKey,
+		ServerPublicKey:       serverPublicKey,
+		PreSharedKey:          preSharedKey,
+		ControlSocket:         controlSocket,
+		MetricsAddress:        metricsAddress,
+	}
+	done, err := stun.RunClient(ctx, tun, cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// routing starts with the first list of domains which isn't empty, later lists
+	// replace it
+	var reloadDomains func(io.Reader) error
+	routes := func() error {
+		if reloadDomains == nil && len(forceRouteDomains) == 0 && len(routeDomains) == 0 {
+			return nil
+		}
+		domains, err := openDomains()
+		if err != nil {
+			return err
+		}
+		defer domains.Close()
+		if reloadDomains != nil {
+			return reloadDomains(domains)
+		}
+		reloadDomains, err = stun.KeepRoutesToDomains(ctx, tun, dnsServer, domains)
+		return err
+	}
+	if err := routes(); err != nil {
+		return nil, nil, err
+	}
+
+	return done, func() error {
+		if err := reloadConfigFile(); err != nil {
+			return err
+		}
+		return routes()
+	}, nil
+}
+
+// openDomains returns domains of the config file followed by domains of the file.
+func openDomains() (io.ReadCloser, error) {
+	var domains io.ReadCloser = io.NopCloser(strings.NewReader(strings.Join(routeDomains, "\n") + "\n"))
+	if len(forceRouteDomains) > 0 {
+		f, err := os.Open(forceRouteDomains)
+		if err != nil {
+			return nil, err
+		}
+		domains = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(domains, f), f}
+	}
+	return domains, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHostAndPort(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint string
+		host     string
+		port     int
+	}{
+		{"100.100.100.100:1300", "100.100.100.100", 1300},
+		{"example.com:1300", "example.com", 1300},
+		{"[::1]:1300", "::1", 1300},
+		{"::1", "::1", 0},
+		{"[::1]", "::1", 0},
+		{"example.com", "example.com", 0},
+		{":1300", "", 1300},
+	} {
+		host, port, err := parseHostAndPort(tc.endpoint)
+		require.NoError(t, err, tc.endpoint)
+		require.Equal(t, tc.host, host, tc.endpoint)
+		require.Equal(t, tc.port, port, tc.endpoint)
+	}
+
+	_, _, err := parseHostAndPort("example.com:port")
+	require.Error(t, err)
+}
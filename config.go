@@ -1,13 +1,72 @@
 package stun
 
 type ClientConfig struct {
-	NetworkCIDR           string
+	// NetworkCIDR is the requested overlay address, the server leases one if empty.
+	NetworkCIDR string
+	// NetworkCIDR6 is the requested IPv6 overlay address, the server leases one if empty.
+	NetworkCIDR6          string
 	ClientPort            int
 	ServerInternetAddress string
 	ServerPort            int
+	PrivateKey            string
+	ServerPublicKey       string
+	PreSharedKey          string
+	// ControlSocket is the unix socket of the control API, it's disabled if empty.
+	ControlSocket string
+	// MetricsAddress is the listen address of prometheus metrics, they're disabled if
+	// empty.
+	MetricsAddress string
 }
 
 type ServerConfig struct {
 	ServerPort  int
 	NetworkCIDR string
+	// NetworkCIDR6 is the optional IPv6 overlay network, clients get IPv6 leases if set.
+	NetworkCIDR6 string
+	PrivateKey   string
+	Peers        []PeerConfig
+	// NAT masquerades traffic of clients to the internet with EgressAddress, the source
+	// address of the default route if it's empty.
+	NAT           bool
+	EgressAddress string
+	// Policy restricts traffic forwarded by the server, everything is allowed if it has
+	// no rules. Only clients allowed to exchange all traffic get direct paths, traffic
+	// of other clients is relayed by the server.
+	Policy PolicyConfig
+	// ControlSocket is the unix socket of the control API, it's disabled if empty.
+	ControlSocket string
+	// MetricsAddress is the listen address of prometheus metrics, they're disabled if
+	// empty.
+	MetricsAddress string
+}
+
+// PeerConfig describes a client allowed to connect to the server.
+type PeerConfig struct {
+	Name         string
+	PublicKey    string
+	PreSharedKey string
+	// AllowedIPs are overlay addresses or networks the client may use as source address.
+	AllowedIPs []string
+}
+
+// PolicyConfig is the firewall of the server, rules are matched in order and packets
+// matching no rule are denied.
+type PolicyConfig struct {
+	// Groups are named sets of peer names or public keys.
+	Groups map[string][]string
+	Rules  []RuleConfig
+}
+
+// RuleConfig allows or denies packets of the source peer to the destination.
+type RuleConfig struct {
+	// Action is allow or deny.
+	Action string
+	// From is *, a peer name or public key, or group:<name>.
+	From string
+	// To is *, peers, egress, server or a network of destination addresses.
+	To string
+	// Proto is tcp, udp, icmp or empty for any protocol.
+	Proto string
+	// Ports is a port or a range like 8000-8080 of tcp or udp, empty for any port.
+	Ports string
 }
@@ -0,0 +1,266 @@
+package stun
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// FileConfig is the YAML configuration file of the command. The server section is used
+// in server mode and the client section otherwise.
+type FileConfig struct {
+	Verbose bool `yaml:"verbose"`
+	Tun     struct {
+		// Number is the id of the tunnel device, it's nil if not set.
+		Number *int `yaml:"number"`
+		Queues int  `yaml:"queues"`
+	} `yaml:"tun"`
+	// Control is the unix socket of the control API.
+	Control *string `yaml:"control"`
+	// Metrics is the listen address of prometheus metrics.
+	Metrics string            `yaml:"metrics"`
+	Server  *ServerFileConfig `yaml:"server"`
+	Client  *ClientFileConfig `yaml:"client"`
+}
+
+type ServerFileConfig struct {
+	Port          int           `yaml:"port"`
+	Network       networkString `yaml:"network"`
+	Network6      networkString `yaml:"network6"`
+	PrivateKey    keyString     `yaml:"private_key"`
+	NAT           bool          `yaml:"nat"`
+	EgressAddress addressString `yaml:"egress_address"`
+	Peers         []struct {
+		Name         string            `yaml:"name"`
+		PublicKey    keyString         `yaml:"public_key"`
+		PreSharedKey keyString         `yaml:"pre_shared_key"`
+		AllowedIPs   []allowedIPString `yaml:"allowed_ips"`
+	} `yaml:"peers"`
+	Policy struct {
+		Groups map[string][]string `yaml:"groups"`
+		Rules  []ruleString        `yaml:"rules"`
+	} `yaml:"policy"`
+}
+
+type ClientFileConfig struct {
+	// Server is the server endpoint in format host:port or [ipv6]:port.
+	Server          endpointString `yaml:"server"`
+	Port            int            `yaml:"port"`
+	Network         networkString  `yaml:"network"`
+	Network6        networkString  `yaml:"network6"`
+	PrivateKey      keyString      `yaml:"private_key"`
+	ServerPublicKey keyString      `yaml:"server_public_key"`
+	PreSharedKey    keyString      `yaml:"pre_shared_key"`
+	// DNS is the dns server resolving domains of routes.
+	DNS    string `yaml:"dns"`
+	Routes struct {
+		// Domains are routed through the tunnel in addition to the ones of DomainsFile.
+		Domains     []string `yaml:"domains"`
+		DomainsFile string   `yaml:"domains_file"`
+	} `yaml:"routes"`
+}
+
+// ReadFileConfig parses the YAML configuration, errors point at the line of the value.
+func ReadFileConfig(r io.Reader) (*FileConfig, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var res FileConfig
+	if err := dec.Decode(&res); err != nil {
+		if errors.Is(err, io.EOF) {
+			return &res, nil
+		}
+		return nil, err
+	}
+	if res.Server != nil {
+		for i, p := range res.Server.Peers {
+			if p.PublicKey == "" {
+				var doc yaml.Node
+				if err := yaml.Unmarshal(data, &doc); err != nil {
+					return nil, err
+				}
+				return nil, fmt.Errorf("line %d: peer without public_key", nodeLine(&doc, "server", "peers", i))
+			}
+		}
+	}
+	return &res, nil
+}
+
+// nodeLine returns the line of the value by mapping keys and sequence indexes, or the
+// line of the closest parent if it's missing.
+func nodeLine(n *yaml.Node, path ...any) int {
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	for _, p := range path {
+		var next *yaml.Node
+		switch p := p.(type) {
+		case string:
+			for i := 0; n.Kind == yaml.MappingNode && i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Value == p {
+					next = n.Content[i+1]
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && p < len(n.Content) {
+				next = n.Content[p]
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return n.Line
+}
+
+// ServerConfig returns settings of the server section, it's empty if there is no section.
+func (f *FileConfig) ServerConfig() ServerConfig {
+	s := f.Server
+	if s == nil {
+		return ServerConfig{}
+	}
+	res := ServerConfig{
+		ServerPort:     s.Port,
+		NetworkCIDR:    string(s.Network),
+		NetworkCIDR6:   string(s.Network6),
+		PrivateKey:     string(s.PrivateKey),
+		NAT:            s.NAT,
+		EgressAddress:  string(s.EgressAddress),
+		Policy:         PolicyConfig{Groups: s.Policy.Groups},
+		MetricsAddress: f.Metrics,
+	}
+	for _, p := range s.Peers {
+		peer := PeerConfig{Name: p.Name, PublicKey: string(p.PublicKey), PreSharedKey: string(p.PreSharedKey)}
+		for _, a := range p.AllowedIPs {
+			peer.AllowedIPs = append(peer.AllowedIPs, string(a))
+		}
+		res.Peers = append(res.Peers, peer)
+	}
+	for _, r := range s.Policy.Rules {
+		rule, _ := parseRuleLine(strings.Fields(string(r)))
+		res.Policy.Rules = append(res.Policy.Rules, rule)
+	}
+	if f.Control != nil {
+		res.ControlSocket = *f.Control
+	}
+	return res
+}
+
+// ClientConfig returns settings of the client section, it's empty if there is no section.
+func (f *FileConfig) ClientConfig() ClientConfig {
+	c := f.Client
+	if c == nil {
+		return ClientConfig{}
+	}
+	res := ClientConfig{
+		NetworkCIDR:     string(c.Network),
+		NetworkCIDR6:    string(c.Network6),
+		ClientPort:      c.Port,
+		PrivateKey:      string(c.PrivateKey),
+		ServerPublicKey: string(c.ServerPublicKey),
+		PreSharedKey:    string(c.PreSharedKey),
+		MetricsAddress:  f.Metrics,
+	}
+	if c.Server != "" {
+		host, port, _ := net.SplitHostPort(string(c.Server))
+		res.ServerInternetAddress = host
+		res.ServerPort, _ = strconv.Atoi(port)
+	}
+	if f.Control != nil {
+		res.ControlSocket = *f.Control
+	}
+	return res
+}
+
+// decodeChecked decodes the scalar and checks non-empty values, so the error points at
+// the line of the value.
+func decodeChecked(n *yaml.Node, dst *string, what string, check func(string) error) error {
+	if err := n.Decode(dst); err != nil {
+		return err
+	}
+	if *dst == "" {
+		return nil
+	}
+	if err := check(*dst); err != nil {
+		return fmt.Errorf("line %d: %s %q: %w", n.Line, what, *dst, err)
+	}
+	return nil
+}
+
+// networkString is an address with the prefix length like 192.168.50.1/24.
+type networkString string
+
+func (s *networkString) UnmarshalYAML(n *yaml.Node) error {
+	return decodeChecked(n, (*string)(s), "network", func(v string) error {
+		_, err := netip.ParsePrefix(v)
+		return err
+	})
+}
+
+type addressString string
+
+func (s *addressString) UnmarshalYAML(n *yaml.Node) error {
+	return decodeChecked(n, (*string)(s), "address", func(v string) error {
+		_, err := netip.ParseAddr(v)
+		return err
+	})
+}
+
+// keyString is a base64 encoded key.
+type keyString string
+
+func (s *keyString) UnmarshalYAML(n *yaml.Node) error {
+	return decodeChecked(n, (*string)(s), "key", func(v string) error {
+		_, err := parseKey(v)
+		return err
+	})
+}
+
+type allowedIPString string
+
+func (s *allowedIPString) UnmarshalYAML(n *yaml.Node) error {
+	return decodeChecked(n, (*string)(s), "allowed ip", func(v string) error {
+		_, err := parseAllowedIP(v)
+		return err
+	})
+}
+
+type endpointString string
+
+func (s *endpointString) UnmarshalYAML(n *yaml.Node) error {
+	return decodeChecked(n, (*string)(s), "endpoint", func(v string) error {
+		_, port, err := net.SplitHostPort(v)
+		if err != nil {
+			return err
+		}
+		_, err = strconv.ParseUint(port, 10, 16)
+		return err
+	})
+}
+
+// ruleString is a policy rule in the format of ReadPolicy. The source is resolved when
+// the server starts, everything else is checked here.
+type ruleString string
+
+func (s *ruleString) UnmarshalYAML(n *yaml.Node) error {
+	return decodeChecked(n, (*string)(s), "rule", func(v string) error {
+		rule, err := parseRuleLine(strings.Fields(v))
+		if err != nil {
+			return err
+		}
+		rule.From = "*"
+		_, err = parseRule(rule, nil, nil)
+		return err
+	})
+}
@@ -0,0 +1,86 @@
+package stun
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileConfig(t *testing.T) {
+	serverKey, clientKey := encodeKey(testPrivateKey(t).Bytes()), encodeKey(testPrivateKey(t).Bytes())
+	clientPublicKey := encodeKey(testPrivateKey(t).PublicKey().Bytes())
+	psk := encodeKey(testKey(t))
+
+	cfg, err := ReadFileConfig(strings.NewReader(`
+tun:
+  number: 0
+metrics: localhost:9100
+server:
+  port: 1300
+  network: 192.168.50.1/24
+  private_key: ` + serverKey + `
+  nat: true
+  peers:
+    - name: laptop
+      public_key: ` + clientPublicKey + `
+      pre_shared_key: ` + psk + `
+      allowed_ips: [192.168.50.6]
+  policy:
+    groups:
+      admins: [laptop]
+    rules:
+      - allow group:admins *
+      - allow * egress tcp/443
+client:
+  server: "[2001:db8::1]:1300"
+  private_key: ` + clientKey + `
+  dns: 1.1.1.1
+  routes:
+    domains: [example.com]
+`))
+	require.NoError(t, err)
+	require.Equal(t, 0, *cfg.Tun.Number)
+	require.Nil(t, cfg.Control)
+	require.Equal(t, ServerConfig{
+		ServerPort:  1300,
+		NetworkCIDR: "192.168.50.1/24",
+		PrivateKey:  serverKey,
+		NAT:         true,
+		Peers: []PeerConfig{
+			{Name: "laptop", PublicKey: clientPublicKey, PreSharedKey: psk, AllowedIPs: []string{"192.168.50.6"}},
+		},
+		Policy: PolicyConfig{
+			Groups: map[string][]string{"admins": {"laptop"}},
+			Rules: []RuleConfig{
+				{Action: "allow", From: "group:admins", To: "*"},
+				{Action: "allow", From: "*", To: "egress", Proto: "tcp", Ports: "443"},
+			},
+		},
+		MetricsAddress: "localhost:9100",
+	}, cfg.ServerConfig())
+	require.Equal(t, ClientConfig{
+		ServerInternetAddress: "2001:db8::1",
+		ServerPort:            1300,
+		PrivateKey:            clientKey,
+		MetricsAddress:        "localhost:9100",
+	}, cfg.ClientConfig())
+	require.Equal(t, []string{"example.com"}, cfg.Client.Routes.Domains)
+}
+
+func TestFileConfigErrors(t *testing.T) {
+	for _, tc := range []struct {
+		config string
+		err    string
+	}{
+		{"server:\n  port: 1300\n  network: 192.168.50.1\n", "line 3: network"},
+		{"client:\n  server: example.com\n", "line 2: endpoint"},
+		{"server:\n  peers:\n    - name: a\n      public_key: nope\n", "line 4: key"},
+		{"server:\n  peers:\n    - name: a\n      public_key: " + encodeKey(testKey(t)) + "\n    - name: b\n", "line 5: peer without public_key"},
+		{"server:\n  policy:\n    rules:\n      - allow * egress sctp\n", "line 4: rule"},
+		{"server:\n  port: 1300\n  prot: 1\n", "line 3: field prot not found"},
+	} {
+		_, err := ReadFileConfig(strings.NewReader(tc.config))
+		require.ErrorContains(t, err, tc.err, tc.config)
+	}
+}
@@ -7,6 +7,25 @@ const (
 	KeepAliveRequestDuration       = KeepAliveMaxDuration - 10*time.Second
 	RetryDelay                     = 2 * time.Second
 	HandshakeDelay                 = 5 * time.Second
+	HappyEyeballsDelay             = 250 * time.Millisecond
+	LeaseDuration                  = 24 * time.Hour
 	DeviceMTU                int32 = 1280
-	DeviceBufferSize               = tmsgMaxHeaderSize + int(DeviceMTU)
+	DeviceBufferSize               = tunnelOverhead + int(DeviceMTU)
+	NATTCPTimeout                  = 30 * time.Minute
+	NATTCPClosingTimeout           = 10 * time.Second
+	NATUDPTimeout                  = time.Minute
+	NATICMPTimeout                 = 30 * time.Second
+	NATExpirationInterval          = 10 * time.Second
+	PunchInterval                  = time.Second
+	DirectKeepAliveDuration        = 5 * time.Second
+	DirectPathTimeout              = 3 * DirectKeepAliveDuration
+	DirectPathExpiry               = 30 * time.Second
+	RendezvousInterval             = time.Minute
+	PolicyFlowTimeout              = 5 * time.Minute
+	CaptureDuration                = 30 * time.Second
+	CaptureMaxDuration             = 10 * time.Minute
+	PingTimeout                    = 5 * time.Second
+	VersionReplyInterval           = 100 * time.Millisecond
 )
+
+const tunnelOverhead = envelopeOverhead + tmsgMaxHeaderSize
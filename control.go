@@ -0,0 +1,276 @@
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// PeerStatus is a client connected to the server as listed by the control API.
+type PeerStatus struct {
+	Name        string         `json:"name,omitempty"`
+	PublicKey   string         `json:"public_key"`
+	Address     netip.Addr     `json:"address"`
+	Address6    netip.Addr     `json:"address6"`
+	InetAddress netip.AddrPort `json:"inet_address"`
+	LastSeen    time.Time      `json:"last_seen"`
+	// RxBytes and TxBytes count tunneled traffic of the client.
+	RxBytes uint64 `json:"rx_bytes"`
+	TxBytes uint64 `json:"tx_bytes"`
+}
+
+// ClientStatus is the connection state of the client as reported by the control API.
+type ClientStatus struct {
+	// State is connected while the server answers keep alive messages, connecting
+	// otherwise.
+	State       string             `json:"state"`
+	Server      string             `json:"server"`
+	Endpoint    netip.AddrPort     `json:"endpoint"`
+	Address     netip.Addr         `json:"address"`
+	Address6    netip.Addr         `json:"address6"`
+	LastSeen    time.Time          `json:"last_seen"`
+	DirectPaths []DirectPathStatus `json:"direct_paths"`
+	Routes      []RouteStatus      `json:"routes"`
+}
+
+// DirectPathStatus is a path to another client without the server relay.
+type DirectPathStatus struct {
+	Peer     netip.Addr     `json:"peer"`
+	Endpoint netip.AddrPort `json:"endpoint"`
+	Up       bool           `json:"up"`
+}
+
+// RouteStatus is a route through the tunnel installed for a domain.
+type RouteStatus struct {
+	Address netip.Addr `json:"address"`
+	Domain  string     `json:"domain"`
+}
+
+const (
+	clientConnected  = "connected"
+	clientConnecting = "connecting"
+)
+
+// installedRoutes are routes added by KeepRoutesToDomains.
+var installedRoutes = struct {
+	mu     sync.Mutex
+	routes map[netip.Addr]string
+}{routes: map[netip.Addr]string{}}
+
+func addInstalledRoute(addr netip.Addr, domain string) {
+	installedRoutes.mu.Lock()
+	defer installedRoutes.mu.Unlock()
+	installedRoutes.routes[addr] = domain
+}
+
+func listInstalledRoutes() []RouteStatus {
+	installedRoutes.mu.Lock()
+	defer installedRoutes.mu.Unlock()
+	res := make([]RouteStatus, 0, len(installedRoutes.routes))
+	for addr, domain := range installedRoutes.routes {
+		res = append(res, RouteStatus{Address: addr, Domain: domain})
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Address.Less(res[j].Address) })
+	return res
+}
+
+// serveControl serves the control API on the unix socket until ctx is done. A stale
+// socket of a previous run is replaced, a socket of a running process is not.
+func serveControl(ctx context.Context, path string, handler http.Handler) error {
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %s is in use", path)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return err
+	}
+
+	srv := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warn("control api", "error", err)
+		}
+	}()
+	log.Infof("control api on %s", path)
+	return nil
+}
+
+// unixTime converts unix nanoseconds, zero is the zero time.
+func unixTime(nsec int64) time.Time {
+	if nsec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nsec)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Warn("control api response", "error", err)
+	}
+}
+
+// controlHandler lists peers with GET /peers and kicks a peer by name, public key or
+// overlay address with DELETE /peers?peer=<peer>. POST /capture streams packets in
+// pcapng format.
+func (s *server) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/capture", func(w http.ResponseWriter, r *http.Request) {
+		serveCapture(w, r, s.capturePeer)
+	})
+	mux.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, s.peerStatuses())
+		case http.MethodDelete:
+			ref := r.URL.Query().Get("peer")
+			p := s.findPeer(ref)
+			if p == nil {
+				http.Error(w, fmt.Sprintf("peer %s is not connected", ref), http.StatusNotFound)
+				return
+			}
+			s.kick(p, "kicked by admin")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		}
+	})
+	return mux
+}
+
+func (s *server) connectedPeers() []*peer {
+	items := s.knownSessions.Items()
+	res := make([]*peer, 0, len(items))
+	for _, item := range items {
+		res = append(res, item.Value())
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].peerAddress.Less(res[j].peerAddress) })
+	return res
+}
+
+func (s *server) peerStatuses() []PeerStatus {
+	peers := s.connectedPeers()
+	res := make([]PeerStatus, 0, len(peers))
+	for _, p := range peers {
+		res = append(res, PeerStatus{
+			Name:        p.identity.name,
+			PublicKey:   encodeKey(p.identity.publicKey.Bytes()),
+			Address:     p.peerAddress,
+			Address6:    p.peerAddress6,
+			InetAddress: unmapAddrPort(p.inetAddress()),
+			LastSeen:    unixTime(p.lastSeen.Load()),
+			RxBytes:     p.rxBytes.Load(),
+			TxBytes:     p.txBytes.Load(),
+		})
+	}
+	return res
+}
+
+// findPeer returns the connected peer by name, public key or overlay address.
+func (s *server) findPeer(ref string) *peer {
+	if addr, err := netip.ParseAddr(ref); err == nil {
+		if item := s.knownLocalPeers.Get(addr, ttlcache.WithDisableTouchOnHit[netip.Addr, *peer]()); item != nil {
+			return item.Value()
+		}
+		return nil
+	}
+	id := s.peers.Load().find(ref)
+	if id == nil {
+		return nil
+	}
+	for _, p := range s.connectedPeers() {
+		if p.identity == id {
+			return p
+		}
+	}
+	return nil
+}
+
+// kick forgets the session of the peer and tells the client about it.
+func (s *server) kick(p *peer, reason string) {
+	s.withdrawPaths(func(ends pathEnds) bool { return ends.a == p || ends.b == p })
+	s.evict(p)
+	bts, err := p.session.seal(tmsg{tp: msgTypeDisconnect, addr: p.peerAddress, payload: []byte(reason)})
+	if err == nil {
+		_, err = s.conn.WriteToUDPAddrPort(bts, p.inetAddress())
+	}
+	if err != nil {
+		log.Warn("send disconnect", "error", err)
+	}
+	log.Infof("disconnect peer %s (%s): %s", p.peerAddress, p.identity, reason)
+	publishPeerEvent(p.event(PeerDisconnected, reason))
+}
+
+// controlHandler reports the connection with GET /status and measures the round trip
+// time to an overlay address with GET /ping. POST /capture streams packets in pcapng
+// format.
+func (c *client) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ping", c.servePing)
+	mux.HandleFunc("/capture", func(w http.ResponseWriter, r *http.Request) {
+		serveCapture(w, r, c.capturePeer)
+	})
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.Header().Set("Allow", "GET")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(w, c.status())
+	})
+	return mux
+}
+
+func (c *client) status() ClientStatus {
+	c.mu.RLock()
+	res := ClientStatus{
+		State:    clientConnecting,
+		Server:   c.server,
+		Endpoint: c.endpoint,
+		Address:  c.device.Addr,
+		LastSeen: unixTime(c.lastSeen.Load()),
+		Routes:   listInstalledRoutes(),
+	}
+	if c.device.Prefix6.IsValid() {
+		res.Address6 = c.device.Prefix6.Addr()
+	}
+	paths := make([]DirectPathStatus, 0, len(c.pathSessions))
+	for _, d := range c.pathSessions {
+		paths = append(paths, DirectPathStatus{Peer: d.peer, Endpoint: *d.endpoint.Load(), Up: d.up()})
+	}
+	c.mu.RUnlock()
+
+	sort.Slice(paths, func(i, j int) bool { return paths[i].Peer.Less(paths[j].Peer) })
+	res.DirectPaths = paths
+	if !res.LastSeen.IsZero() && time.Since(res.LastSeen) < KeepAliveMaxDuration {
+		res.State = clientConnected
+	}
+	return res
+}
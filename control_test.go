@@ -0,0 +1,88 @@
+package stun
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlPeers(t *testing.T) {
+	pub := testPrivateKey(t).PublicKey()
+	registry, err := newPeerRegistry([]PeerConfig{{Name: "laptop", PublicKey: encodeKey(pub.Bytes())}})
+	require.NoError(t, err)
+
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	require.NoError(t, err)
+	defer conn.Close()
+	remote, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	require.NoError(t, err)
+	defer remote.Close()
+
+	s := &server{
+		conn:            conn,
+		knownLocalPeers: ttlcache.New[netip.Addr, *peer](),
+		knownSessions:   ttlcache.New[uint32, *peer](),
+	}
+	s.peers.Store(registry)
+	sess, err := newSession(1, make([]byte, keySize), make([]byte, keySize))
+	require.NoError(t, err)
+	p := &peer{peerAddress: netip.MustParseAddr("192.168.50.2"), identity: registry.lookup(pub), session: sess}
+	p.roam(remote.LocalAddr().(*net.UDPAddr).AddrPort())
+	p.rxBytes.Add(10)
+	s.knownLocalPeers.Set(p.peerAddress, p, KeepAliveMaxDuration)
+	s.knownSessions.Set(sess.id, p, KeepAliveMaxDuration)
+
+	path := filepath.Join(t.TempDir(), "control.sock")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	require.NoError(t, serveControl(ctx, path, s.controlHandler()))
+	require.Error(t, serveControl(ctx, path, s.controlHandler()))
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://stun/peers")
+	require.NoError(t, err)
+	var peers []PeerStatus
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&peers))
+	resp.Body.Close()
+	require.Len(t, peers, 1)
+	require.Equal(t, "laptop", peers[0].Name)
+	require.Equal(t, p.peerAddress, peers[0].Address)
+	require.Equal(t, p.inetAddress(), peers[0].InetAddress)
+	require.Equal(t, uint64(10), peers[0].RxBytes)
+
+	kick := func(ref string) int {
+		req, err := http.NewRequest(http.MethodDelete, "http://stun/peers?peer="+ref, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	require.Equal(t, http.StatusNotFound, kick("192.168.50.3"))
+	require.Equal(t, http.StatusNoContent, kick("laptop"))
+	require.Nil(t, s.knownSessions.Get(sess.id))
+	require.Equal(t, http.StatusNotFound, kick("laptop"))
+
+	// the client is told about the kick
+	buf := make([]byte, DeviceBufferSize)
+	require.NoError(t, remote.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := remote.Read(buf)
+	require.NoError(t, err)
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(buf[:n]))
+	msg, err := sess.open(e)
+	require.NoError(t, err)
+	require.Equal(t, msgTypeDisconnect, msg.tp)
+}
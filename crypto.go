@@ -0,0 +1,333 @@
+package stun
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type envelopeKind byte
+
+const (
+	envelopeHandshakeInit     envelopeKind = 1
+	envelopeHandshakeResponse envelopeKind = 2
+	envelopeTransport         envelopeKind = 3
+	// envelopeReject body is a cleartext msgTypeError message, it is sent when
+	// the server can't answer with a handshake response.
+	envelopeReject envelopeKind = 4
+)
+
+// protocolVersion is the first byte of every datagram. It changes on incompatible
+// wire format changes, optional features are negotiated with capabilities instead.
+const protocolVersion byte = 2
+
+const (
+	keySize            = 32
+	envelopeHeaderSize = 1 /*version*/ + 1 /*kind*/ + 4 /*session*/ + 8 /*counter*/
+	envelopeOverhead   = envelopeHeaderSize + chacha20poly1305.Overhead
+)
+
+var (
+	errAuthentication = errors.New("message authentication failed")
+	errReplay         = errors.New("replayed message")
+)
+
+type versionError struct {
+	version byte
+}
+
+func (e versionError) Error() string {
+	return fmt.Sprintf("unsupported protocol version %d, expected %d", e.version, protocolVersion)
+}
+
+// isHandshakeInit reports whether the datagram of any protocol version looks like a
+// handshake init, the header layout is the same in every version.
+func isHandshakeInit(bts []byte) bool {
+	return len(bts) >= envelopeHeaderSize+noiseInitSize && envelopeKind(bts[1]) == envelopeHandshakeInit
+}
+
+// envelope is the datagram sent over the wire. Everything except the header
+// is sealed, the header itself is authenticated as additional data.
+// The session is assigned by the server in the handshake response, it identifies
+// the client regardless of its internet address.
+type envelope struct {
+	kind    envelopeKind
+	session uint32
+	counter uint64
+	body    []byte
+}
+
+func (e envelope) header() []byte {
+	var hdr [envelopeHeaderSize]byte
+	e.putHeader(hdr[:])
+	return hdr[:]
+}
+
+func (e envelope) putHeader(dst []byte) {
+	dst[0] = protocolVersion
+	dst[1] = byte(e.kind)
+	binary.LittleEndian.PutUint32(dst[2:], e.session)
+	binary.LittleEndian.PutUint64(dst[6:], e.counter)
+}
+
+func (e envelope) MarshalBinary() ([]byte, error) {
+	res := make([]byte, 0, envelopeHeaderSize+len(e.body))
+	res = append(res, e.header()...)
+	res = append(res, e.body...)
+	return res, nil
+}
+
+func (e *envelope) UnmarshalBinary(bts []byte) error {
+	if len(bts) > 0 && bts[0] != protocolVersion {
+		return versionError{version: bts[0]}
+	}
+	if len(bts) < envelopeHeaderSize {
+		return fmt.Errorf("%w: envelope length %d less than header size %d", errMalformedMessage, len(bts), envelopeHeaderSize)
+	}
+	e.kind = envelopeKind(bts[1])
+	e.session = binary.LittleEndian.Uint32(bts[2:6])
+	e.counter = binary.LittleEndian.Uint64(bts[6:envelopeHeaderSize])
+	e.body = bts[envelopeHeaderSize:]
+	return nil
+}
+
+// sealPacket builds the envelope and the message headers in the headroom of p and
+// encrypts the message in place. The returned datagram shares memory with p.
+func (e envelope) sealPacket(aead cipher.AEAD, p packetBuf, msg tmsg) ([]byte, error) {
+	start := p.off - msg.headerSize() - envelopeHeaderSize
+	if start < 0 || cap(p.buf)-len(p.buf) < aead.Overhead() {
+		msg.payload = p.payload()
+		p = getPacketBuf(len(msg.payload))
+		copy(p.payload(), msg.payload)
+		start = p.off - msg.headerSize() - envelopeHeaderSize
+	}
+	hdr := p.buf[start : start+envelopeHeaderSize]
+	e.putHeader(hdr)
+	plain := p.buf[start+envelopeHeaderSize:]
+	msg.putHeader(plain)
+	sealed := aead.Seal(plain[:0], nonce(e.counter), plain, hdr)
+	return p.buf[start : start+envelopeHeaderSize+len(sealed)], nil
+}
+
+func (e envelope) seal(aead cipher.AEAD, msg tmsg) ([]byte, error) {
+	p := getPacketBuf(len(msg.payload))
+	copy(p.payload(), msg.payload)
+	return e.sealPacket(aead, p, msg)
+}
+
+// open decrypts the body in place, payload of the message shares memory with the body.
+func (e envelope) open(aead cipher.AEAD) (tmsg, error) {
+	var msg tmsg
+	plain, err := aead.Open(e.body[:0], nonce(e.counter), e.body, e.header())
+	if err != nil {
+		return msg, errAuthentication
+	}
+	if err := msg.UnmarshalBinary(plain); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+func nonce(counter uint64) []byte {
+	var res [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(res[4:], counter)
+	return res[:]
+}
+
+// session holds the keys of one established connection between a client and the server,
+// or of a direct path between two clients.
+type session struct {
+	id      uint32
+	send    cipher.AEAD
+	recv    cipher.AEAD
+	counter atomic.Uint64
+	replay  replayFilter
+}
+
+// newSession returns the session with keys agreed without a handshake.
+func newSession(id uint32, sendKey, recvKey []byte) (*session, error) {
+	send, err := chacha20poly1305.New(sendKey)
+	if err != nil {
+		return nil, err
+	}
+	recv, err := chacha20poly1305.New(recvKey)
+	if err != nil {
+		return nil, err
+	}
+	return &session{id: id, send: send, recv: recv}, nil
+}
+
+func (s *session) seal(msg tmsg) ([]byte, error) {
+	return s.envelope().seal(s.send, msg)
+}
+
+// sealPacket seals the packet stored in p as a message of type tp, see envelope.sealPacket.
+func (s *session) sealPacket(p packetBuf, tp msgType, addr netip.Addr) ([]byte, error) {
+	return s.envelope().sealPacket(s.send, p, tmsg{tp: tp, addr: addr})
+}
+
+func (s *session) envelope() envelope {
+	return envelope{
+		kind:    envelopeTransport,
+		session: s.id,
+		counter: s.counter.Add(1) - 1,
+	}
+}
+
+func (s *session) open(e envelope) (tmsg, error) {
+	if e.kind != envelopeTransport {
+		return tmsg{}, fmt.Errorf("unexpected envelope kind %d", e.kind)
+	}
+	if e.session != s.id {
+		return tmsg{}, fmt.Errorf("unexpected session %d instead %d", e.session, s.id)
+	}
+	// body is decrypted in place, so a replay is rejected before it's clobbered. The
+	// counter isn't authenticated yet, so the drop isn't counted as a replay, anyone may
+	// send a seen counter.
+	if s.replay.seen(e.counter) {
+		return tmsg{}, fmt.Errorf("%w %d", errReplay, e.counter)
+	}
+	msg, err := e.open(s.recv)
+	if err != nil {
+		return msg, err
+	}
+	if !s.replay.accept(e.counter) {
+		countDrop(dropReasonReplay)
+		return tmsg{}, fmt.Errorf("%w %d", errReplay, e.counter)
+	}
+	return msg, nil
+}
+
+func parseKey(s string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("key length %d instead of %d", len(key), keySize)
+	}
+	return key, nil
+}
+
+func parsePrivateKey(s string) (*ecdh.PrivateKey, error) {
+	key, err := parseKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(key)
+}
+
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	key, err := parseKey(s)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(key)
+}
+
+func parsePresharedKey(s string) ([]byte, error) {
+	if s == "" {
+		return nil, nil
+	}
+	return parseKey(s)
+}
+
+func encodeKey(key []byte) string {
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// GenerateKey returns a new base64 encoded X25519 private key.
+func GenerateKey() (string, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return encodeKey(key.Bytes()), nil
+}
+
+// PublicKey returns the base64 encoded public key of the private key.
+func PublicKey(privateKey string) (string, error) {
+	key, err := parsePrivateKey(privateKey)
+	if err != nil {
+		return "", err
+	}
+	return encodeKey(key.PublicKey().Bytes()), nil
+}
+
+// initTimestampSize is the size of the timestamp before the connect message of the
+// handshake init.
+const initTimestampSize = 8
+
+// initEnvelope seals the connect message into the first handshake message. The message
+// is prefixed with the timestamp, so the server rejects replayed inits.
+func (hs *handshakeState) initEnvelope(connect tmsg) ([]byte, error) {
+	hs.timestamp = uint64(time.Now().UnixNano())
+	payload := binary.BigEndian.AppendUint64(nil, hs.timestamp)
+	payload, err := connect.AppendBinary(payload)
+	if err != nil {
+		return nil, err
+	}
+	body, err := hs.writeInit(payload)
+	if err != nil {
+		return nil, err
+	}
+	return envelope{kind: envelopeHandshakeInit, body: body}.MarshalBinary()
+}
+
+func (hs *handshakeState) consumeInit(e envelope) (tmsg, error) {
+	var msg tmsg
+	if e.kind != envelopeHandshakeInit {
+		return msg, fmt.Errorf("unexpected handshake init kind %d", e.kind)
+	}
+	payload, err := hs.readInit(e.body)
+	if err != nil {
+		return msg, err
+	}
+	if len(payload) < initTimestampSize {
+		return msg, fmt.Errorf("%w: handshake init without timestamp", errMalformedMessage)
+	}
+	hs.timestamp = binary.BigEndian.Uint64(payload)
+	if err := msg.UnmarshalBinary(payload[initTimestampSize:]); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+func (hs *handshakeState) responseEnvelope(id uint32, ack tmsg) (*session, []byte, error) {
+	payload, err := ack.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	sess, body, err := hs.writeResponse(payload)
+	if err != nil {
+		return nil, nil, err
+	}
+	sess.id = id
+	bts, err := envelope{kind: envelopeHandshakeResponse, session: id, body: body}.MarshalBinary()
+	return sess, bts, err
+}
+
+func (hs *handshakeState) consumeResponse(e envelope) (*session, tmsg, error) {
+	var msg tmsg
+	if e.kind != envelopeHandshakeResponse {
+		return nil, msg, fmt.Errorf("unexpected handshake response kind %d", e.kind)
+	}
+	sess, payload, err := hs.readResponse(e.body)
+	if err != nil {
+		return nil, msg, err
+	}
+	sess.id = e.session
+	if err := msg.UnmarshalBinary(payload); err != nil {
+		return nil, msg, err
+	}
+	return sess, msg, nil
+}
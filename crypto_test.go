@@ -0,0 +1,205 @@
+package stun
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+func testKey(t *testing.T) []byte {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	require.NoError(t, err)
+	return key
+}
+
+func testPrivateKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	return key
+}
+
+type testSessions struct {
+	client *session
+	server *session
+}
+
+func testHandshake(t *testing.T, clientPSK, serverPSK []byte) (testSessions, error) {
+	clientKey, serverKey := testPrivateKey(t), testPrivateKey(t)
+	connect := tmsg{
+		tp:   msgTypeConnect,
+		addr: netip.MustParseAddr("192.168.4.2"),
+	}
+
+	client := newInitiatorHandshake(clientKey, serverKey.PublicKey(), clientPSK)
+	bts, err := client.initEnvelope(connect)
+	require.NoError(t, err)
+
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(bts))
+	server := newResponderHandshake(serverKey)
+	actual, err := server.consumeInit(e)
+	require.NoError(t, err)
+	require.Equal(t, connect.tp, actual.tp)
+	require.Equal(t, connect.addr, actual.addr)
+	require.True(t, clientKey.PublicKey().Equal(server.rs))
+
+	server.psk = serverPSK
+	serverSession, bts, err := server.responseEnvelope(7, tmsg{tp: msgTypeAck})
+	require.NoError(t, err)
+
+	require.NoError(t, e.UnmarshalBinary(bts))
+	clientSession, ack, err := client.consumeResponse(e)
+	if err != nil {
+		return testSessions{}, err
+	}
+	require.Equal(t, msgTypeAck, ack.tp)
+	return testSessions{client: clientSession, server: serverSession}, nil
+}
+
+func TestHandshake(t *testing.T) {
+	psk := testKey(t)
+	sessions, err := testHandshake(t, psk, psk)
+	require.NoError(t, err)
+
+	data := tmsg{
+		tp:      msgTypeData,
+		addr:    netip.MustParseAddr("192.168.4.2"),
+		payload: []byte{1, 2, 3},
+	}
+	bts, err := sessions.client.seal(data)
+	require.NoError(t, err)
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(bts))
+	actual, err := sessions.server.open(e)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+
+	bts, err = sessions.server.seal(data)
+	require.NoError(t, err)
+	require.NoError(t, e.UnmarshalBinary(bts))
+	actual, err = sessions.client.open(e)
+	require.NoError(t, err)
+	require.Equal(t, data, actual)
+}
+
+func TestHandshakeWithoutPresharedKey(t *testing.T) {
+	_, err := testHandshake(t, nil, nil)
+	require.NoError(t, err)
+}
+
+func TestHandshakePresharedKeyMismatch(t *testing.T) {
+	_, err := testHandshake(t, testKey(t), testKey(t))
+	require.ErrorIs(t, err, errAuthentication)
+}
+
+func TestHandshakeWrongServerKey(t *testing.T) {
+	client := newInitiatorHandshake(testPrivateKey(t), testPrivateKey(t).PublicKey(), nil)
+	bts, err := client.initEnvelope(tmsg{tp: msgTypeConnect})
+	require.NoError(t, err)
+
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(bts))
+	_, err = newResponderHandshake(testPrivateKey(t)).consumeInit(e)
+	require.ErrorIs(t, err, errAuthentication)
+}
+
+func TestOpenTampered(t *testing.T) {
+	sessions, err := testHandshake(t, nil, nil)
+	require.NoError(t, err)
+
+	bts, err := sessions.client.seal(tmsg{tp: msgTypeData, payload: []byte{1}})
+	require.NoError(t, err)
+	bts[len(bts)-1] ^= 1
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(bts))
+	_, err = sessions.server.open(e)
+	require.ErrorIs(t, err, errAuthentication)
+}
+
+func TestParseKey(t *testing.T) {
+	key := testKey(t)
+	actual, err := parseKey(base64.StdEncoding.EncodeToString(key))
+	require.NoError(t, err)
+	require.Equal(t, key, actual)
+
+	_, err = parseKey(base64.StdEncoding.EncodeToString(key[1:]))
+	require.Error(t, err)
+}
+
+func TestEnvelopeVersion(t *testing.T) {
+	bts, err := envelope{kind: envelopeTransport, counter: 1}.MarshalBinary()
+	require.NoError(t, err)
+	bts[0]++
+
+	var e envelope
+	var versionErr versionError
+	require.ErrorAs(t, e.UnmarshalBinary(bts), &versionErr)
+	require.Equal(t, protocolVersion+1, versionErr.version)
+	require.False(t, isHandshakeInit(bts))
+
+	hs := newInitiatorHandshake(testPrivateKey(t), testPrivateKey(t).PublicKey(), nil)
+	init, err := hs.initEnvelope(tmsg{tp: msgTypeConnect})
+	require.NoError(t, err)
+	init[0]++
+	require.True(t, isHandshakeInit(init))
+}
+
+func TestSessionID(t *testing.T) {
+	sessions, err := testHandshake(t, nil, nil)
+	require.NoError(t, err)
+	require.Equal(t, uint32(7), sessions.client.id)
+	require.Equal(t, uint32(7), sessions.server.id)
+
+	bts, err := sessions.client.seal(tmsg{tp: msgTypeKeepAlive})
+	require.NoError(t, err)
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(bts))
+	require.Equal(t, uint32(7), e.session)
+
+	e.session++
+	_, err = sessions.server.open(e)
+	require.Error(t, err)
+}
+
+func TestSealPacket(t *testing.T) {
+	sessions, err := testHandshake(t, nil, nil)
+	require.NoError(t, err)
+
+	addr := netip.MustParseAddr("192.168.4.2")
+	p := getPacketBuf(3)
+	copy(p.payload(), []byte{1, 2, 3})
+	bts, err := sessions.client.sealPacket(p, msgTypeData, addr)
+	require.NoError(t, err)
+	require.Equal(t, &p.buf[p.off-tmsgMinHeaderSize-envelopeHeaderSize], &bts[0], "sealed in place")
+
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(bts))
+	actual, err := sessions.server.open(e)
+	require.NoError(t, err)
+	require.Equal(t, tmsg{tp: msgTypeData, addr: addr, payload: []byte{1, 2, 3}}, actual)
+	require.Equal(t, actual.payload, receivedPacket(bts, actual).payload())
+}
+
+func FuzzSessionOpen(f *testing.F) {
+	aead, err := chacha20poly1305.New(make([]byte, keySize))
+	require.NoError(f, err)
+	sender := &session{id: 1, send: aead}
+	bts, err := sender.seal(tmsg{tp: msgTypeData, addr: netip.MustParseAddr("192.168.4.2"), payload: []byte{1, 2, 3}})
+	require.NoError(f, err)
+	f.Add(bts)
+
+	f.Fuzz(func(t *testing.T, bts []byte) {
+		var e envelope
+		if err := e.UnmarshalBinary(bts); err != nil {
+			return
+		}
+		receiver := &session{id: 1, recv: aead}
+		_, _ = receiver.open(e)
+	})
+}
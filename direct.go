@@ -0,0 +1,350 @@
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"net/netip"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// directPath is a path to another client without the server in the middle. Both
+// clients punch holes in their NATs with keep alive messages to the endpoint the server
+// observed, the path is used while keep alive messages are acknowledged.
+type directPath struct {
+	peer     netip.Addr
+	peer6    netip.Addr
+	session  *session
+	endpoint atomic.Pointer[netip.AddrPort]
+	created  time.Time
+	// acked is the time of the last acknowledged keep alive in unix nanoseconds
+	acked atomic.Int64
+	stop  chan struct{}
+}
+
+func (d *directPath) up() bool {
+	acked := d.acked.Load()
+	return acked != 0 && time.Since(time.Unix(0, acked)) < DirectPathTimeout
+}
+
+// active returns the time the path was known to work or created.
+func (d *directPath) active() time.Time {
+	if acked := d.acked.Load(); acked != 0 {
+		return time.Unix(0, acked)
+	}
+	return d.created
+}
+
+// owns reports whether the peer may send packets from the address.
+func (d *directPath) owns(addr netip.Addr) bool {
+	return addr == d.peer || d.peer6.IsValid() && addr == d.peer6
+}
+
+// addDirectPath replaces the path to the peer with the offered one.
+func (c *client) addDirectPath(peer netip.Addr, offer peerOffer) error {
+	sess, err := newSession(offer.session, offer.sendKey[:], offer.recvKey[:])
+	if err != nil {
+		return err
+	}
+	d := &directPath{
+		peer:    peer,
+		peer6:   offer.addr6,
+		session: sess,
+		created: time.Now(),
+		stop:    make(chan struct{}),
+	}
+	d.endpoint.Store(&offer.endpoint)
+
+	c.mu.Lock()
+	if c.paths == nil {
+		c.paths = map[netip.Addr]*directPath{}
+		c.pathSessions = map[uint32]*directPath{}
+	}
+	if prev := c.paths[peer]; prev != nil {
+		c.removeDirectPathLocked(prev)
+	}
+	c.paths[peer], c.pathSessions[sess.id] = d, d
+	if d.peer6.IsValid() {
+		c.paths[d.peer6] = d
+	}
+	c.mu.Unlock()
+
+	log.Infof("punch direct path to %s at %s", peer, offer.endpoint)
+	go c.punch(d)
+	return nil
+}
+
+// withdrawDirectPath removes the path to the peer if the server withdrew its session.
+func (c *client) withdrawDirectPath(peer netip.Addr, session uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if d := c.pathSessions[session]; d != nil && d.peer == peer {
+		log.Infof("direct path to %s withdrawn by server", peer)
+		c.removeDirectPathLocked(d)
+	}
+}
+
+func (c *client) removeDirectPath(d *directPath) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeDirectPathLocked(d)
+}
+
+func (c *client) removeDirectPathLocked(d *directPath) {
+	if c.pathSessions[d.session.id] != d {
+		return
+	}
+	delete(c.pathSessions, d.session.id)
+	delete(c.paths, d.peer)
+	if d.peer6.IsValid() {
+		delete(c.paths, d.peer6)
+	}
+	close(d.stop)
+}
+
+// punch sends keep alive messages to the peer, often until the path is up. The path is
+// removed if it doesn't work for DirectPathExpiry, the server offers it again later.
+func (c *client) punch(d *directPath) {
+	ticker := time.NewTicker(PunchInterval)
+	defer ticker.Stop()
+
+	var sent time.Time
+	var wasUp bool
+	for {
+		up := d.up()
+		switch {
+		case up && !wasUp:
+			log.Infof("direct path to %s at %s is up", d.peer, d.endpoint.Load())
+		case !up && wasUp:
+			log.Infof("direct path to %s is down, relay through server", d.peer)
+		}
+		wasUp = up
+
+		if !up && time.Since(d.active()) > DirectPathExpiry {
+			log.Infof("remove direct path to %s", d.peer)
+			c.removeDirectPath(d)
+			return
+		}
+		if !up || time.Since(sent) >= DirectKeepAliveDuration {
+			if err := c.sendDirect(d, tmsg{tp: msgTypeKeepAlive, addr: c.deviceInfo().Addr}); err != nil {
+				log.Debugf("direct keep alive to %s: %s", d.peer, err)
+			}
+			sent = time.Now()
+		}
+
+		select {
+		case <-d.stop:
+			return
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *client) sendDirect(d *directPath, msg tmsg) error {
+	bts, err := d.session.seal(msg)
+	if err != nil {
+		return err
+	}
+	_, err = c.get().WriteToUDPAddrPort(bts, *d.endpoint.Load())
+	return err
+}
+
+// directPathTo returns the working path to the overlay address or nil.
+func (c *client) directPathTo(dst netip.Addr) *directPath {
+	c.mu.RLock()
+	d := c.paths[dst]
+	c.mu.RUnlock()
+	if d == nil || !d.up() {
+		return nil
+	}
+	return d
+}
+
+func (c *client) receiveDirect(tun TunDevice, buf []byte, e envelope, addr netip.AddrPort) {
+	c.mu.RLock()
+	d := c.pathSessions[e.session]
+	c.mu.RUnlock()
+	if d == nil {
+		log.Debugf("drop packet from %s with unknown session %d", addr, e.session)
+		return
+	}
+
+	msg, err := d.session.open(e)
+	if err != nil {
+		log.Debug("drop packet", "from", addr, "error", err)
+		return
+	}
+	// the peer is followed when its NAT mapping changes
+	if *d.endpoint.Load() != addr {
+		d.endpoint.Store(&addr)
+	}
+
+	switch msg.tp {
+	case msgTypeKeepAlive:
+		if err := c.sendDirect(d, tmsg{tp: msgTypeAck, addr: c.deviceInfo().Addr}); err != nil {
+			log.Debugf("direct ack to %s: %s", d.peer, err)
+		}
+	case msgTypeAck:
+		now := time.Now().UnixNano()
+		d.acked.Store(now)
+		c.acks.notify(d.session.id, now)
+	case msgTypeData:
+		if !validIPPacket(msg.payload) || !d.owns(ipSrc(msg.payload)) {
+			log.Warnf("drop packet from peer %s with foreign source address", d.peer)
+			return
+		}
+		c.rxPackets.Add(1)
+		c.rxBytes.Add(uint64(len(msg.payload)))
+		capturePacket(captureTunnel, msg.payload)
+		if _, err := tun.Write(receivedPacket(buf, msg).frame()); err != nil {
+			log.Warn("write to device", "error", err)
+		}
+	}
+}
+
+// peerPair is the ordered pair of sessions of clients introduced by the server.
+type peerPair struct {
+	a, b uint32
+}
+
+// pathEnds are clients of a direct path.
+type pathEnds struct {
+	a, b *peer
+}
+
+// introduce offers a direct path to the source and destination clients of relayed
+// traffic, the offer is repeated every RendezvousInterval while the traffic is relayed.
+// With a policy only clients allowed to exchange all traffic are introduced, traffic of
+// others is relayed, so the server enforces it.
+func (s *server) introduce(src *peer, dst netip.Addr) {
+	if !src.capabilities.has(capDirect) || !s.isPrivateNetwork(dst) {
+		return
+	}
+	item := s.knownLocalPeers.Get(dst, ttlcache.WithDisableTouchOnHit[netip.Addr, *peer]())
+	if item == nil {
+		return
+	}
+	target := item.Value()
+	if target == src || !target.capabilities.has(capDirect) {
+		return
+	}
+	if policy := s.policy.Load(); policy != nil && !policy.permitsPath(src, target) {
+		return
+	}
+	// holes are punched only between endpoints of the same family
+	srcEndpoint, dstEndpoint := unmapAddrPort(src.inetAddress()), unmapAddrPort(target.inetAddress())
+	if srcEndpoint.Addr().Is4() != dstEndpoint.Addr().Is4() {
+		return
+	}
+
+	pair := peerPair{src.session.id, target.session.id}
+	if pair.a > pair.b {
+		pair.a, pair.b = pair.b, pair.a
+	}
+	offer := peerOffer{session: s.newSessionID(), endpoint: dstEndpoint, addr6: target.peerAddress6}
+	s.rendezvousMu.Lock()
+	if s.rendezvous.Get(pair, ttlcache.WithDisableTouchOnHit[peerPair, struct{}]()) != nil {
+		s.rendezvousMu.Unlock()
+		return
+	}
+	s.rendezvous.Set(pair, struct{}{}, RendezvousInterval)
+	if s.paths == nil {
+		s.paths = map[uint32]pathEnds{}
+	}
+	// the offer replaces the previous path of the pair on both clients
+	for id, ends := range s.paths {
+		if ends.a == src && ends.b == target || ends.a == target && ends.b == src {
+			delete(s.paths, id)
+		}
+	}
+	s.paths[offer.session] = pathEnds{src, target}
+	s.rendezvousMu.Unlock()
+
+	if _, err := rand.Read(offer.sendKey[:]); err != nil {
+		panic(err)
+	}
+	if _, err := rand.Read(offer.recvKey[:]); err != nil {
+		panic(err)
+	}
+	mirrored := peerOffer{
+		session:  offer.session,
+		endpoint: srcEndpoint,
+		sendKey:  offer.recvKey,
+		recvKey:  offer.sendKey,
+		addr6:    src.peerAddress6,
+	}
+
+	log.Infof("introduce peer %s (%s) to %s (%s)", src.peerAddress, srcEndpoint, target.peerAddress, dstEndpoint)
+	if err := s.sendOffer(src, target.peerAddress, offer); err != nil {
+		log.Warn("send peer offer", "error", err)
+	}
+	if err := s.sendOffer(target, src.peerAddress, mirrored); err != nil {
+		log.Warn("send peer offer", "error", err)
+	}
+}
+
+// withdrawPaths tells both clients of the matching direct paths to drop them, so their
+// traffic passes the server again.
+func (s *server) withdrawPaths(match func(ends pathEnds) bool) {
+	withdrawn := map[uint32]pathEnds{}
+	s.rendezvousMu.Lock()
+	for id, ends := range s.paths {
+		if match(ends) {
+			withdrawn[id] = ends
+			delete(s.paths, id)
+		}
+	}
+	s.rendezvousMu.Unlock()
+
+	for id, ends := range withdrawn {
+		log.Infof("withdraw direct path between %s and %s", ends.a.peerAddress, ends.b.peerAddress)
+		payload := binary.BigEndian.AppendUint32(nil, id)
+		for _, p := range []*peer{ends.a, ends.b} {
+			other := ends.a
+			if p == ends.a {
+				other = ends.b
+			}
+			bts, err := p.session.seal(tmsg{tp: msgTypeUnpeer, addr: other.peerAddress, payload: payload})
+			if err == nil {
+				_, err = s.conn.WriteToUDPAddrPort(bts, p.inetAddress())
+			}
+			if err != nil {
+				log.Warn("send path withdrawal", "error", err)
+			}
+		}
+	}
+}
+
+// forgetPaths forgets direct paths of the peer session without telling clients, the
+// client drops its paths with the session.
+func (s *server) forgetPaths(p *peer) {
+	s.rendezvousMu.Lock()
+	defer s.rendezvousMu.Unlock()
+	for id, ends := range s.paths {
+		if ends.a == p || ends.b == p {
+			delete(s.paths, id)
+		}
+	}
+}
+
+func (s *server) sendOffer(p *peer, addr netip.Addr, offer peerOffer) error {
+	payload, err := offer.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	bts, err := p.session.seal(tmsg{tp: msgTypePeer, addr: addr, payload: payload})
+	if err != nil {
+		return err
+	}
+	_, err = s.conn.WriteToUDPAddrPort(bts, p.inetAddress())
+	return err
+}
+
+func unmapAddrPort(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
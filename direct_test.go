@@ -0,0 +1,83 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testDirectClient(t *testing.T, addr netip.Addr) *client {
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	require.NoError(t, err)
+	sess, err := newSession(1, make([]byte, keySize), make([]byte, keySize))
+	require.NoError(t, err)
+	c := &client{
+		conn:    conn,
+		session: sess,
+		device:  Device{Addr: addr},
+		done:    make(chan struct{}),
+	}
+	go func() {
+		buf := make([]byte, DeviceBufferSize)
+		for {
+			n, from, err := conn.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			c.receivePacket(nil, buf[:n], from)
+		}
+	}()
+	t.Cleanup(func() {
+		close(c.done)
+		conn.Close()
+	})
+	return c
+}
+
+func TestDirectPath(t *testing.T) {
+	a := testDirectClient(t, netip.MustParseAddr("192.168.50.2"))
+	b := testDirectClient(t, netip.MustParseAddr("192.168.50.3"))
+
+	offer := peerOffer{session: 2, endpoint: b.conn.LocalAddr().(*net.UDPAddr).AddrPort()}
+	offer.sendKey[0], offer.recvKey[0] = 1, 2
+	require.NoError(t, a.addDirectPath(b.device.Addr, offer))
+	require.Nil(t, a.directPathTo(b.device.Addr))
+
+	mirrored := peerOffer{
+		session:  2,
+		endpoint: a.conn.LocalAddr().(*net.UDPAddr).AddrPort(),
+		sendKey:  offer.recvKey,
+		recvKey:  offer.sendKey,
+	}
+	require.NoError(t, b.addDirectPath(a.device.Addr, mirrored))
+
+	require.Eventually(t, func() bool {
+		return a.directPathTo(b.device.Addr) != nil && b.directPathTo(a.device.Addr) != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), PingTimeout)
+	defer cancel()
+	res, err := a.ping(ctx, b.device.Addr)
+	require.NoError(t, err)
+	require.Equal(t, b.device.Addr, res.Addr)
+	require.Greater(t, res.RTT, time.Duration(0))
+	_, err = a.ping(ctx, netip.MustParseAddr("192.168.50.4"))
+	require.EqualError(t, err, "no direct path to 192.168.50.4")
+
+	// a new offer replaces the path
+	offer.session = 3
+	require.NoError(t, a.addDirectPath(b.device.Addr, offer))
+	require.Nil(t, a.directPathTo(b.device.Addr))
+	a.mu.RLock()
+	require.Len(t, a.pathSessions, 1)
+	a.mu.RUnlock()
+
+	b.withdrawDirectPath(a.device.Addr, 3)
+	require.NotNil(t, b.directPathTo(a.device.Addr))
+	b.withdrawDirectPath(a.device.Addr, 2)
+	require.Nil(t, b.directPathTo(a.device.Addr))
+}
@@ -0,0 +1,33 @@
+package stun
+
+import "sync/atomic"
+
+type dropReason int
+
+const (
+	dropReasonReplay dropReason = iota
+	dropReasonQueueFull
+	dropReasonPolicy
+	dropReasonCount
+)
+
+var dropReasonNames = [dropReasonCount]string{
+	dropReasonReplay:    "replay",
+	dropReasonQueueFull: "queue_full",
+	dropReasonPolicy:    "policy",
+}
+
+var drops [dropReasonCount]atomic.Uint64
+
+func countDrop(reason dropReason) {
+	drops[reason].Add(1)
+}
+
+// Drops returns number of dropped packets by reason since start.
+func Drops() map[string]uint64 {
+	res := make(map[string]uint64, len(drops))
+	for i := range drops {
+		res[dropReasonNames[i]] = drops[i].Load()
+	}
+	return res
+}
@@ -14,6 +14,8 @@ require (
 	github.com/miekg/dns v1.1.54
 	github.com/stretchr/testify v1.8.2
 	github.com/vishvananda/netlink v1.1.0
+	golang.org/x/crypto v0.7.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -32,5 +34,4 @@ require (
 	golang.org/x/mod v0.7.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
 	golang.org/x/tools v0.3.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -0,0 +1,424 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// virtio_net_hdr from linux/virtio_net.h, the tun device prepends it to packets when
+// it is opened with IFF_VNET_HDR.
+const (
+	virtioNetHdrSize = 10
+
+	virtioNetHdrFNeedsCsum = 1
+
+	virtioNetHdrGSONone  = 0
+	virtioNetHdrGSOTCPv4 = 1
+	virtioNetHdrGSOTCPv6 = 4
+	virtioNetHdrGSOECN   = 0x80
+)
+
+const (
+	tcpFlagFIN = 0x01
+	tcpFlagRST = 0x04
+	tcpFlagPSH = 0x08
+	tcpFlagACK = 0x10
+	tcpFlagCWR = 0x80
+
+	tcpMinHeaderSize = 20
+	// tcpChecksumOffset is the offset of the checksum in the tcp header.
+	tcpChecksumOffset = 16
+
+	// maxGSOSize is the largest packet the device reads or writes with offloads.
+	maxGSOSize = 1<<16 - 1
+
+	// maxTCPGroups is the number of flows coalesced at once.
+	maxTCPGroups = 16
+)
+
+var errGSO = errors.New("malformed gso packet")
+
+// virtioNetHdr is in the native byte order, which is little endian on supported
+// platforms.
+type virtioNetHdr struct {
+	flags      uint8
+	gsoType    uint8
+	hdrLen     uint16
+	gsoSize    uint16
+	csumStart  uint16
+	csumOffset uint16
+}
+
+func (h *virtioNetHdr) decode(b []byte) {
+	h.flags = b[0]
+	h.gsoType = b[1]
+	h.hdrLen = binary.LittleEndian.Uint16(b[2:])
+	h.gsoSize = binary.LittleEndian.Uint16(b[4:])
+	h.csumStart = binary.LittleEndian.Uint16(b[6:])
+	h.csumOffset = binary.LittleEndian.Uint16(b[8:])
+}
+
+func (h virtioNetHdr) encode(b []byte) {
+	b[0] = h.flags
+	b[1] = h.gsoType
+	binary.LittleEndian.PutUint16(b[2:], h.hdrLen)
+	binary.LittleEndian.PutUint16(b[4:], h.gsoSize)
+	binary.LittleEndian.PutUint16(b[6:], h.csumStart)
+	binary.LittleEndian.PutUint16(b[8:], h.csumOffset)
+}
+
+func checksumAdd(b []byte, sum uint64) uint64 {
+	for len(b) >= 2 {
+		sum += uint64(b[0])<<8 | uint64(b[1])
+		b = b[2:]
+	}
+	if len(b) == 1 {
+		sum += uint64(b[0]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint64) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return uint16(sum)
+}
+
+func pseudoHeaderSum(pkt []byte, proto uint8, length int) uint64 {
+	var sum uint64
+	if ipVersion(pkt) == 6 {
+		sum = checksumAdd(pkt[8:40], 0)
+	} else {
+		sum = checksumAdd(pkt[12:20], 0)
+	}
+	return sum + uint64(proto) + uint64(length)
+}
+
+func ipv4HeaderChecksum(pkt []byte) {
+	ihl := int(pkt[0]&0x0f) * 4
+	pkt[10], pkt[11] = 0, 0
+	binary.BigEndian.PutUint16(pkt[10:], ^checksumFold(checksumAdd(pkt[:ihl], 0)))
+}
+
+// completeChecksum computes the checksum the device left partial.
+func completeChecksum(pkt []byte, h virtioNetHdr) error {
+	start, at := int(h.csumStart), int(h.csumStart)+int(h.csumOffset)
+	if at+2 > len(pkt) {
+		return errGSO
+	}
+	// the field holds the sum of the pseudo header
+	binary.BigEndian.PutUint16(pkt[at:], ^checksumFold(checksumAdd(pkt[start:], 0)))
+	return nil
+}
+
+// gsoSegment writes the segment of the tcp super packet with the payload at the
+// offset to dst. It returns the segment length and the offset of the next segment,
+// which is 0 after the last one.
+func gsoSegment(dst, pkt []byte, h virtioNetHdr, off int) (int, int, error) {
+	ipLen := int(h.csumStart)
+	if h.gsoSize == 0 || ipLen+tcpMinHeaderSize > len(pkt) {
+		return 0, 0, errGSO
+	}
+	tcpLen := int(pkt[ipLen+12]>>4) * 4
+	hdrLen := ipLen + tcpLen
+	if tcpLen < tcpMinHeaderSize || hdrLen > len(pkt) || hdrLen+off > len(pkt) {
+		return 0, 0, errGSO
+	}
+
+	payload := pkt[hdrLen:]
+	end := off + int(h.gsoSize)
+	next := end
+	if end >= len(payload) {
+		end, next = len(payload), 0
+	}
+	n := hdrLen + end - off
+	if n > len(dst) {
+		return 0, 0, errGSO
+	}
+	copy(dst, pkt[:hdrLen])
+	copy(dst[hdrLen:], payload[off:end])
+	seg := dst[:n]
+
+	if ipVersion(seg) == 6 {
+		binary.BigEndian.PutUint16(seg[4:], uint16(n-ipv6.HeaderLen))
+	} else {
+		binary.BigEndian.PutUint16(seg[2:], uint16(n))
+		id := binary.BigEndian.Uint16(seg[4:]) + uint16(off/int(h.gsoSize))
+		binary.BigEndian.PutUint16(seg[4:], id)
+		ipv4HeaderChecksum(seg)
+	}
+
+	tcp := seg[ipLen:]
+	binary.BigEndian.PutUint32(tcp[4:], binary.BigEndian.Uint32(tcp[4:])+uint32(off))
+	if off > 0 {
+		tcp[13] &^= tcpFlagCWR
+	}
+	if next != 0 {
+		tcp[13] &^= tcpFlagFIN | tcpFlagPSH
+	}
+	tcp[tcpChecksumOffset], tcp[tcpChecksumOffset+1] = 0, 0
+	sum := checksumAdd(tcp, pseudoHeaderSum(seg, uint8(6), len(tcp)))
+	binary.BigEndian.PutUint16(tcp[tcpChecksumOffset:], ^checksumFold(sum))
+
+	return n, next, nil
+}
+
+// tcpSegment is a tcp packet that may be coalesced with others of its flow.
+type tcpSegment struct {
+	pkt    []byte
+	ipLen  int
+	hdrLen int
+	seq    uint32
+}
+
+func parseTCPSegment(pkt []byte) (tcpSegment, bool) {
+	if !validIPPacket(pkt) {
+		return tcpSegment{}, false
+	}
+	var ipLen int
+	if ipVersion(pkt) == 6 {
+		ipLen = ipv6.HeaderLen
+		if pkt[6] != 6 || int(binary.BigEndian.Uint16(pkt[4:]))+ipLen != len(pkt) {
+			return tcpSegment{}, false
+		}
+	} else {
+		// header without options and not fragmented
+		ipLen = ipv4.HeaderLen
+		if pkt[0]&0x0f != 5 || pkt[9] != 6 || binary.BigEndian.Uint16(pkt[6:])&0x3fff != 0 ||
+			int(binary.BigEndian.Uint16(pkt[2:])) != len(pkt) {
+			return tcpSegment{}, false
+		}
+	}
+	if ipLen+tcpMinHeaderSize > len(pkt) {
+		return tcpSegment{}, false
+	}
+	tcp := pkt[ipLen:]
+	hdrLen := ipLen + int(tcp[12]>>4)*4
+	if hdrLen < ipLen+tcpMinHeaderSize || hdrLen >= len(pkt) {
+		return tcpSegment{}, false
+	}
+	if flags := tcp[13]; flags&^tcpFlagPSH != tcpFlagACK {
+		return tcpSegment{}, false
+	}
+
+	return tcpSegment{
+		pkt:    pkt,
+		ipLen:  ipLen,
+		hdrLen: hdrLen,
+		seq:    binary.BigEndian.Uint32(tcp[4:]),
+	}, true
+}
+
+// parseTCPFlow returns the tcp packet which isn't coalesced, only addresses and ports of
+// it are used.
+func parseTCPFlow(pkt []byte) (tcpSegment, bool) {
+	if !validIPPacket(pkt) {
+		return tcpSegment{}, false
+	}
+	ipLen := ipv6.HeaderLen
+	if ipVersion(pkt) == 6 {
+		if pkt[6] != 6 {
+			return tcpSegment{}, false
+		}
+	} else {
+		// fragments after the first one don't have ports
+		ipLen = int(pkt[0]&0x0f) * 4
+		if pkt[9] != 6 || binary.BigEndian.Uint16(pkt[6:])&0x1fff != 0 {
+			return tcpSegment{}, false
+		}
+	}
+	if ipLen+4 > len(pkt) {
+		return tcpSegment{}, false
+	}
+	return tcpSegment{pkt: pkt, ipLen: ipLen}, true
+}
+
+func (s tcpSegment) payloadLen() int {
+	return len(s.pkt) - s.hdrLen
+}
+
+// sameFlow compares addresses and ports.
+func (s tcpSegment) sameFlow(o tcpSegment) bool {
+	if ipVersion(s.pkt) != ipVersion(o.pkt) {
+		return false
+	}
+	addrs := [2]int{12, 20}
+	if ipVersion(s.pkt) == 6 {
+		addrs = [2]int{8, 40}
+	}
+	return bytes.Equal(s.pkt[addrs[0]:addrs[1]], o.pkt[addrs[0]:addrs[1]]) &&
+		bytes.Equal(s.pkt[s.ipLen:s.ipLen+4], o.pkt[o.ipLen:o.ipLen+4])
+}
+
+// mergeable compares the headers that must be the same in coalesced segments, it is
+// the ip header except lengths, id and checksum, the ack number and tcp options.
+func (s tcpSegment) mergeable(o tcpSegment) bool {
+	if s.hdrLen != o.hdrLen {
+		return false
+	}
+	if s.ipLen == ipv4.HeaderLen {
+		// tos, don't fragment bit and ttl
+		if s.pkt[1] != o.pkt[1] || s.pkt[6]&0x40 != o.pkt[6]&0x40 || s.pkt[8] != o.pkt[8] {
+			return false
+		}
+	} else if !bytes.Equal(s.pkt[:4], o.pkt[:4]) || s.pkt[7] != o.pkt[7] {
+		return false
+	}
+	return bytes.Equal(s.pkt[s.ipLen+8:s.ipLen+12], o.pkt[o.ipLen+8:o.ipLen+12]) &&
+		bytes.Equal(s.pkt[s.ipLen+tcpMinHeaderSize:s.hdrLen], o.pkt[o.ipLen+tcpMinHeaderSize:o.hdrLen])
+}
+
+// tcpGroup coalesces consecutive segments of a flow into a super packet.
+type tcpGroup struct {
+	buf     []byte
+	first   tcpSegment
+	gsoSize int
+	count   int
+	nextSeq uint32
+	// closed is set after a segment shorter than gsoSize or with PSH flag
+	closed bool
+}
+
+func (g *tcpGroup) reset(s tcpSegment) {
+	g.buf = append(g.buf[:0], s.pkt...)
+	g.first = s
+	g.first.pkt = g.buf
+	g.gsoSize = s.payloadLen()
+	g.count = 1
+	g.nextSeq = s.seq + uint32(g.gsoSize)
+	g.closed = s.pkt[s.ipLen+13]&tcpFlagPSH != 0
+}
+
+// add appends the segment if it continues the group.
+func (g *tcpGroup) add(s tcpSegment) bool {
+	if g.closed || s.seq != g.nextSeq || s.payloadLen() > g.gsoSize ||
+		len(g.buf)+s.payloadLen() > maxGSOSize || !g.first.mergeable(s) {
+		return false
+	}
+	g.buf = append(g.buf, s.pkt[s.hdrLen:]...)
+	g.first.pkt = g.buf
+	g.count++
+	g.nextSeq += uint32(s.payloadLen())
+	if psh := s.pkt[s.ipLen+13] & tcpFlagPSH; psh != 0 || s.payloadLen() < g.gsoSize {
+		g.buf[g.first.ipLen+13] |= psh
+		g.closed = true
+	}
+	return true
+}
+
+// packet returns the coalesced packet and its virtio header. The checksum is left to
+// the device, as segments are already verified by the authentication of messages.
+func (g *tcpGroup) packet() (virtioNetHdr, []byte) {
+	if g.count == 1 {
+		return virtioNetHdr{}, g.buf
+	}
+
+	pkt, ipLen := g.buf, g.first.ipLen
+	h := virtioNetHdr{
+		flags:      virtioNetHdrFNeedsCsum,
+		hdrLen:     uint16(g.first.hdrLen),
+		gsoSize:    uint16(g.gsoSize),
+		csumStart:  uint16(ipLen),
+		csumOffset: tcpChecksumOffset,
+	}
+	if ipLen == ipv4.HeaderLen {
+		h.gsoType = virtioNetHdrGSOTCPv4
+		binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+		ipv4HeaderChecksum(pkt)
+	} else {
+		h.gsoType = virtioNetHdrGSOTCPv6
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)-ipLen))
+	}
+	// partial checksum is the sum of the pseudo header
+	sum := pseudoHeaderSum(pkt, uint8(6), len(pkt)-ipLen)
+	binary.BigEndian.PutUint16(pkt[ipLen+tcpChecksumOffset:], checksumFold(sum))
+	return h, pkt
+}
+
+// tcpCoalescer coalesces tcp segments of flows until flush. Other packets are written
+// right away after the segments of their flow, so packets of a flow keep their order.
+type tcpCoalescer struct {
+	groups []*tcpGroup
+	active int
+	write  func(h virtioNetHdr, pkt []byte) error
+}
+
+func newTCPCoalescer(write func(h virtioNetHdr, pkt []byte) error) *tcpCoalescer {
+	c := &tcpCoalescer{groups: make([]*tcpGroup, maxTCPGroups), write: write}
+	for i := range c.groups {
+		c.groups[i] = &tcpGroup{}
+	}
+	return c
+}
+
+func (c *tcpCoalescer) add(pkt []byte) error {
+	s, ok := parseTCPSegment(pkt)
+	if !ok {
+		if f, ok := parseTCPFlow(pkt); ok {
+			if err := c.flushFlow(f); err != nil {
+				return err
+			}
+		}
+		return c.write(virtioNetHdr{}, pkt)
+	}
+
+	for i := 0; i < c.active; i++ {
+		g := c.groups[i]
+		if !g.first.sameFlow(s) {
+			continue
+		}
+		if g.add(s) {
+			return nil
+		}
+		// the flow continues in a new group after the current one is written
+		if err := c.writeGroup(g); err != nil {
+			return err
+		}
+		g.reset(s)
+		return nil
+	}
+
+	if c.active == len(c.groups) {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	c.groups[c.active].reset(s)
+	c.active++
+	return nil
+}
+
+// flushFlow writes the group of the flow of the segment.
+func (c *tcpCoalescer) flushFlow(s tcpSegment) error {
+	for i := 0; i < c.active; i++ {
+		g := c.groups[i]
+		if !g.first.sameFlow(s) {
+			continue
+		}
+		c.active--
+		c.groups[i], c.groups[c.active] = c.groups[c.active], g
+		return c.writeGroup(g)
+	}
+	return nil
+}
+
+func (c *tcpCoalescer) flush() error {
+	var err error
+	for _, g := range c.groups[:c.active] {
+		if werr := c.writeGroup(g); err == nil {
+			err = werr
+		}
+	}
+	c.active = 0
+	return err
+}
+
+func (c *tcpCoalescer) writeGroup(g *tcpGroup) error {
+	h, pkt := g.packet()
+	return c.write(h, pkt)
+}
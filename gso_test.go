@@ -0,0 +1,181 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+func testTCPPacket(t *testing.T, version int, seq uint32, payload []byte) []byte {
+	tcp := &layers.TCP{
+		SrcPort: 4000,
+		DstPort: 443,
+		Seq:     seq,
+		Ack:     7,
+		ACK:     true,
+		PSH:     true,
+		Window:  1000,
+		Options: []layers.TCPOption{{OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)}},
+	}
+	var ip gopacket.SerializableLayer
+	if version == 6 {
+		ip6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   64,
+			NextHeader: layers.IPProtocolTCP,
+			SrcIP:      net.ParseIP("fd00:50::2"),
+			DstIP:      net.ParseIP("fd00:50::3"),
+		}
+		require.NoError(t, tcp.SetNetworkLayerForChecksum(ip6))
+		ip = ip6
+	} else {
+		ip4 := &layers.IPv4{
+			Version:  4,
+			TTL:      64,
+			Id:       100,
+			Flags:    layers.IPv4DontFragment,
+			Protocol: layers.IPProtocolTCP,
+			SrcIP:    net.IPv4(192, 168, 50, 2),
+			DstIP:    net.IPv4(192, 168, 50, 3),
+		}
+		require.NoError(t, tcp.SetNetworkLayerForChecksum(ip4))
+		ip = ip4
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, tcp, gopacket.Payload(payload)))
+	return buf.Bytes()
+}
+
+func requireChecksums(t *testing.T, pkt []byte, ipLen int) {
+	if ipLen == 20 {
+		require.Equal(t, uint16(0xffff), checksumFold(checksumAdd(pkt[:ipLen], 0)), "ip checksum")
+	}
+	sum := checksumAdd(pkt[ipLen:], pseudoHeaderSum(pkt, 6, len(pkt)-ipLen))
+	require.Equal(t, uint16(0xffff), checksumFold(sum), "tcp checksum")
+}
+
+func TestGSO(t *testing.T) {
+	for _, version := range []int{4, 6} {
+		const mss = 100
+		payload := make([]byte, 3*mss+50)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		super := testTCPPacket(t, version, 1000, payload)
+		ipLen := 20
+		h := virtioNetHdr{gsoType: virtioNetHdrGSOTCPv4, gsoSize: mss, csumStart: 20, csumOffset: tcpChecksumOffset}
+		if version == 6 {
+			ipLen, h.gsoType, h.csumStart = 40, virtioNetHdrGSOTCPv6, 40
+		}
+
+		var segments [][]byte
+		for off := 0; ; {
+			dst := make([]byte, 1500)
+			n, next, err := gsoSegment(dst, super, h, off)
+			require.NoError(t, err)
+			segments = append(segments, dst[:n])
+			if next == 0 {
+				break
+			}
+			off = next
+		}
+		require.Len(t, segments, 4)
+
+		var g tcpGroup
+		for i, seg := range segments {
+			requireChecksums(t, seg, ipLen)
+			s, ok := parseTCPSegment(seg)
+			require.True(t, ok)
+			require.Equal(t, uint32(1000+i*mss), s.seq)
+			require.Equal(t, payload[i*mss:i*mss+s.payloadLen()], seg[s.hdrLen:])
+			require.Equal(t, i == len(segments)-1, seg[ipLen+13]&tcpFlagPSH != 0)
+
+			if i == 0 {
+				g.reset(s)
+				continue
+			}
+			require.True(t, g.add(s))
+		}
+		// nothing continues a segment shorter than the others
+		s, _ := parseTCPSegment(testTCPPacket(t, version, g.nextSeq, []byte{1}))
+		require.False(t, g.add(s))
+
+		h, pkt := g.packet()
+		require.Equal(t, uint16(mss), h.gsoSize)
+		require.Equal(t, virtioNetHdrFNeedsCsum, int(h.flags))
+		require.Equal(t, len(super), len(pkt))
+
+		// coalesced packet is split into the same segments
+		for i, off := 0, 0; ; i++ {
+			dst := make([]byte, 1500)
+			n, next, err := gsoSegment(dst, pkt, h, off)
+			require.NoError(t, err)
+			require.Equal(t, segments[i], dst[:n])
+			if next == 0 {
+				break
+			}
+			off = next
+		}
+	}
+}
+
+func TestCoalesceDifferentFlows(t *testing.T) {
+	a, ok := parseTCPSegment(testTCPPacket(t, 4, 1, make([]byte, 10)))
+	require.True(t, ok)
+
+	pkt := testTCPPacket(t, 4, 11, make([]byte, 10))
+	binary.BigEndian.PutUint16(pkt[20:], 4001)
+	b, ok := parseTCPSegment(pkt)
+	require.True(t, ok)
+	require.False(t, a.sameFlow(b))
+
+	// changed ack number doesn't continue the group
+	pkt = testTCPPacket(t, 4, 11, make([]byte, 10))
+	pkt[20+8]++
+	c, ok := parseTCPSegment(pkt)
+	require.True(t, ok)
+	require.True(t, a.sameFlow(c))
+	require.False(t, a.mergeable(c))
+
+	// segments with data only
+	_, ok = parseTCPSegment(testTCPPacket(t, 4, 1, nil))
+	require.False(t, ok)
+}
+
+func TestCompleteChecksum(t *testing.T) {
+	pkt := testTCPPacket(t, 4, 1, []byte{1, 2, 3})
+	expected := bytes.Clone(pkt)
+
+	// the device leaves the sum of the pseudo header
+	binary.BigEndian.PutUint16(pkt[20+tcpChecksumOffset:], checksumFold(pseudoHeaderSum(pkt, 6, len(pkt)-20)))
+	require.NoError(t, completeChecksum(pkt, virtioNetHdr{csumStart: 20, csumOffset: tcpChecksumOffset}))
+	require.Equal(t, expected, pkt)
+}
+
+func TestCoalescerFlowOrder(t *testing.T) {
+	var written [][]byte
+	c := newTCPCoalescer(func(_ virtioNetHdr, pkt []byte) error {
+		written = append(written, bytes.Clone(pkt))
+		return nil
+	})
+
+	other := testTCPPacket(t, 4, 1, make([]byte, 10))
+	binary.BigEndian.PutUint16(other[20:], 4001)
+	data := testTCPPacket(t, 4, 1, make([]byte, 10))
+	fin := testTCPPacket(t, 4, 11, nil)
+	fin[20+13] |= tcpFlagFIN
+	require.NoError(t, c.add(other))
+	require.NoError(t, c.add(data))
+	require.NoError(t, c.add(fin))
+
+	// the fin follows the data of its flow, the other flow waits for flush
+	require.Equal(t, [][]byte{data, fin}, written)
+	require.NoError(t, c.flush())
+	require.Equal(t, [][]byte{data, fin, other}, written)
+}
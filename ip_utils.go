@@ -1,17 +1,116 @@
 package stun
 
 import (
-	"net"
+	"encoding/binary"
+	"net/netip"
 
 	"github.com/google/gopacket/layers"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
 )
 
 type rawPacket []byte
 
-func ipv4Dst(raw rawPacket) net.IP {
-	return net.IP(raw[16 : 16+4])
+func ipVersion(raw rawPacket) int {
+	if len(raw) == 0 {
+		return 0
+	}
+	return int(raw[0] >> 4)
 }
 
-func ipv4Proto(raw rawPacket) layers.IPProtocol {
+// validIPPacket reports whether the packet is long enough to hold its IP header.
+func validIPPacket(raw rawPacket) bool {
+	switch ipVersion(raw) {
+	case ipv4.Version:
+		return len(raw) >= ipv4.HeaderLen
+	case ipv6.Version:
+		return len(raw) >= ipv6.HeaderLen
+	default:
+		return false
+	}
+}
+
+func ipSrc(raw rawPacket) netip.Addr {
+	if ipVersion(raw) == ipv6.Version {
+		return netip.AddrFrom16([16]byte(raw[8 : 8+16]))
+	}
+	return netip.AddrFrom4([4]byte(raw[12 : 12+4]))
+}
+
+func ipDst(raw rawPacket) netip.Addr {
+	if ipVersion(raw) == ipv6.Version {
+		return netip.AddrFrom16([16]byte(raw[24 : 24+16]))
+	}
+	return netip.AddrFrom4([4]byte(raw[16 : 16+4]))
+}
+
+// ipProto returns the transport protocol, IPv6 extension headers are not followed.
+func ipProto(raw rawPacket) layers.IPProtocol {
+	if ipVersion(raw) == ipv6.Version {
+		return layers.IPProtocol(raw[6])
+	}
 	return layers.IPProtocol(raw[9])
 }
+
+// ipPorts returns ports of tcp and udp packets, ok is false for other protocols and for
+// IPv4 fragments after the first one.
+func ipPorts(raw rawPacket) (src, dst uint16, ok bool) {
+	hdrLen := ipv6.HeaderLen
+	if ipVersion(raw) == ipv4.Version {
+		if binary.BigEndian.Uint16(raw[6:8])&0x1fff != 0 {
+			return 0, 0, false
+		}
+		hdrLen = int(raw[0]&0x0f) * 4
+	}
+	switch ipProto(raw) {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP:
+	default:
+		return 0, 0, false
+	}
+	if len(raw) < hdrLen+4 {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint16(raw[hdrLen:]), binary.BigEndian.Uint16(raw[hdrLen+2:]), true
+}
+
+// flowHash hashes the 5-tuple of the packet with FNV-1a, packets of one flow get the same hash.
+// Ports are left out of IPv4 fragments, because only the first fragment has them.
+func flowHash(raw rawPacket) uint32 {
+	const prime = 16777619
+	h := uint32(2166136261)
+	mix := func(bts []byte) {
+		for _, b := range bts {
+			h ^= uint32(b)
+			h *= prime
+		}
+	}
+
+	if !validIPPacket(raw) {
+		return h
+	}
+
+	var hdrLen int
+	ports := true
+	switch ipVersion(raw) {
+	case ipv4.Version:
+		mix(raw[12:20])
+		hdrLen = int(raw[0]&0x0f) * 4
+		ports = binary.BigEndian.Uint16(raw[6:8])&0x3fff == 0
+	case ipv6.Version:
+		mix(raw[8:40])
+		hdrLen = ipv6.HeaderLen
+	default:
+		return h
+	}
+
+	proto := ipProto(raw)
+	h ^= uint32(proto)
+	h *= prime
+	switch proto {
+	case layers.IPProtocolTCP, layers.IPProtocolUDP, layers.IPProtocolSCTP, layers.IPProtocolUDPLite:
+		if ports && len(raw) >= hdrLen+4 {
+			mix(raw[hdrLen : hdrLen+4])
+		}
+	}
+	return h
+}
@@ -0,0 +1,41 @@
+package stun
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPHeader(t *testing.T) {
+	src, dst := netip.MustParseAddr("fd00::2"), netip.MustParseAddr("fd00::3")
+	buf := gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true},
+		&layers.IPv6{Version: 6, NextHeader: layers.IPProtocolUDP, SrcIP: src.AsSlice(), DstIP: dst.AsSlice()},
+		gopacket.Payload{1, 2, 3}))
+
+	raw := buf.Bytes()
+	require.True(t, validIPPacket(raw))
+	require.Equal(t, src, ipSrc(raw))
+	require.Equal(t, dst, ipDst(raw))
+	require.Equal(t, layers.IPProtocolUDP, ipProto(raw))
+	require.Equal(t, tunFrameIPV6Header, tunFrameHeaderOf(raw))
+	require.False(t, validIPPacket(raw[:39]))
+}
+
+func TestFlowHash(t *testing.T) {
+	packet := func(srcPort layers.UDPPort, payload byte) []byte {
+		ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP,
+			SrcIP: netip.MustParseAddr("192.168.4.2").AsSlice(), DstIP: netip.MustParseAddr("192.168.4.3").AsSlice()}
+		udp := &layers.UDP{SrcPort: srcPort, DstPort: 53}
+		buf := gopacket.NewSerializeBuffer()
+		require.NoError(t, gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, ip, udp, gopacket.Payload{payload}))
+		return buf.Bytes()
+	}
+
+	require.Equal(t, flowHash(packet(1000, 1)), flowHash(packet(1000, 2)))
+	require.NotEqual(t, flowHash(packet(1000, 1)), flowHash(packet(1001, 1)))
+	require.NotPanics(t, func() { flowHash([]byte{0x45, 0}) })
+}
@@ -0,0 +1,143 @@
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+
+	"github.com/jellydator/ttlcache/v3"
+)
+
+var (
+	errAddressOutsideNetwork = errors.New("address outside network")
+	errAddressNotAllowed     = errors.New("address not allowed")
+	errAddressInUse          = errors.New("address in use")
+	errNoFreeAddress         = errors.New("no free address")
+)
+
+// leases hands out overlay addresses to clients. A lease belongs to the client
+// identity, so reconnecting clients get the same address back.
+type leases struct {
+	mu      sync.Mutex
+	network netip.Prefix
+	peers   *peerRegistry
+	byKey   *ttlcache.Cache[[keySize]byte, netip.Addr]
+	// byAddr is the client of every leased address, expired leases are removed when
+	// their address is checked
+	byAddr map[netip.Addr][keySize]byte
+}
+
+func newLeases(network netip.Prefix, peers *peerRegistry) *leases {
+	return &leases{
+		network: network,
+		peers:   peers,
+		byKey:   ttlcache.New[[keySize]byte, netip.Addr](),
+		byAddr:  map[netip.Addr][keySize]byte{},
+	}
+}
+
+// acquire returns the address leased to the client. Unspecified requested address means
+// any address, the previous lease of the client is preferred in this case.
+func (l *leases) acquire(id *identity, requested netip.Addr) (netip.Addr, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := [keySize]byte(id.publicKey.Bytes())
+	if !requested.IsValid() || requested.IsUnspecified() {
+		if current := l.byKey.Get(key); current != nil {
+			return current.Value(), nil
+		}
+		free, err := l.free(id, key)
+		if err != nil {
+			return netip.Addr{}, err
+		}
+		requested = free
+	}
+
+	if err := l.check(id, requested, key); err != nil {
+		return netip.Addr{}, err
+	}
+
+	if prev := l.byKey.Get(key, ttlcache.WithDisableTouchOnHit[[keySize]byte, netip.Addr]()); prev != nil {
+		delete(l.byAddr, prev.Value())
+	}
+	l.byKey.Set(key, requested, LeaseDuration)
+	l.byAddr[requested] = key
+	return requested, nil
+}
+
+// setPeers replaces the registry of reserved addresses.
+func (l *leases) setPeers(peers *peerRegistry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.peers = peers
+}
+
+func (l *leases) renew(id *identity) {
+	l.byKey.Touch([keySize]byte(id.publicKey.Bytes()))
+}
+
+// used reports whether the address is leased to another client than the key.
+func (l *leases) used(key [keySize]byte, addr netip.Addr) bool {
+	owner, ok := l.byAddr[addr]
+	if !ok || owner == key {
+		return false
+	}
+	lease := l.byKey.Get(owner, ttlcache.WithDisableTouchOnHit[[keySize]byte, netip.Addr]())
+	if lease != nil && lease.Value() == addr {
+		return true
+	}
+	delete(l.byAddr, addr)
+	return false
+}
+
+func (l *leases) check(id *identity, addr netip.Addr, key [keySize]byte) error {
+	if !l.network.Contains(addr) || addr == l.network.Addr() || addr == l.network.Masked().Addr() {
+		return fmt.Errorf("%w: %s not in %s", errAddressOutsideNetwork, addr, l.network)
+	}
+	if allowed := l.allowedIPs(id); len(allowed) > 0 && !id.allows(addr) {
+		return fmt.Errorf("%w: %s", errAddressNotAllowed, addr)
+	}
+	if owner := l.peers.owner(addr); owner != nil && owner != id {
+		return fmt.Errorf("%w: %s reserved for %s", errAddressNotAllowed, addr, owner)
+	}
+	if l.used(key, addr) {
+		return fmt.Errorf("%w: %s", errAddressInUse, addr)
+	}
+	return nil
+}
+
+func (l *leases) free(id *identity, key [keySize]byte) (netip.Addr, error) {
+	ranges := l.allowedIPs(id)
+	if len(ranges) == 0 {
+		ranges = []netip.Prefix{l.network.Masked()}
+	}
+
+	for _, r := range ranges {
+		for addr := r.Masked().Addr(); r.Contains(addr); addr = addr.Next() {
+			if l.isBroadcast(addr) {
+				continue
+			}
+			if err := l.check(id, addr, key); err == nil {
+				return addr, nil
+			}
+		}
+	}
+	return netip.Addr{}, errNoFreeAddress
+}
+
+// allowedIPs returns allowed ips of the client in the address family of the network.
+func (l *leases) allowedIPs(id *identity) []netip.Prefix {
+	var res []netip.Prefix
+	for _, p := range id.allowedIPs {
+		if p.Addr().Is4() == l.network.Addr().Is4() {
+			res = append(res, p)
+		}
+	}
+	return res
+}
+
+func (l *leases) isBroadcast(addr netip.Addr) bool {
+	return addr.Is4() && l.network.Bits() < 31 && !l.network.Contains(addr.Next())
+}
@@ -0,0 +1,97 @@
+package stun
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLeases(t *testing.T) {
+	static, first, second := testPrivateKey(t).PublicKey(), testPrivateKey(t).PublicKey(), testPrivateKey(t).PublicKey()
+	registry, err := newPeerRegistry([]PeerConfig{
+		{PublicKey: encodeKey(static.Bytes()), AllowedIPs: []string{"192.168.4.2"}},
+		{PublicKey: encodeKey(first.Bytes())},
+		{PublicKey: encodeKey(second.Bytes())},
+	})
+	require.NoError(t, err)
+	l := newLeases(netip.MustParsePrefix("192.168.4.1/29"), registry)
+
+	addr, err := l.acquire(registry.lookup(static), netip.Addr{})
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("192.168.4.2"), addr)
+
+	addr, err = l.acquire(registry.lookup(first), netip.IPv4Unspecified())
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("192.168.4.3"), addr)
+
+	addr, err = l.acquire(registry.lookup(first), netip.IPv4Unspecified())
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("192.168.4.3"), addr, "lease survives reconnect")
+
+	_, err = l.acquire(registry.lookup(second), netip.MustParseAddr("192.168.4.3"))
+	require.ErrorIs(t, err, errAddressInUse)
+
+	_, err = l.acquire(registry.lookup(second), netip.MustParseAddr("192.168.4.2"))
+	require.ErrorIs(t, err, errAddressNotAllowed)
+
+	_, err = l.acquire(registry.lookup(second), netip.MustParseAddr("192.168.5.2"))
+	require.ErrorIs(t, err, errAddressOutsideNetwork)
+
+	_, err = l.acquire(registry.lookup(second), netip.MustParseAddr("192.168.4.1"))
+	require.ErrorIs(t, err, errAddressOutsideNetwork)
+
+	addr, err = l.acquire(registry.lookup(second), netip.MustParseAddr("192.168.4.6"))
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("192.168.4.6"), addr)
+
+	// the previous address of a client is released
+	_, err = l.acquire(registry.lookup(first), netip.MustParseAddr("192.168.4.4"))
+	require.NoError(t, err)
+	addr, err = l.acquire(registry.lookup(second), netip.MustParseAddr("192.168.4.3"))
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("192.168.4.3"), addr)
+}
+
+func TestLeasesExhausted(t *testing.T) {
+	first, second := testPrivateKey(t).PublicKey(), testPrivateKey(t).PublicKey()
+	registry, err := newPeerRegistry([]PeerConfig{
+		{PublicKey: encodeKey(first.Bytes())},
+		{PublicKey: encodeKey(second.Bytes())},
+	})
+	require.NoError(t, err)
+	l := newLeases(netip.MustParsePrefix("192.168.4.1/30"), registry)
+
+	addr, err := l.acquire(registry.lookup(first), netip.Addr{})
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("192.168.4.2"), addr)
+
+	_, err = l.acquire(registry.lookup(second), netip.Addr{})
+	require.ErrorIs(t, err, errNoFreeAddress)
+
+	// the address of the expired lease is free again
+	l.byKey.Set([keySize]byte(first.Bytes()), addr, time.Millisecond)
+	time.Sleep(2 * time.Millisecond)
+	addr, err = l.acquire(registry.lookup(second), netip.Addr{})
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("192.168.4.2"), addr)
+}
+
+func TestLeasesIPv6(t *testing.T) {
+	static, dynamic := testPrivateKey(t).PublicKey(), testPrivateKey(t).PublicKey()
+	registry, err := newPeerRegistry([]PeerConfig{
+		{PublicKey: encodeKey(static.Bytes()), AllowedIPs: []string{"192.168.4.2", "fd00::2"}},
+		{PublicKey: encodeKey(dynamic.Bytes()), AllowedIPs: []string{"192.168.4.3"}},
+	})
+	require.NoError(t, err)
+	l := newLeases(netip.MustParsePrefix("fd00::1/64"), registry)
+
+	addr, err := l.acquire(registry.lookup(static), netip.Addr{})
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("fd00::2"), addr)
+
+	addr, err = l.acquire(registry.lookup(dynamic), netip.Addr{})
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("fd00::3"), addr, "IPv4 allowed ips don't restrict IPv6 lease")
+}
@@ -0,0 +1,218 @@
+package stun
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+// counters of the process which don't belong to a server or a client.
+var (
+	handshakeSuccesses atomic.Uint64
+	handshakeFailures  atomic.Uint64
+	unknownHostReplies atomic.Uint64
+	routesAdded        atomic.Uint64
+)
+
+func countHandshake(ok bool) {
+	if ok {
+		handshakeSuccesses.Add(1)
+	} else {
+		handshakeFailures.Add(1)
+	}
+}
+
+// metricsWriter writes metric families in the prometheus text format, the first error is
+// kept and returned by flush.
+type metricsWriter struct {
+	w   *bufio.Writer
+	err error
+}
+
+func newMetricsWriter(w io.Writer) *metricsWriter {
+	return &metricsWriter{w: bufio.NewWriter(w)}
+}
+
+// family starts the metric family, typ is counter or gauge.
+func (m *metricsWriter) family(name, typ, help string) {
+	m.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// sample writes the value with label pairs.
+func (m *metricsWriter) sample(name string, value float64, labels ...string) {
+	m.printf("%s", name)
+	if len(labels) > 0 {
+		m.printf("{")
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				m.printf(",")
+			}
+			m.printf("%s=\"%s\"", labels[i], labelEscaper.Replace(labels[i+1]))
+		}
+		m.printf("}")
+	}
+	m.printf(" %s\n", strconv.FormatFloat(value, 'g', -1, 64))
+}
+
+func (m *metricsWriter) printf(format string, args ...any) {
+	if m.err != nil {
+		return
+	}
+	_, m.err = fmt.Fprintf(m.w, format, args...)
+}
+
+func (m *metricsWriter) flush() error {
+	if m.err != nil {
+		return m.err
+	}
+	return m.w.Flush()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writeProcessMetrics writes metrics shared by the server and the client.
+func writeProcessMetrics(m *metricsWriter) {
+	m.family("stun_handshakes_total", "counter", "Handshakes by result.")
+	m.sample("stun_handshakes_total", float64(handshakeSuccesses.Load()), "result", "success")
+	m.sample("stun_handshakes_total", float64(handshakeFailures.Load()), "result", "failure")
+
+	drops := Drops()
+	reasons := make([]string, 0, len(drops))
+	for reason := range drops {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	m.family("stun_drops_total", "counter", "Dropped packets by reason.")
+	for _, reason := range reasons {
+		m.sample("stun_drops_total", float64(drops[reason]), "reason", reason)
+	}
+
+	m.family("go_goroutines", "gauge", "Number of goroutines.")
+	m.sample("go_goroutines", float64(runtime.NumGoroutine()))
+}
+
+// serveMetrics serves metrics written by fn on /metrics of the address until ctx is done.
+func serveMetrics(ctx context.Context, addr string, fn func(m *metricsWriter)) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		m := newMetricsWriter(w)
+		fn(m)
+		writeProcessMetrics(m)
+		if err := m.flush(); err != nil {
+			log.Debug("write metrics", "error", err)
+		}
+	})
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: HandshakeDelay}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	go func() {
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warn("metrics", "error", err)
+		}
+	}()
+	log.Infof("metrics on %s", l.Addr())
+	return nil
+}
+
+func (s *server) writeMetrics(m *metricsWriter) {
+	peers := s.connectedPeers()
+	m.family("stun_peers", "gauge", "Connected peers.")
+	m.sample("stun_peers", float64(len(peers)))
+
+	type counter struct {
+		name, help string
+		value      func(p *peer) (rx, tx uint64)
+	}
+	for _, c := range []counter{
+		{"stun_peer_packets_total", "Tunneled packets of the peer by direction.", func(p *peer) (uint64, uint64) {
+			return p.rxPackets.Load(), p.txPackets.Load()
+		}},
+		{"stun_peer_bytes_total", "Tunneled bytes of the peer by direction.", func(p *peer) (uint64, uint64) {
+			return p.rxBytes.Load(), p.txBytes.Load()
+		}},
+	} {
+		m.family(c.name, "counter", c.help)
+		for _, p := range peers {
+			rx, tx := c.value(p)
+			m.sample(c.name, float64(rx), "peer", p.identity.String(), "address", p.peerAddress.String(), "direction", "in")
+			m.sample(c.name, float64(tx), "peer", p.identity.String(), "address", p.peerAddress.String(), "direction", "out")
+		}
+	}
+	m.family("stun_peer_last_seen_seconds", "gauge", "Unix time of the last message of the peer.")
+	for _, p := range peers {
+		m.sample("stun_peer_last_seen_seconds", float64(p.lastSeen.Load())/float64(time.Second), "peer", p.identity.String(), "address", p.peerAddress.String())
+	}
+
+	m.family("stun_unknown_host_replies_total", "counter", "Unreachable replies to packets for unknown overlay addresses.")
+	m.sample("stun_unknown_host_replies_total", float64(unknownHostReplies.Load()))
+
+	m.family("stun_queue_depth", "gauge", "Packets waiting in worker queues.")
+	if s.connWorkers != nil {
+		m.sample("stun_queue_depth", float64(s.connWorkers.depth()), "queue", "socket")
+	}
+	if s.tunWorkers != nil {
+		m.sample("stun_queue_depth", float64(s.tunWorkers.depth()), "queue", "device")
+	}
+}
+
+func (c *client) writeMetrics(m *metricsWriter) {
+	status := c.status()
+	connected := 0.0
+	if status.State == clientConnected {
+		connected = 1
+	}
+	m.family("stun_connected", "gauge", "Whether the server answers keep alive messages.")
+	m.sample("stun_connected", connected)
+
+	m.family("stun_packets_total", "counter", "Tunneled packets by direction.")
+	m.sample("stun_packets_total", float64(c.rxPackets.Load()), "direction", "in")
+	m.sample("stun_packets_total", float64(c.txPackets.Load()), "direction", "out")
+	m.family("stun_bytes_total", "counter", "Tunneled bytes by direction.")
+	m.sample("stun_bytes_total", float64(c.rxBytes.Load()), "direction", "in")
+	m.sample("stun_bytes_total", float64(c.txBytes.Load()), "direction", "out")
+
+	m.family("stun_keepalive_rtt_seconds", "gauge", "Round trip time of the last keep alive message.")
+	m.sample("stun_keepalive_rtt_seconds", time.Duration(c.keepAliveRTT.Load()).Seconds())
+
+	up := 0
+	for _, d := range status.DirectPaths {
+		if d.Up {
+			up++
+		}
+	}
+	m.family("stun_direct_paths", "gauge", "Direct paths to other clients by state.")
+	m.sample("stun_direct_paths", float64(up), "state", "up")
+	m.sample("stun_direct_paths", float64(len(status.DirectPaths)-up), "state", "down")
+
+	m.family("stun_routes_added_total", "counter", "Routes added for domains.")
+	m.sample("stun_routes_added_total", float64(routesAdded.Load()))
+	m.family("stun_routes", "gauge", "Installed routes for domains.")
+	m.sample("stun_routes", float64(len(status.Routes)))
+
+	depth := 0
+	for _, q := range c.deviceQueues {
+		depth += len(q)
+	}
+	m.family("stun_queue_depth", "gauge", "Packets waiting in queues.")
+	m.sample("stun_queue_depth", float64(depth), "queue", "device")
+}
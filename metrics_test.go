@@ -0,0 +1,43 @@
+package stun
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricsWriter(t *testing.T) {
+	var buf bytes.Buffer
+	m := newMetricsWriter(&buf)
+	m.family("stun_test_total", "counter", "Test counter.")
+	m.sample("stun_test_total", 3, "peer", "a \"b\"\\\n", "direction", "in")
+	m.sample("stun_test_total", 0.5)
+	require.NoError(t, m.flush())
+	require.Equal(t, `# HELP stun_test_total Test counter.
+# TYPE stun_test_total counter
+stun_test_total{peer="a \"b\"\\\n",direction="in"} 3
+stun_test_total 0.5
+`, buf.String())
+}
+
+func TestServerMetrics(t *testing.T) {
+	pub := testPrivateKey(t).PublicKey()
+	s := &server{knownSessions: ttlcache.New[uint32, *peer]()}
+	p := &peer{peerAddress: netip.MustParseAddr("192.168.50.2"), identity: &identity{name: "laptop", publicKey: pub}}
+	p.rxPackets.Add(2)
+	p.txBytes.Add(100)
+	s.knownSessions.Set(1, p, KeepAliveMaxDuration)
+
+	var buf bytes.Buffer
+	m := newMetricsWriter(&buf)
+	s.writeMetrics(m)
+	writeProcessMetrics(m)
+	require.NoError(t, m.flush())
+	require.Contains(t, buf.String(), "stun_peers 1\n")
+	require.Contains(t, buf.String(), `stun_peer_packets_total{peer="laptop",address="192.168.50.2",direction="in"} 2`)
+	require.Contains(t, buf.String(), `stun_peer_bytes_total{peer="laptop",address="192.168.50.2",direction="out"} 100`)
+	require.Contains(t, buf.String(), `stun_drops_total{reason="policy"}`)
+}
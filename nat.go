@@ -0,0 +1,494 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/ipv4"
+)
+
+var errNATPortsExhausted = errors.New("nat ports exhausted")
+
+// icmpHeaderSize is the size of the icmp header before the quoted packet of an error.
+const icmpHeaderSize = 8
+
+// natEgress sends translated packets to the internet and receives return traffic.
+type natEgress interface {
+	// reserve allocates the egress port of the protocol, so the system doesn't handle
+	// return traffic itself.
+	reserve(proto layers.IPProtocol) (uint16, io.Closer, error)
+	send(pkt []byte, dst netip.Addr) error
+	// receive calls fn for every packet to the egress address until ctx is done.
+	receive(ctx context.Context, fn func(p packetBuf))
+	Close() error
+}
+
+// natKey identifies a flow on one side of the nat, port of icmp flows is the echo id.
+type natKey struct {
+	proto  layers.IPProtocol
+	src    netip.AddrPort
+	remote netip.AddrPort
+}
+
+type natEntry struct {
+	// out is the key of packets from the client, in is the key of return traffic
+	out, in     natKey
+	reservation io.Closer
+	expires     time.Time
+	closing     bool
+}
+
+// nat masquerades IPv4 packets of clients with the egress address. The connection
+// tracking table maps flows of clients to egress ports, entries expire when the flow
+// is idle or a tcp connection is closed.
+type nat struct {
+	egress    netip.Addr
+	transport natEgress
+
+	mu     sync.Mutex
+	flows  map[natKey]*natEntry
+	icmpID uint16
+	now    func() time.Time
+}
+
+func newNAT(egress netip.Addr, transport natEgress) *nat {
+	return &nat{
+		egress:    egress,
+		transport: transport,
+		flows:     map[natKey]*natEntry{},
+		now:       time.Now,
+	}
+}
+
+// egressAddress parses the address, the source address of the default route is used
+// if it's empty.
+func egressAddress(addr string) (netip.Addr, error) {
+	if addr != "" {
+		res, err := netip.ParseAddr(addr)
+		if err == nil && !res.Is4() {
+			err = fmt.Errorf("egress address %s is not IPv4", res)
+		}
+		return res, err
+	}
+	// nothing is sent by the connectionless socket
+	conn, err := net.Dial("udp4", "192.0.2.1:9")
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+// run expires idle flows and translates return traffic to clients with deliver.
+func (n *nat) run(ctx context.Context, deliver func(p packetBuf)) {
+	go func() {
+		ticker := time.NewTicker(NATExpirationInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				n.transport.Close()
+				return
+			case <-ticker.C:
+				n.expire()
+			}
+		}
+	}()
+
+	n.transport.receive(ctx, func(p packetBuf) {
+		n.receive(p, deliver)
+	})
+}
+
+// receive translates return traffic and delivers it in packets of at most the device
+// MTU, larger ones don't fit into a message the client reads. TCP is segmented, other
+// packets are fragmented unless the sender doesn't allow it, then it is told the MTU.
+func (n *nat) receive(p packetBuf, deliver func(p packetBuf)) {
+	pkt := p.payload()
+	if len(pkt) <= int(DeviceMTU) {
+		if !n.translateIn(pkt) {
+			putPacketBuf(p)
+			return
+		}
+		deliver(p)
+		return
+	}
+
+	defer putPacketBuf(p)
+	// the error quotes the packet as it was received
+	quote := append([]byte(nil), pkt[:int(pkt[0]&0x0f)*4+8]...)
+	if !n.translateIn(pkt) {
+		return
+	}
+	switch {
+	case layers.IPProtocol(pkt[9]) == layers.IPProtocolTCP:
+		segmentTCP(pkt, deliver)
+	case pkt[6]&0x40 != 0:
+		n.fragmentationNeeded(quote)
+	default:
+		fragmentIPv4(pkt, deliver)
+	}
+}
+
+// segmentTCP delivers the tcp packet in segments of the device MTU.
+func segmentTCP(pkt []byte, deliver func(p packetBuf)) {
+	ihl := int(pkt[0]&0x0f) * 4
+	hdrLen := ihl + int(pkt[ihl+12]>>4)*4
+	if hdrLen >= int(DeviceMTU) {
+		return
+	}
+	h := virtioNetHdr{gsoSize: uint16(int(DeviceMTU) - hdrLen), csumStart: uint16(ihl)}
+	for off := 0; ; {
+		p := getPacketBuf(int(DeviceMTU))
+		n, next, err := gsoSegment(p.payload(), pkt, h, off)
+		if err != nil {
+			putPacketBuf(p)
+			log.Debugf("drop nat packet: %s", err)
+			return
+		}
+		deliver(p.truncate(n))
+		if next == 0 {
+			return
+		}
+		off = next
+	}
+}
+
+// fragmentIPv4 delivers the packet in fragments of at most the device MTU, the client
+// reassembles them.
+func fragmentIPv4(pkt []byte, deliver func(p packetBuf)) {
+	ihl := int(pkt[0]&0x0f) * 4
+	// fragment offsets are in 8 byte units
+	size := (int(DeviceMTU) - ihl) &^ 7
+	// the last fragment keeps the more fragments bit of a first fragment
+	last := binary.BigEndian.Uint16(pkt[6:]) & 0x2000
+	payload := pkt[ihl:]
+	for off := 0; off < len(payload); off += size {
+		end, flags := off+size, uint16(0x2000)
+		if end >= len(payload) {
+			end, flags = len(payload), last
+		}
+		p := getPacketBuf(ihl + end - off)
+		frag := p.payload()
+		copy(frag, pkt[:ihl])
+		copy(frag[ihl:], payload[off:end])
+		binary.BigEndian.PutUint16(frag[2:], uint16(len(frag)))
+		binary.BigEndian.PutUint16(frag[6:], flags|uint16(off/8))
+		ipv4HeaderChecksum(frag)
+		deliver(p)
+	}
+}
+
+// fragmentationNeeded tells the sender of the packet with the quoted header that the
+// path MTU is the device MTU, see RFC 1191.
+func (n *nat) fragmentationNeeded(quote []byte) {
+	pkt := make([]byte, ipv4.HeaderLen+icmpHeaderSize+len(quote))
+	pkt[0] = 4<<4 | ipv4.HeaderLen/4
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	pkt[8] = 64
+	pkt[9] = byte(layers.IPProtocolICMPv4)
+	copy(pkt[12:16], quote[16:20])
+	copy(pkt[16:20], quote[12:16])
+	ipv4HeaderChecksum(pkt)
+
+	icmp := pkt[ipv4.HeaderLen:]
+	icmp[0], icmp[1] = layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded
+	binary.BigEndian.PutUint16(icmp[6:], uint16(DeviceMTU))
+	copy(icmp[icmpHeaderSize:], quote)
+	binary.BigEndian.PutUint16(icmp[2:], ^checksumFold(checksumAdd(icmp, 0)))
+
+	sender := netip.AddrFrom4([4]byte(quote[12:16]))
+	if err := n.transport.send(pkt, sender); err != nil {
+		log.Debugf("send fragmentation needed to %s: %s", sender, err)
+	}
+}
+
+// natPacket is the parsed part of a packet the nat rewrites.
+type natPacket struct {
+	proto layers.IPProtocol
+	// port is the offset of the source port in the packet, the destination port follows
+	// it, icmp has only the echo id
+	port int
+	// csum is the offset of the transport checksum
+	csum  int
+	flags uint8
+}
+
+func parseNATPacket(pkt []byte, echoType uint8) (natPacket, bool) {
+	if len(pkt) < ipv4.HeaderLen || ipVersion(pkt) != 4 {
+		return natPacket{}, false
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	// fragments after the first one don't have ports
+	if ihl < ipv4.HeaderLen || binary.BigEndian.Uint16(pkt[6:])&0x1fff != 0 {
+		return natPacket{}, false
+	}
+	res := natPacket{proto: layers.IPProtocol(pkt[9]), port: ihl}
+	switch res.proto {
+	case layers.IPProtocolTCP:
+		if len(pkt) < ihl+tcpMinHeaderSize {
+			return natPacket{}, false
+		}
+		res.csum = ihl + tcpChecksumOffset
+		res.flags = pkt[ihl+13]
+	case layers.IPProtocolUDP:
+		if len(pkt) < ihl+8 {
+			return natPacket{}, false
+		}
+		res.csum = ihl + 6
+	case layers.IPProtocolICMPv4:
+		if len(pkt) < ihl+8 || pkt[ihl] != echoType {
+			return natPacket{}, false
+		}
+		res.port = ihl + 4
+		res.csum = ihl + 2
+	default:
+		return natPacket{}, false
+	}
+	return res, true
+}
+
+func (p natPacket) src(pkt []byte) netip.AddrPort {
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(pkt[12:16])), binary.BigEndian.Uint16(pkt[p.port:]))
+}
+
+func (p natPacket) dst(pkt []byte) netip.AddrPort {
+	if p.proto == layers.IPProtocolICMPv4 {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(pkt[16:20])), binary.BigEndian.Uint16(pkt[p.port:]))
+	}
+	return netip.AddrPortFrom(netip.AddrFrom4([4]byte(pkt[16:20])), binary.BigEndian.Uint16(pkt[p.port+2:]))
+}
+
+// rewrite sets the address at the offset of the ip header and the port, it updates
+// checksums.
+func (p natPacket) rewrite(pkt []byte, addrOff, portOff int, addr netip.AddrPort) {
+	var update [6]byte
+	a := addr.Addr().As4()
+	copy(update[:], a[:])
+	binary.BigEndian.PutUint16(update[4:], addr.Port())
+
+	// the pseudo header of tcp and udp checksums includes the address
+	switch {
+	case p.csum+2 > len(pkt):
+		// the checksum isn't quoted by an icmp error
+	case p.proto == layers.IPProtocolICMPv4:
+		checksumReplace(pkt[p.csum:], pkt[portOff:portOff+2], update[4:])
+	case p.proto == layers.IPProtocolUDP && binary.BigEndian.Uint16(pkt[p.csum:]) == 0:
+		// checksum is not used
+	default:
+		checksumReplace(pkt[p.csum:], pkt[addrOff:addrOff+4], update[:4])
+		checksumReplace(pkt[p.csum:], pkt[portOff:portOff+2], update[4:])
+		if p.proto == layers.IPProtocolUDP && binary.BigEndian.Uint16(pkt[p.csum:]) == 0 {
+			binary.BigEndian.PutUint16(pkt[p.csum:], 0xffff)
+		}
+	}
+	checksumReplace(pkt[10:], pkt[addrOff:addrOff+4], update[:4])
+
+	copy(pkt[addrOff:], update[:4])
+	copy(pkt[portOff:], update[4:])
+}
+
+// checksumReplace updates the checksum at csum for the data replaced by update, see
+// RFC 1624.
+func checksumReplace(csum []byte, data, update []byte) {
+	sum := uint64(^binary.BigEndian.Uint16(csum))
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint64(^binary.BigEndian.Uint16(data[i:]))
+		sum += uint64(binary.BigEndian.Uint16(update[i:]))
+	}
+	binary.BigEndian.PutUint16(csum, ^checksumFold(sum))
+}
+
+// translateOut masquerades and sends the packet from a client, it returns false if the
+// packet isn't handled by the nat.
+func (n *nat) translateOut(pkt []byte) (bool, error) {
+	p, ok := parseNATPacket(pkt, uint8(layers.ICMPv4TypeEchoRequest))
+	if !ok {
+		return false, nil
+	}
+	key := natKey{proto: p.proto, src: p.src(pkt), remote: p.dst(pkt)}
+	if key.remote.Addr() == n.egress {
+		return false, nil
+	}
+	if p.proto == layers.IPProtocolICMPv4 {
+		key.remote = netip.AddrPortFrom(key.remote.Addr(), 0)
+	}
+
+	e, err := n.entry(key, p.flags)
+	if err != nil {
+		return true, err
+	}
+	p.rewrite(pkt, 12, p.port, e.in.src)
+	return true, n.transport.send(pkt, key.remote.Addr())
+}
+
+// translateIn rewrites return traffic to the client, it returns false if the packet
+// doesn't belong to a known flow.
+func (n *nat) translateIn(pkt []byte) bool {
+	p, ok := parseNATPacket(pkt, uint8(layers.ICMPv4TypeEchoReply))
+	if !ok {
+		return n.translateICMPError(pkt)
+	}
+	key := natKey{proto: p.proto, src: p.dst(pkt), remote: p.src(pkt)}
+	portOff := p.port + 2
+	if p.proto == layers.IPProtocolICMPv4 {
+		key.remote = netip.AddrPortFrom(key.remote.Addr(), 0)
+		portOff = p.port
+	}
+
+	n.mu.Lock()
+	e, ok := n.flows[key]
+	if ok {
+		n.touch(e, p.flags)
+	}
+	n.mu.Unlock()
+	if !ok {
+		return false
+	}
+
+	p.rewrite(pkt, 16, portOff, e.out.src)
+	return true
+}
+
+// translateICMPError rewrites the icmp error about a packet of a known flow to the client,
+// the quoted packet is translated back to the one the client sent.
+func (n *nat) translateICMPError(pkt []byte) bool {
+	if len(pkt) < ipv4.HeaderLen || ipVersion(pkt) != 4 || layers.IPProtocol(pkt[9]) != layers.IPProtocolICMPv4 {
+		return false
+	}
+	ihl := int(pkt[0]&0x0f) * 4
+	if ihl < ipv4.HeaderLen || len(pkt) < ihl+icmpHeaderSize+ipv4.HeaderLen {
+		return false
+	}
+	icmp := pkt[ihl:]
+	switch icmp[0] {
+	case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+	default:
+		return false
+	}
+
+	// the quoted packet has at least 8 bytes of the transport header
+	quoted := icmp[icmpHeaderSize:]
+	qihl := int(quoted[0]&0x0f) * 4
+	if ipVersion(quoted) != 4 || qihl < ipv4.HeaderLen || len(quoted) < qihl+8 {
+		return false
+	}
+	q := natPacket{proto: layers.IPProtocol(quoted[9]), port: qihl}
+	switch q.proto {
+	case layers.IPProtocolTCP:
+		q.csum = qihl + tcpChecksumOffset
+	case layers.IPProtocolUDP:
+		q.csum = qihl + 6
+	case layers.IPProtocolICMPv4:
+		if quoted[qihl] != layers.ICMPv4TypeEchoRequest {
+			return false
+		}
+		q.port, q.csum = qihl+4, qihl+2
+	default:
+		return false
+	}
+	key := natKey{proto: q.proto, src: q.src(quoted), remote: q.dst(quoted)}
+	if q.proto == layers.IPProtocolICMPv4 {
+		key.remote = netip.AddrPortFrom(key.remote.Addr(), 0)
+	}
+
+	n.mu.Lock()
+	e, ok := n.flows[key]
+	n.mu.Unlock()
+	if !ok || e.in != key {
+		return false
+	}
+
+	q.rewrite(quoted, 12, q.port, e.out.src)
+	client := e.out.src.Addr().As4()
+	checksumReplace(pkt[10:], pkt[16:20], client[:])
+	copy(pkt[16:20], client[:])
+	icmp[2], icmp[3] = 0, 0
+	binary.BigEndian.PutUint16(icmp[2:], ^checksumFold(checksumAdd(icmp, 0)))
+	return true
+}
+
+// entry returns the flow of the client, a new one gets an egress port.
+func (n *nat) entry(key natKey, flags uint8) (*natEntry, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if e, ok := n.flows[key]; ok {
+		n.touch(e, flags)
+		return e, nil
+	}
+
+	e := &natEntry{out: key}
+	var port uint16
+	var err error
+	if key.proto == layers.IPProtocolICMPv4 {
+		port, err = n.nextICMPID(key.remote)
+	} else {
+		port, e.reservation, err = n.transport.reserve(key.proto)
+	}
+	if err != nil {
+		return nil, err
+	}
+	e.in = natKey{proto: key.proto, src: netip.AddrPortFrom(n.egress, port), remote: key.remote}
+	n.flows[e.out], n.flows[e.in] = e, e
+	n.touch(e, flags)
+
+	log.Debugf("nat %s %s -> %s to %s", key.proto, key.src, e.in.src, key.remote)
+	return e, nil
+}
+
+func (n *nat) nextICMPID(remote netip.AddrPort) (uint16, error) {
+	for i := 0; i < 1<<16; i++ {
+		n.icmpID++
+		key := natKey{proto: layers.IPProtocolICMPv4, src: netip.AddrPortFrom(n.egress, n.icmpID), remote: remote}
+		if _, ok := n.flows[key]; !ok {
+			return n.icmpID, nil
+		}
+	}
+	return 0, errNATPortsExhausted
+}
+
+// touch extends the entry, closed tcp connections are kept a short time for the last
+// segments.
+func (n *nat) touch(e *natEntry, flags uint8) {
+	timeout := NATUDPTimeout
+	switch e.out.proto {
+	case layers.IPProtocolTCP:
+		timeout = NATTCPTimeout
+		if flags&(tcpFlagFIN|tcpFlagRST) != 0 {
+			e.closing = true
+		}
+		if e.closing {
+			timeout = NATTCPClosingTimeout
+		}
+	case layers.IPProtocolICMPv4:
+		timeout = NATICMPTimeout
+	}
+	e.expires = n.now().Add(timeout)
+}
+
+func (n *nat) expire() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := n.now()
+	for key, e := range n.flows {
+		if key != e.out || now.Before(e.expires) {
+			continue
+		}
+		delete(n.flows, e.out)
+		delete(n.flows, e.in)
+		if e.reservation != nil {
+			e.reservation.Close()
+		}
+	}
+}
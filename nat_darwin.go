@@ -0,0 +1,10 @@
+package stun
+
+import (
+	"errors"
+	"net/netip"
+)
+
+func openNATEgress(netip.Addr) (natEgress, error) {
+	return nil, errors.New("nat is supported only on linux")
+}
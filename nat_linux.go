@@ -0,0 +1,182 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// rawEgress sends translated packets with a raw socket and receives return traffic
+// with raw sockets of the protocols. Egress ports are reserved by sockets which drop
+// everything, so the system neither resets tcp connections nor replies port
+// unreachable to them. Raw tcp and udp sockets get only packets to the range of
+// reserved ports, other traffic of the host isn't copied to the server.
+type rawEgress struct {
+	addr netip.Addr
+	out  int
+	in   []*os.File
+}
+
+func openNATEgress(addr netip.Addr) (natEgress, error) {
+	out, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW, unix.IPPROTO_RAW)
+	if err != nil {
+		return nil, err
+	}
+	e := &rawEgress{addr: addr, out: out}
+	lo, hi, err := localPortRange()
+	if err != nil {
+		e.Close()
+		return nil, err
+	}
+	for _, proto := range []int{unix.IPPROTO_TCP, unix.IPPROTO_UDP, unix.IPPROTO_ICMP} {
+		fd, err := unix.Socket(unix.AF_INET, unix.SOCK_RAW|unix.SOCK_NONBLOCK, proto)
+		if err != nil {
+			e.Close()
+			return nil, err
+		}
+		e.in = append(e.in, os.NewFile(uintptr(fd), "nat"))
+		if proto == unix.IPPROTO_ICMP {
+			continue
+		}
+		if err := attachPortFilter(fd, addr, lo, hi); err != nil {
+			e.Close()
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// localPortRange returns the range of ports the system binds sockets to, reserved
+// egress ports are taken from it.
+func localPortRange() (lo, hi uint16, err error) {
+	bts, err := os.ReadFile("/proc/sys/net/ipv4/ip_local_port_range")
+	if err != nil {
+		return 0, 0, err
+	}
+	fields := strings.Fields(string(bts))
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("invalid local port range %q", bts)
+	}
+	from, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	to, err := strconv.ParseUint(fields[1], 10, 16)
+	if err != nil {
+		return 0, 0, err
+	}
+	return uint16(from), uint16(to), nil
+}
+
+// attachPortFilter attaches the filter which accepts tcp or udp packets to the address
+// and a port of the range, packets of raw sockets start with the IPv4 header.
+func attachPortFilter(fd int, addr netip.Addr, lo, hi uint16) error {
+	filter := []unix.SockFilter{
+		{Code: unix.BPF_LD | unix.BPF_W | unix.BPF_ABS, K: 16},
+		{Code: unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K, Jf: 5, K: binary.BigEndian.Uint32(addr.AsSlice())},
+		// X is the length of the IPv4 header
+		{Code: unix.BPF_LDX | unix.BPF_B | unix.BPF_MSH, K: 0},
+		// destination port of tcp and udp
+		{Code: unix.BPF_LD | unix.BPF_H | unix.BPF_IND, K: 2},
+		{Code: unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K, Jf: 2, K: uint32(lo)},
+		{Code: unix.BPF_JMP | unix.BPF_JGT | unix.BPF_K, Jt: 1, K: uint32(hi)},
+		{Code: unix.BPF_RET | unix.BPF_K, K: math.MaxUint32},
+		{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+	}
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog)
+}
+
+func (e *rawEgress) reserve(proto layers.IPProtocol) (uint16, io.Closer, error) {
+	lc := net.ListenConfig{Control: dropAll}
+	addr := netip.AddrPortFrom(e.addr, 0).String()
+	switch proto {
+	case layers.IPProtocolTCP:
+		l, err := lc.Listen(context.Background(), "tcp4", addr)
+		if err != nil {
+			return 0, nil, err
+		}
+		return uint16(l.Addr().(*net.TCPAddr).Port), l, nil
+	case layers.IPProtocolUDP:
+		c, err := lc.ListenPacket(context.Background(), "udp4", addr)
+		if err != nil {
+			return 0, nil, err
+		}
+		return uint16(c.LocalAddr().(*net.UDPAddr).Port), c, nil
+	}
+	return 0, nil, errors.New("unsupported protocol " + proto.String())
+}
+
+// dropAll attaches the filter which drops every packet of the socket.
+func dropAll(_, _ string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		prog := unix.SockFprog{
+			Len:    1,
+			Filter: &unix.SockFilter{Code: unix.BPF_RET | unix.BPF_K, K: 0},
+		}
+		err = unix.SetsockoptSockFprog(int(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (e *rawEgress) send(pkt []byte, dst netip.Addr) error {
+	return unix.Sendto(e.out, pkt, 0, &unix.SockaddrInet4{Addr: dst.As4()})
+}
+
+func (e *rawEgress) receive(ctx context.Context, fn func(p packetBuf)) {
+	var wg sync.WaitGroup
+	for _, f := range e.in {
+		f := f
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// packets from the internet may be larger than the device MTU
+			buf := make([]byte, maxGSOSize)
+			for {
+				n, err := f.Read(buf)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					log.Warn("nat read error", "error", err)
+					continue
+				}
+				if n < ipv4.HeaderLen || netip.AddrFrom4([4]byte(buf[16:20])) != e.addr {
+					continue
+				}
+				p := getPacketBuf(n)
+				copy(p.payload(), buf[:n])
+				fn(p)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (e *rawEgress) Close() error {
+	err := unix.Close(e.out)
+	for _, f := range e.in {
+		if ferr := f.Close(); err == nil {
+			err = ferr
+		}
+	}
+	return err
+}
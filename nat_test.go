@@ -0,0 +1,279 @@
+package stun
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+type testEgress struct {
+	port   uint16
+	sent   [][]byte
+	closed int
+}
+
+func (e *testEgress) reserve(layers.IPProtocol) (uint16, io.Closer, error) {
+	e.port++
+	return e.port, e, nil
+}
+
+func (e *testEgress) send(pkt []byte, _ netip.Addr) error {
+	e.sent = append(e.sent, append([]byte(nil), pkt...))
+	return nil
+}
+
+func (e *testEgress) receive(context.Context, func(p packetBuf)) {}
+
+func (e *testEgress) Close() error {
+	e.closed++
+	return nil
+}
+
+func testNATPacket(t *testing.T, src, dst netip.AddrPort, transport gopacket.SerializableLayer) []byte {
+	ip := &layers.IPv4{
+		Version: 4,
+		TTL:     64,
+		SrcIP:   src.Addr().AsSlice(),
+		DstIP:   dst.Addr().AsSlice(),
+	}
+	switch l := transport.(type) {
+	case *layers.TCP:
+		ip.Protocol = layers.IPProtocolTCP
+		l.SrcPort, l.DstPort = layers.TCPPort(src.Port()), layers.TCPPort(dst.Port())
+		require.NoError(t, l.SetNetworkLayerForChecksum(ip))
+	case *layers.UDP:
+		ip.Protocol = layers.IPProtocolUDP
+		l.SrcPort, l.DstPort = layers.UDPPort(src.Port()), layers.UDPPort(dst.Port())
+		require.NoError(t, l.SetNetworkLayerForChecksum(ip))
+	case *layers.ICMPv4:
+		ip.Protocol = layers.IPProtocolICMPv4
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, transport, gopacket.Payload{1, 2, 3}))
+	return buf.Bytes()
+}
+
+func TestNAT(t *testing.T) {
+	egress := &testEgress{port: 40000}
+	n := newNAT(netip.MustParseAddr("203.0.113.1"), egress)
+	client := netip.MustParseAddrPort("192.168.50.5:1234")
+	remote := netip.MustParseAddrPort("198.51.100.7:443")
+
+	for _, tc := range []struct {
+		name      string
+		out, in   func() gopacket.SerializableLayer
+		egressSrc netip.AddrPort
+	}{
+		{
+			name:      "tcp",
+			out:       func() gopacket.SerializableLayer { return &layers.TCP{SYN: true, Window: 10} },
+			in:        func() gopacket.SerializableLayer { return &layers.TCP{SYN: true, ACK: true, Window: 10} },
+			egressSrc: netip.MustParseAddrPort("203.0.113.1:40001"),
+		},
+		{
+			name:      "udp",
+			out:       func() gopacket.SerializableLayer { return &layers.UDP{} },
+			in:        func() gopacket.SerializableLayer { return &layers.UDP{} },
+			egressSrc: netip.MustParseAddrPort("203.0.113.1:40002"),
+		},
+		{
+			name: "icmp",
+			out: func() gopacket.SerializableLayer {
+				return &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: client.Port()}
+			},
+			in: func() gopacket.SerializableLayer {
+				return &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), Id: 1}
+			},
+			egressSrc: netip.MustParseAddrPort("203.0.113.1:1"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dst := remote
+			if tc.name == "icmp" {
+				dst = netip.AddrPortFrom(remote.Addr(), client.Port())
+			}
+			ok, err := n.translateOut(testNATPacket(t, client, dst, tc.out()))
+			require.NoError(t, err)
+			require.True(t, ok)
+
+			sent := egress.sent[len(egress.sent)-1]
+			expected := testNATPacket(t, tc.egressSrc, dst, tc.out())
+			if tc.name == "icmp" {
+				expected = testNATPacket(t, netip.AddrPortFrom(tc.egressSrc.Addr(), client.Port()), dst,
+					&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoRequest, 0), Id: tc.egressSrc.Port()})
+			}
+			require.Equal(t, expected, sent)
+
+			reply := testNATPacket(t, dst, tc.egressSrc, tc.in())
+			if tc.name == "icmp" {
+				reply = testNATPacket(t, netip.AddrPortFrom(remote.Addr(), 1), tc.egressSrc, tc.in())
+			}
+			require.True(t, n.translateIn(reply))
+			if tc.name == "icmp" {
+				expected = testNATPacket(t, remote, client,
+					&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0), Id: client.Port()})
+			} else {
+				expected = testNATPacket(t, dst, client, tc.in())
+			}
+			require.Equal(t, expected, reply)
+		})
+	}
+
+	// unknown return traffic isn't translated
+	require.False(t, n.translateIn(testNATPacket(t, remote, netip.MustParseAddrPort("203.0.113.1:40999"), &layers.UDP{})))
+
+	// established flow keeps the port
+	_, err := n.translateOut(testNATPacket(t, client, remote, &layers.UDP{}))
+	require.NoError(t, err)
+	require.Equal(t, uint16(40002), egress.port)
+
+	now := time.Now()
+	n.now = func() time.Time { return now.Add(NATTCPTimeout + time.Second) }
+	n.expire()
+	require.Empty(t, n.flows)
+	require.Equal(t, 2, egress.closed)
+}
+
+func TestNATClosedConnection(t *testing.T) {
+	n := newNAT(netip.MustParseAddr("203.0.113.1"), &testEgress{})
+	client := netip.MustParseAddrPort("192.168.50.5:1234")
+	remote := netip.MustParseAddrPort("198.51.100.7:443")
+
+	_, err := n.translateOut(testNATPacket(t, client, remote, &layers.TCP{ACK: true, FIN: true}))
+	require.NoError(t, err)
+
+	now := time.Now()
+	n.now = func() time.Time { return now.Add(NATTCPClosingTimeout + time.Second) }
+	n.expire()
+	require.Empty(t, n.flows)
+}
+
+func TestEgressAddress(t *testing.T) {
+	addr, err := egressAddress("203.0.113.1")
+	require.NoError(t, err)
+	require.Equal(t, netip.MustParseAddr("203.0.113.1"), addr)
+
+	_, err = egressAddress("2001:db8::1")
+	require.Error(t, err)
+
+	_, err = egressAddress("egress")
+	require.Error(t, err)
+}
+
+func TestNATReturnPath(t *testing.T) {
+	egress := &testEgress{port: 40000}
+	n := newNAT(netip.MustParseAddr("203.0.113.1"), egress)
+	client := netip.MustParseAddrPort("192.168.50.5:1234")
+	remote := netip.MustParseAddrPort("198.51.100.7:443")
+	_, err := n.translateOut(testNATPacket(t, client, remote, &layers.TCP{SYN: true}))
+	require.NoError(t, err)
+	_, err = n.translateOut(testNATPacket(t, client, remote, &layers.UDP{}))
+	require.NoError(t, err)
+	tcpSrc, udpSrc := netip.MustParseAddrPort("203.0.113.1:40001"), netip.MustParseAddrPort("203.0.113.1:40002")
+
+	payload := make([]byte, 3000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+	large := func(dst netip.AddrPort, transport gopacket.SerializableLayer, df bool) packetBuf {
+		ip := &layers.IPv4{Version: 4, TTL: 64, SrcIP: remote.Addr().AsSlice(), DstIP: dst.Addr().AsSlice()}
+		if df {
+			ip.Flags = layers.IPv4DontFragment
+		}
+		switch l := transport.(type) {
+		case *layers.TCP:
+			ip.Protocol = layers.IPProtocolTCP
+			l.SrcPort, l.DstPort = layers.TCPPort(remote.Port()), layers.TCPPort(dst.Port())
+			require.NoError(t, l.SetNetworkLayerForChecksum(ip))
+		case *layers.UDP:
+			ip.Protocol = layers.IPProtocolUDP
+			l.SrcPort, l.DstPort = layers.UDPPort(remote.Port()), layers.UDPPort(dst.Port())
+			require.NoError(t, l.SetNetworkLayerForChecksum(ip))
+		}
+		buf := gopacket.NewSerializeBuffer()
+		opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+		require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, transport, gopacket.Payload(payload)))
+		p := getPacketBuf(len(buf.Bytes()))
+		copy(p.payload(), buf.Bytes())
+		return p
+	}
+	receive := func(p packetBuf) [][]byte {
+		var res [][]byte
+		n.receive(p, func(p packetBuf) {
+			res = append(res, append([]byte(nil), p.payload()...))
+			putPacketBuf(p)
+		})
+		return res
+	}
+
+	// tcp is segmented
+	var received []byte
+	for _, seg := range receive(large(tcpSrc, &layers.TCP{ACK: true, Seq: 100}, true)) {
+		require.LessOrEqual(t, len(seg), int(DeviceMTU))
+		require.Equal(t, client.Addr(), ipDst(seg))
+		requireChecksums(t, seg, 20)
+		received = append(received, seg[40:]...)
+	}
+	require.Equal(t, payload, received)
+
+	// udp is fragmented
+	received = nil
+	frags := receive(large(udpSrc, &layers.UDP{}, false))
+	require.Len(t, frags, 3)
+	for i, frag := range frags {
+		require.LessOrEqual(t, len(frag), int(DeviceMTU))
+		require.Equal(t, client.Addr(), ipDst(frag))
+		require.Equal(t, i < len(frags)-1, frag[6]&0x20 != 0)
+		require.Equal(t, len(received)/8, int(binary.BigEndian.Uint16(frag[6:])&0x1fff))
+		received = append(received, frag[20:]...)
+	}
+	require.Equal(t, payload, received[8:])
+
+	// the sender of udp which must not be fragmented is told the MTU
+	require.Empty(t, receive(large(udpSrc, &layers.UDP{}, true)))
+	icmp := gopacket.NewPacket(egress.sent[len(egress.sent)-1], layers.LayerTypeIPv4, gopacket.Default)
+	require.Nil(t, icmp.ErrorLayer())
+	require.Equal(t, remote.Addr().AsSlice(), []byte(icmp.NetworkLayer().(*layers.IPv4).DstIP.To4()))
+	icmpLayer := icmp.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+	require.Equal(t, layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded), icmpLayer.TypeCode)
+	require.Equal(t, uint16(DeviceMTU), icmpLayer.Seq)
+	require.Equal(t, udpSrc.Port(), binary.BigEndian.Uint16(icmpLayer.Payload[22:]))
+}
+
+func TestNATICMPError(t *testing.T) {
+	egress := &testEgress{port: 40000}
+	n := newNAT(netip.MustParseAddr("203.0.113.1"), egress)
+	client := netip.MustParseAddrPort("192.168.50.5:1234")
+	remote := netip.MustParseAddrPort("198.51.100.7:53")
+	_, err := n.translateOut(testNATPacket(t, client, remote, &layers.UDP{}))
+	require.NoError(t, err)
+
+	// the remote answers the udp packet sent from the egress port with port unreachable
+	sent := egress.sent[len(egress.sent)-1]
+	ip := &layers.IPv4{Version: 4, TTL: 64, Protocol: layers.IPProtocolICMPv4, SrcIP: remote.Addr().AsSlice(), DstIP: net.IPv4(203, 0, 113, 1)}
+	unreachable := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodePort)}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, unreachable, gopacket.Payload(sent)))
+	pkt := buf.Bytes()
+	unknown := append([]byte(nil), pkt...)
+
+	require.True(t, n.translateIn(pkt))
+	ip.DstIP = client.Addr().AsSlice()
+	buf = gopacket.NewSerializeBuffer()
+	require.NoError(t, gopacket.SerializeLayers(buf, opts, ip, unreachable, gopacket.Payload(testNATPacket(t, client, remote, &layers.UDP{}))))
+	require.Equal(t, buf.Bytes(), pkt)
+
+	// errors about unknown flows aren't translated
+	binary.BigEndian.PutUint16(unknown[20+8+20:], 40999)
+	require.False(t, n.translateIn(unknown))
+}
@@ -0,0 +1,296 @@
+package stun
+
+import (
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Noise IK handshake with the psk2 modifier, see https://noiseprotocol.org/noise.html.
+// The client (initiator) knows the server static key in advance and sends its
+// own static key encrypted in the first message.
+
+const (
+	noiseProtocolName = "Noise_IKpsk2_25519_ChaChaPoly_SHA256"
+	noisePrologue     = "stun"
+)
+
+var errHandshakeState = errors.New("handshake message out of order")
+
+type symmetricState struct {
+	ck  [sha256.Size]byte
+	h   [sha256.Size]byte
+	k   []byte
+	n   uint64
+	err error
+}
+
+func (ss *symmetricState) init() {
+	ss.h = sha256.Sum256([]byte(noiseProtocolName))
+	ss.ck = ss.h
+	ss.mixHash([]byte(noisePrologue))
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h[:])
+	h.Write(data)
+	h.Sum(ss.h[:0])
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) {
+	var k []byte
+	ss.ck, k, _ = noiseHKDF(ss.ck[:], ikm)
+	ss.k, ss.n = k, 0
+}
+
+func (ss *symmetricState) mixKeyAndHash(ikm []byte) {
+	var h, k []byte
+	ss.ck, h, k = noiseHKDF(ss.ck[:], ikm)
+	ss.mixHash(h)
+	ss.k, ss.n = k, 0
+}
+
+func (ss *symmetricState) mixDH(local *ecdh.PrivateKey, remote *ecdh.PublicKey) {
+	if ss.err != nil {
+		return
+	}
+	secret, err := local.ECDH(remote)
+	if err != nil {
+		ss.err = err
+		return
+	}
+	ss.mixKey(secret)
+}
+
+func (ss *symmetricState) encryptAndHash(dst, plaintext []byte) []byte {
+	aead, err := chacha20poly1305.New(ss.k)
+	if err != nil {
+		ss.err = err
+		return dst
+	}
+	start := len(dst)
+	dst = aead.Seal(dst, nonce(ss.n), plaintext, ss.h[:])
+	ss.n++
+	ss.mixHash(dst[start:])
+	return dst
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(ss.k)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := aead.Open(nil, nonce(ss.n), ciphertext, ss.h[:])
+	if err != nil {
+		return nil, errAuthentication
+	}
+	ss.n++
+	ss.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+func (ss *symmetricState) split() (initiator, responder cipher.AEAD, err error) {
+	k1, k2, _ := noiseHKDF(ss.ck[:], nil)
+	if initiator, err = chacha20poly1305.New(k1[:]); err != nil {
+		return nil, nil, err
+	}
+	if responder, err = chacha20poly1305.New(k2); err != nil {
+		return nil, nil, err
+	}
+	return initiator, responder, nil
+}
+
+func noiseHKDF(ck, ikm []byte) (out1 [sha256.Size]byte, out2, out3 []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	tempKey := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, tempKey)
+	mac.Write([]byte{1})
+	mac.Sum(out1[:0])
+
+	mac.Reset()
+	mac.Write(out1[:])
+	mac.Write([]byte{2})
+	out2 = mac.Sum(nil)
+
+	mac.Reset()
+	mac.Write(out2)
+	mac.Write([]byte{3})
+	out3 = mac.Sum(nil)
+	return out1, out2, out3
+}
+
+type handshakeState struct {
+	symmetricState
+	initiator bool
+	s         *ecdh.PrivateKey
+	e         *ecdh.PrivateKey
+	rs        *ecdh.PublicKey
+	re        *ecdh.PublicKey
+	psk       []byte
+	// timestamp of the init in unix nanoseconds orders inits of the initiator
+	timestamp uint64
+}
+
+func newInitiatorHandshake(static *ecdh.PrivateKey, remote *ecdh.PublicKey, psk []byte) *handshakeState {
+	hs := &handshakeState{initiator: true, s: static, rs: remote, psk: psk}
+	hs.init()
+	hs.mixHash(remote.Bytes())
+	return hs
+}
+
+func newResponderHandshake(static *ecdh.PrivateKey) *handshakeState {
+	hs := &handshakeState{s: static}
+	hs.init()
+	hs.mixHash(static.PublicKey().Bytes())
+	return hs
+}
+
+func (hs *handshakeState) writeEphemeral(dst []byte) ([]byte, error) {
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	hs.e = e
+	pub := e.PublicKey().Bytes()
+	hs.mixHash(pub)
+	hs.mixKey(pub)
+	return append(dst, pub...), nil
+}
+
+func (hs *handshakeState) readEphemeral(msg []byte) ([]byte, error) {
+	if len(msg) < keySize {
+		return nil, fmt.Errorf("handshake message length %d less than key size", len(msg))
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:keySize])
+	if err != nil {
+		return nil, err
+	}
+	hs.re = re
+	hs.mixHash(msg[:keySize])
+	hs.mixKey(msg[:keySize])
+	return msg[keySize:], nil
+}
+
+// writeInit builds the first handshake message: e, es, s, ss.
+func (hs *handshakeState) writeInit(payload []byte) ([]byte, error) {
+	if !hs.initiator || hs.e != nil {
+		return nil, errHandshakeState
+	}
+	res, err := hs.writeEphemeral(make([]byte, 0, noiseInitSize+len(payload)))
+	if err != nil {
+		return nil, err
+	}
+	hs.mixDH(hs.e, hs.rs)
+	res = hs.encryptAndHash(res, hs.s.PublicKey().Bytes())
+	hs.mixDH(hs.s, hs.rs)
+	res = hs.encryptAndHash(res, payload)
+	return res, hs.err
+}
+
+// readInit consumes the first handshake message and learns the initiator static key.
+func (hs *handshakeState) readInit(msg []byte) ([]byte, error) {
+	if hs.initiator || hs.re != nil {
+		return nil, errHandshakeState
+	}
+	if len(msg) < noiseInitSize {
+		return nil, fmt.Errorf("handshake init length %d less than %d", len(msg), noiseInitSize)
+	}
+	msg, err := hs.readEphemeral(msg)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixDH(hs.s, hs.re)
+	if hs.err != nil {
+		return nil, hs.err
+	}
+
+	const encryptedKeySize = keySize + chacha20poly1305.Overhead
+	rs, err := hs.decryptAndHash(msg[:encryptedKeySize])
+	if err != nil {
+		return nil, err
+	}
+	if hs.rs, err = ecdh.X25519().NewPublicKey(rs); err != nil {
+		return nil, err
+	}
+
+	hs.mixDH(hs.s, hs.rs)
+	if hs.err != nil {
+		return nil, hs.err
+	}
+	return hs.decryptAndHash(msg[encryptedKeySize:])
+}
+
+// writeResponse builds the second handshake message: e, ee, se, psk.
+func (hs *handshakeState) writeResponse(payload []byte) (*session, []byte, error) {
+	if hs.initiator || hs.rs == nil || hs.e != nil {
+		return nil, nil, errHandshakeState
+	}
+	res, err := hs.writeEphemeral(make([]byte, 0, noiseResponseSize+len(payload)))
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.mixDH(hs.e, hs.re)
+	hs.mixDH(hs.e, hs.rs)
+	hs.mixKeyAndHash(hs.presharedKey())
+	res = hs.encryptAndHash(res, payload)
+	if hs.err != nil {
+		return nil, nil, hs.err
+	}
+
+	initiator, responder, err := hs.split()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &session{send: responder, recv: initiator}, res, nil
+}
+
+func (hs *handshakeState) readResponse(msg []byte) (*session, []byte, error) {
+	if !hs.initiator || hs.e == nil || hs.re != nil {
+		return nil, nil, errHandshakeState
+	}
+	if len(msg) < noiseResponseSize {
+		return nil, nil, fmt.Errorf("handshake response length %d less than %d", len(msg), noiseResponseSize)
+	}
+	msg, err := hs.readEphemeral(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+	hs.mixDH(hs.e, hs.re)
+	hs.mixDH(hs.s, hs.re)
+	if hs.err != nil {
+		return nil, nil, hs.err
+	}
+	hs.mixKeyAndHash(hs.presharedKey())
+
+	payload, err := hs.decryptAndHash(msg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	initiator, responder, err := hs.split()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &session{send: initiator, recv: responder}, payload, nil
+}
+
+func (hs *handshakeState) presharedKey() []byte {
+	if len(hs.psk) == 0 {
+		return make([]byte, keySize)
+	}
+	return hs.psk
+}
+
+const (
+	noiseInitSize     = keySize + keySize + chacha20poly1305.Overhead + chacha20poly1305.Overhead
+	noiseResponseSize = keySize + chacha20poly1305.Overhead
+)
@@ -0,0 +1,83 @@
+package stun
+
+import (
+	"net/netip"
+	"sync"
+	"sync/atomic"
+)
+
+type PeerEventType int
+
+const (
+	PeerConnected    PeerEventType = 0
+	PeerDisconnected PeerEventType = 1
+)
+
+func (t PeerEventType) String() string {
+	switch t {
+	case PeerConnected:
+		return "connected"
+	case PeerDisconnected:
+		return "disconnected"
+	default:
+		return "unknown"
+	}
+}
+
+// PeerEvent is published by the server when a client connects or leaves.
+type PeerEvent struct {
+	Type        PeerEventType
+	Peer        string
+	Address     netip.Addr
+	InetAddress netip.AddrPort
+	Reason      string
+}
+
+var peerEventBus = struct {
+	subscribers []peerSubscription
+	mu          sync.RWMutex
+}{}
+
+type peerSubscription struct {
+	c  chan PeerEvent
+	id uint64
+}
+
+var peerSubscriptionCnt uint64
+
+// SubscribePeerEvents registers an observer of server peers. Events are dropped
+// for observers which don't keep up.
+func SubscribePeerEvents() (events <-chan PeerEvent, cancel func()) {
+	ss := peerSubscription{
+		c:  make(chan PeerEvent, 16),
+		id: atomic.AddUint64(&peerSubscriptionCnt, 1),
+	}
+	peerEventBus.mu.Lock()
+	defer peerEventBus.mu.Unlock()
+	peerEventBus.subscribers = append(peerEventBus.subscribers, ss)
+
+	return ss.c, func() {
+		peerEventBus.mu.Lock()
+		defer peerEventBus.mu.Unlock()
+
+		for i := 0; i < len(peerEventBus.subscribers); i++ {
+			if peerEventBus.subscribers[i].id == ss.id {
+				last := len(peerEventBus.subscribers) - 1
+				peerEventBus.subscribers[i] = peerEventBus.subscribers[last]
+				peerEventBus.subscribers = peerEventBus.subscribers[:last]
+				return
+			}
+		}
+	}
+}
+
+func publishPeerEvent(ev PeerEvent) {
+	peerEventBus.mu.RLock()
+	defer peerEventBus.mu.RUnlock()
+	for _, s := range peerEventBus.subscribers {
+		select {
+		case s.c <- ev:
+		default:
+		}
+	}
+}
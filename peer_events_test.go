@@ -0,0 +1,24 @@
+package stun
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerEvents(t *testing.T) {
+	events, cancel := SubscribePeerEvents()
+	expected := PeerEvent{
+		Type:    PeerDisconnected,
+		Peer:    "laptop",
+		Address: netip.MustParseAddr("192.168.4.2"),
+		Reason:  "client shutdown",
+	}
+	publishPeerEvent(expected)
+	require.Equal(t, expected, <-events)
+
+	cancel()
+	publishPeerEvent(expected)
+	require.Empty(t, events)
+}
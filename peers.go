@@ -0,0 +1,170 @@
+package stun
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+// identity is a client known to the server, it may only use the overlay
+// addresses from allowedIPs. Client without allowed ips gets an address leased
+// from the server network.
+type identity struct {
+	name       string
+	publicKey  *ecdh.PublicKey
+	psk        []byte
+	allowedIPs []netip.Prefix
+	// initTimestamp is the timestamp of the last accepted handshake init
+	initTimestamp atomic.Uint64
+}
+
+// acceptInit advances the timestamp of handshake inits, it returns false if the init
+// isn't newer than the last accepted one, so it is a replay.
+func (i *identity) acceptInit(timestamp uint64) bool {
+	for {
+		last := i.initTimestamp.Load()
+		if timestamp <= last {
+			return false
+		}
+		if i.initTimestamp.CompareAndSwap(last, timestamp) {
+			return true
+		}
+	}
+}
+
+func (i *identity) allows(addr netip.Addr) bool {
+	for _, p := range i.allowedIPs {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// equal reports whether both identities have the same settings.
+func (i *identity) equal(o *identity) bool {
+	if i.name != o.name || !bytes.Equal(i.psk, o.psk) || len(i.allowedIPs) != len(o.allowedIPs) {
+		return false
+	}
+	for n := range i.allowedIPs {
+		if i.allowedIPs[n] != o.allowedIPs[n] {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *identity) String() string {
+	if i.name != "" {
+		return i.name
+	}
+	return encodeKey(i.publicKey.Bytes())
+}
+
+type peerRegistry struct {
+	byKey map[[keySize]byte]*identity
+}
+
+func newPeerRegistry(peers []PeerConfig) (*peerRegistry, error) {
+	res := &peerRegistry{byKey: make(map[[keySize]byte]*identity, len(peers))}
+	var all []*identity
+	names := make(map[string]struct{}, len(peers))
+	for _, p := range peers {
+		if p.Name != "" {
+			if _, ok := names[p.Name]; ok {
+				return nil, fmt.Errorf("duplicate peer name %s", p.Name)
+			}
+			names[p.Name] = struct{}{}
+		}
+		pub, err := parsePublicKey(p.PublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("peer %q public key: %w", p.PublicKey, err)
+		}
+		id := &identity{
+			name:      p.Name,
+			publicKey: pub,
+		}
+		if id.psk, err = parsePresharedKey(p.PreSharedKey); err != nil {
+			return nil, fmt.Errorf("peer %s pre-shared key: %w", id, err)
+		}
+		for _, a := range p.AllowedIPs {
+			prefix, err := parseAllowedIP(a)
+			if err != nil {
+				return nil, fmt.Errorf("peer %s allowed ip: %w", id, err)
+			}
+			for _, other := range all {
+				for _, o := range other.allowedIPs {
+					if o.Overlaps(prefix) {
+						return nil, fmt.Errorf("peer %s allowed ip %s overlaps with %s of peer %s", id, prefix, o, other)
+					}
+				}
+			}
+			id.allowedIPs = append(id.allowedIPs, prefix)
+		}
+
+		key := [keySize]byte(pub.Bytes())
+		if _, ok := res.byKey[key]; ok {
+			return nil, fmt.Errorf("duplicate peer %s", id)
+		}
+		res.byKey[key] = id
+		all = append(all, id)
+	}
+	return res, nil
+}
+
+func (r *peerRegistry) lookup(pub *ecdh.PublicKey) *identity {
+	return r.byKey[[keySize]byte(pub.Bytes())]
+}
+
+// keep replaces identities which didn't change since the previous registry with the
+// previous ones, so sessions, leases and policy rules of them stay valid.
+func (r *peerRegistry) keep(prev *peerRegistry) {
+	for key, id := range r.byKey {
+		old, ok := prev.byKey[key]
+		switch {
+		case ok && old.equal(id):
+			r.byKey[key] = old
+		case ok:
+			// inits accepted with old settings can't be replayed
+			id.initTimestamp.Store(old.initTimestamp.Load())
+		}
+	}
+}
+
+// find returns the client by name or public key.
+func (r *peerRegistry) find(ref string) *identity {
+	for _, id := range r.byKey {
+		if id.name != "" && id.name == ref {
+			return id
+		}
+	}
+	if pub, err := parsePublicKey(ref); err == nil {
+		return r.lookup(pub)
+	}
+	return nil
+}
+
+// owner returns the client with the address in its allowed ips.
+func (r *peerRegistry) owner(addr netip.Addr) *identity {
+	for _, id := range r.byKey {
+		if id.allows(addr) {
+			return id
+		}
+	}
+	return nil
+}
+
+func parseAllowedIP(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		return p.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,46 @@
+package stun
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeerRegistry(t *testing.T) {
+	first, second := testPrivateKey(t).PublicKey(), testPrivateKey(t).PublicKey()
+	registry, err := newPeerRegistry([]PeerConfig{
+		{Name: "first", PublicKey: encodeKey(first.Bytes()), AllowedIPs: []string{"192.168.4.2"}},
+		{PublicKey: encodeKey(second.Bytes()), AllowedIPs: []string{"192.168.4.16/28"}},
+	})
+	require.NoError(t, err)
+
+	id := registry.lookup(first)
+	require.NotNil(t, id)
+	require.Equal(t, "first", id.String())
+	require.True(t, id.allows(netip.MustParseAddr("192.168.4.2")))
+	require.False(t, id.allows(netip.MustParseAddr("192.168.4.3")))
+
+	id = registry.lookup(second)
+	require.NotNil(t, id)
+	require.True(t, id.allows(netip.MustParseAddr("192.168.4.20")))
+	require.False(t, id.allows(netip.MustParseAddr("192.168.4.2")))
+
+	require.Nil(t, registry.lookup(testPrivateKey(t).PublicKey()))
+}
+
+func TestPeerRegistryOverlap(t *testing.T) {
+	_, err := newPeerRegistry([]PeerConfig{
+		{PublicKey: encodeKey(testPrivateKey(t).PublicKey().Bytes()), AllowedIPs: []string{"192.168.4.2"}},
+		{PublicKey: encodeKey(testPrivateKey(t).PublicKey().Bytes()), AllowedIPs: []string{"192.168.4.0/24"}},
+	})
+	require.Error(t, err)
+}
+
+func TestPeerRegistryDuplicateName(t *testing.T) {
+	_, err := newPeerRegistry([]PeerConfig{
+		{Name: "laptop", PublicKey: encodeKey(testPrivateKey(t).PublicKey().Bytes())},
+		{Name: "laptop", PublicKey: encodeKey(testPrivateKey(t).PublicKey().Bytes())},
+	})
+	require.ErrorContains(t, err, "duplicate peer name laptop")
+}
@@ -0,0 +1,136 @@
+package stun
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// PingResult is the round trip time of a keep alive message reported by the control API.
+type PingResult struct {
+	// Addr is the overlay address of the peer which answered, it is unset if the
+	// server answered.
+	Addr netip.Addr    `json:"addr,omitempty"`
+	RTT  time.Duration `json:"rtt"`
+}
+
+// ackWaiters are pings waiting for acks by session.
+type ackWaiters struct {
+	mu      sync.Mutex
+	waiters map[uint32][]chan int64
+}
+
+// wait returns the channel of the receive time of the next ack of the session, cancel
+// stops the wait.
+func (a *ackWaiters) wait(session uint32) (<-chan int64, func()) {
+	ch := make(chan int64, 1)
+	a.mu.Lock()
+	if a.waiters == nil {
+		a.waiters = map[uint32][]chan int64{}
+	}
+	a.waiters[session] = append(a.waiters[session], ch)
+	a.mu.Unlock()
+
+	return ch, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		waiters := a.waiters[session]
+		for i, w := range waiters {
+			if w == ch {
+				a.waiters[session] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(a.waiters[session]) == 0 {
+			delete(a.waiters, session)
+		}
+	}
+}
+
+func (a *ackWaiters) notify(session uint32, now int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, ch := range a.waiters[session] {
+		select {
+		case ch <- now:
+		default:
+		}
+	}
+	delete(a.waiters, session)
+}
+
+// ping sends a keep alive message over the direct path to the overlay address and waits
+// for the ack of the peer. The server is pinged if the address is unset. Peers don't
+// answer keep alive messages relayed by the server, so it fails without a direct path.
+func (c *client) ping(ctx context.Context, dst netip.Addr) (PingResult, error) {
+	res := PingResult{Addr: dst}
+	sess := c.getSession()
+	if sess == nil {
+		return res, errors.New("not connected")
+	}
+	var d *directPath
+	id := sess.id
+	if dst.IsValid() {
+		if d = c.directPathTo(dst); d == nil {
+			return res, fmt.Errorf("no direct path to %s", dst)
+		}
+		id = d.session.id
+	}
+
+	acks, cancel := c.acks.wait(id)
+	defer cancel()
+	sent := time.Now().UnixNano()
+	msg := tmsg{tp: msgTypeKeepAlive, addr: c.deviceInfo().Addr}
+	var err error
+	if d != nil {
+		err = c.sendDirect(d, msg)
+	} else {
+		err = c.send(msg)
+	}
+	if err != nil {
+		return res, err
+	}
+
+	select {
+	case received := <-acks:
+		res.RTT = time.Duration(received - sent)
+		return res, nil
+	case <-ctx.Done():
+		return res, ctx.Err()
+	}
+}
+
+// servePing answers GET /ping?addr=<overlay address> with the round trip time to the
+// peer, or to the server without addr.
+func (c *client) servePing(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	var addr netip.Addr
+	if s := r.URL.Query().Get("addr"); s != "" {
+		var err error
+		if addr, err = netip.ParseAddr(s); err != nil {
+			http.Error(w, fmt.Sprintf("addr: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), PingTimeout)
+	defer cancel()
+	res, err := c.ping(ctx, addr)
+	if errors.Is(err, context.DeadlineExceeded) {
+		http.Error(w, fmt.Sprintf("no ack in %s", PingTimeout), http.StatusGatewayTimeout)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	writeJSON(w, res)
+}
@@ -0,0 +1,353 @@
+package stun
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"github.com/charmbracelet/log"
+	"github.com/google/gopacket/layers"
+	"github.com/jellydator/ttlcache/v3"
+)
+
+// policyTarget is the kind of destination of a forwarded packet.
+type policyTarget int
+
+const (
+	targetAny policyTarget = iota
+	// targetPeers are other clients in the overlay network
+	targetPeers
+	// targetEgress is the internet behind the server
+	targetEgress
+	// targetServer is the overlay address of the server
+	targetServer
+)
+
+var policyTargets = map[string]policyTarget{
+	"*":      targetAny,
+	"peers":  targetPeers,
+	"egress": targetEgress,
+	"server": targetServer,
+}
+
+type policyRule struct {
+	allow bool
+	// from is nil for any peer
+	from   map[*identity]struct{}
+	target policyTarget
+	// network is invalid for any destination address
+	network netip.Prefix
+	// proto is 0 for any protocol, icmp matches ICMPv4 and ICMPv6
+	proto    layers.IPProtocol
+	portFrom uint16
+	portTo   uint16
+}
+
+func (r *policyRule) matches(id *identity, pkt rawPacket, target policyTarget) bool {
+	if r.from != nil {
+		if _, ok := r.from[id]; !ok {
+			return false
+		}
+	}
+	if r.target != targetAny && r.target != target {
+		return false
+	}
+	if r.network.IsValid() && !r.network.Contains(ipDst(pkt)) {
+		return false
+	}
+	switch proto := ipProto(pkt); {
+	case r.proto == 0:
+	case r.proto == layers.IPProtocolICMPv4:
+		if proto != layers.IPProtocolICMPv4 && proto != layers.IPProtocolICMPv6 {
+			return false
+		}
+	case r.proto != proto:
+		return false
+	}
+	if r.portTo != 0 {
+		_, port, ok := ipPorts(pkt)
+		if !ok || port < r.portFrom || port > r.portTo {
+			return false
+		}
+	}
+	return true
+}
+
+// policyFlow is a flow between two clients, ports are zero if the protocol has none.
+type policyFlow struct {
+	proto    layers.IPProtocol
+	src, dst netip.AddrPort
+}
+
+func newPolicyFlow(pkt rawPacket) policyFlow {
+	src, dst, _ := ipPorts(pkt)
+	return policyFlow{
+		proto: ipProto(pkt),
+		src:   netip.AddrPortFrom(ipSrc(pkt), src),
+		dst:   netip.AddrPortFrom(ipDst(pkt), dst),
+	}
+}
+
+func (f policyFlow) reply() policyFlow {
+	return policyFlow{proto: f.proto, src: f.dst, dst: f.src}
+}
+
+// policy decides which packets of clients the server forwards. Traffic between clients
+// is tracked, so replies to an allowed flow are allowed as well.
+type policy struct {
+	rules []policyRule
+	flows *ttlcache.Cache[policyFlow, struct{}]
+	stop  context.CancelFunc
+}
+
+// newPolicy returns nil if there are no rules.
+func newPolicy(config PolicyConfig, peers *peerRegistry) (*policy, error) {
+	if len(config.Rules) == 0 {
+		return nil, nil
+	}
+
+	groups := make(map[string]map[*identity]struct{}, len(config.Groups))
+	for name, members := range config.Groups {
+		group := make(map[*identity]struct{}, len(members))
+		for _, m := range members {
+			id := peers.find(m)
+			if id == nil {
+				return nil, fmt.Errorf("group %s: unknown peer %s", name, m)
+			}
+			group[id] = struct{}{}
+		}
+		groups[name] = group
+	}
+
+	res := &policy{flows: ttlcache.New[policyFlow, struct{}]()}
+	for i, rc := range config.Rules {
+		r, err := parseRule(rc, groups, peers)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		res.rules = append(res.rules, r)
+	}
+	return res, nil
+}
+
+func parseRule(rc RuleConfig, groups map[string]map[*identity]struct{}, peers *peerRegistry) (policyRule, error) {
+	var r policyRule
+	switch rc.Action {
+	case "allow":
+		r.allow = true
+	case "deny":
+	default:
+		return r, fmt.Errorf("unknown action %q", rc.Action)
+	}
+
+	switch {
+	case rc.From == "*":
+	case strings.HasPrefix(rc.From, "group:"):
+		group, ok := groups[strings.TrimPrefix(rc.From, "group:")]
+		if !ok {
+			return r, fmt.Errorf("unknown group %s", rc.From)
+		}
+		r.from = group
+	default:
+		id := peers.find(rc.From)
+		if id == nil {
+			return r, fmt.Errorf("unknown peer %s", rc.From)
+		}
+		r.from = map[*identity]struct{}{id: {}}
+	}
+
+	if target, ok := policyTargets[rc.To]; ok {
+		r.target = target
+	} else {
+		network, err := parseAllowedIP(rc.To)
+		if err != nil {
+			return r, fmt.Errorf("destination %q: %w", rc.To, err)
+		}
+		r.network = network
+	}
+
+	switch rc.Proto {
+	case "":
+	case "tcp":
+		r.proto = layers.IPProtocolTCP
+	case "udp":
+		r.proto = layers.IPProtocolUDP
+	case "icmp":
+		r.proto = layers.IPProtocolICMPv4
+	default:
+		return r, fmt.Errorf("unknown protocol %q", rc.Proto)
+	}
+
+	if rc.Ports != "" {
+		if r.proto != layers.IPProtocolTCP && r.proto != layers.IPProtocolUDP {
+			return r, fmt.Errorf("ports %s without tcp or udp", rc.Ports)
+		}
+		from, to, ranged := strings.Cut(rc.Ports, "-")
+		if !ranged {
+			to = from
+		}
+		lo, err := strconv.ParseUint(from, 10, 16)
+		if err != nil {
+			return r, fmt.Errorf("ports %s: %w", rc.Ports, err)
+		}
+		hi, err := strconv.ParseUint(to, 10, 16)
+		if err != nil {
+			return r, fmt.Errorf("ports %s: %w", rc.Ports, err)
+		}
+		if lo == 0 || lo > hi {
+			return r, fmt.Errorf("invalid ports %s", rc.Ports)
+		}
+		r.portFrom, r.portTo = uint16(lo), uint16(hi)
+	}
+	return r, nil
+}
+
+// run expires tracked flows until ctx is done or the policy is replaced by stop.
+func (p *policy) run(ctx context.Context) {
+	ctx, p.stop = context.WithCancel(ctx)
+	go func() {
+		<-ctx.Done()
+		p.flows.Stop()
+	}()
+	go p.flows.Start()
+}
+
+// allows checks the packet of the client, rule is the index of the matched rule or -1.
+func (p *policy) allows(id *identity, pkt rawPacket, target policyTarget) (allowed bool, rule int) {
+	var flow policyFlow
+	if target == targetPeers {
+		flow = newPolicyFlow(pkt)
+		if p.flows.Get(flow) != nil {
+			return true, -1
+		}
+	}
+
+	for i := range p.rules {
+		r := &p.rules[i]
+		if !r.matches(id, pkt, target) {
+			continue
+		}
+		if r.allow && target == targetPeers {
+			p.flows.Set(flow.reply(), struct{}{}, PolicyFlowTimeout)
+		}
+		return r.allow, i
+	}
+	return false, -1
+}
+
+// allowsAll reports whether the policy allows any packet of the client to the overlay
+// addresses of another client. A rule which denies some of the packets, or no rule,
+// makes it false.
+func (p *policy) allowsAll(id *identity, dsts []netip.Addr) bool {
+	for i := range p.rules {
+		r := &p.rules[i]
+		if r.from != nil {
+			if _, ok := r.from[id]; !ok {
+				continue
+			}
+		}
+		if r.target != targetAny && r.target != targetPeers {
+			continue
+		}
+		matched := 0
+		for _, dst := range dsts {
+			if !r.network.IsValid() || r.network.Contains(dst) {
+				matched++
+			}
+		}
+		if matched == 0 {
+			continue
+		}
+		if !r.allow {
+			return false
+		}
+		if matched == len(dsts) && r.proto == 0 && r.portTo == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// permitsPath reports whether the clients may exchange all traffic, only such clients
+// are introduced for a direct path, its traffic doesn't pass the policy.
+func (p *policy) permitsPath(a, b *peer) bool {
+	return p.allowsAll(a.identity, b.overlayAddresses()) && p.allowsAll(b.identity, a.overlayAddresses())
+}
+
+// permits checks the packet of the peer against the policy, denied packets are counted
+// and logged at debug level, a peer may send many of them.
+func (s *server) permits(p *peer, pkt rawPacket, dst netip.Addr) bool {
+	policy := s.policy.Load()
+	if policy == nil {
+		return true
+	}
+	target := targetEgress
+	switch {
+	case s.isLocal(dst):
+		target = targetServer
+	case s.isPrivateNetwork(dst):
+		target = targetPeers
+	}
+
+	allowed, rule := policy.allows(p.identity, pkt, target)
+	if !allowed {
+		countDrop(dropReasonPolicy)
+		if rule < 0 {
+			log.Debugf("deny %s packet of peer %s to %s, no rule matched", ipProto(pkt), p.identity, dst)
+		} else {
+			log.Debugf("deny %s packet of peer %s to %s by rule %d", ipProto(pkt), p.identity, dst, rule+1)
+		}
+	}
+	return allowed
+}
+
+// ReadPolicy parses rules of the server firewall, one per line:
+//
+//	group <name> <peer>...
+//	allow|deny <from> <to> [tcp|udp|icmp[/<port>[-<port>]]]
+//
+// Peers are names or public keys, empty lines and lines starting with # are ignored.
+func ReadPolicy(r io.Reader) (PolicyConfig, error) {
+	var res PolicyConfig
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		if fields[0] == "group" {
+			if len(fields) < 3 {
+				return res, fmt.Errorf("line %d: group without members", n)
+			}
+			if res.Groups == nil {
+				res.Groups = map[string][]string{}
+			}
+			res.Groups[fields[1]] = append(res.Groups[fields[1]], fields[2:]...)
+			continue
+		}
+
+		rule, err := parseRuleLine(fields)
+		if err != nil {
+			return res, fmt.Errorf("line %d: %w", n, err)
+		}
+		res.Rules = append(res.Rules, rule)
+	}
+	return res, scanner.Err()
+}
+
+func parseRuleLine(fields []string) (RuleConfig, error) {
+	if len(fields) < 3 || len(fields) > 4 {
+		return RuleConfig{}, errors.New("rule not in format allow|deny <from> <to> [<proto>[/<ports>]]")
+	}
+	rule := RuleConfig{Action: fields[0], From: fields[1], To: fields[2]}
+	if len(fields) == 4 {
+		rule.Proto, rule.Ports, _ = strings.Cut(fields[3], "/")
+	}
+	return rule, nil
+}
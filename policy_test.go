@@ -0,0 +1,95 @@
+package stun
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicy(t *testing.T) {
+	admin, laptop := testPrivateKey(t).PublicKey(), testPrivateKey(t).PublicKey()
+	peers, err := newPeerRegistry([]PeerConfig{
+		{Name: "admin", PublicKey: encodeKey(admin.Bytes())},
+		{PublicKey: encodeKey(laptop.Bytes())},
+	})
+	require.NoError(t, err)
+
+	config, err := ReadPolicy(strings.NewReader(`
+# admins reach everything
+group admins admin
+allow group:admins *
+
+allow * peers tcp/8000-8080
+deny ` + encodeKey(laptop.Bytes()) + ` 198.51.100.0/24
+allow * egress
+`))
+	require.NoError(t, err)
+	require.Equal(t, []RuleConfig{
+		{Action: "allow", From: "group:admins", To: "*"},
+		{Action: "allow", From: "*", To: "peers", Proto: "tcp", Ports: "8000-8080"},
+		{Action: "deny", From: encodeKey(laptop.Bytes()), To: "198.51.100.0/24"},
+		{Action: "allow", From: "*", To: "egress"},
+	}, config.Rules)
+
+	p, err := newPolicy(config, peers)
+	require.NoError(t, err)
+	adminID, laptopID := peers.lookup(admin), peers.lookup(laptop)
+	laptopAddr := netip.MustParseAddrPort("192.168.50.3:5000")
+	adminAddr := netip.MustParseAddrPort("192.168.50.2:8080")
+
+	allowed, rule := p.allows(adminID, testNATPacket(t, adminAddr, laptopAddr, &layers.UDP{}), targetPeers)
+	require.True(t, allowed)
+	require.Equal(t, 0, rule)
+	// reply of the allowed flow
+	allowed, _ = p.allows(laptopID, testNATPacket(t, laptopAddr, adminAddr, &layers.UDP{}), targetPeers)
+	require.True(t, allowed)
+
+	allowed, rule = p.allows(laptopID, testNATPacket(t, laptopAddr, netip.MustParseAddrPort("192.168.50.2:22"), &layers.TCP{}), targetPeers)
+	require.False(t, allowed)
+	require.Equal(t, -1, rule)
+	allowed, rule = p.allows(laptopID, testNATPacket(t, laptopAddr, netip.MustParseAddrPort("192.168.50.2:8000"), &layers.TCP{}), targetPeers)
+	require.True(t, allowed)
+	require.Equal(t, 1, rule)
+
+	allowed, rule = p.allows(laptopID, testNATPacket(t, laptopAddr, netip.MustParseAddrPort("198.51.100.7:443"), &layers.TCP{}), targetEgress)
+	require.False(t, allowed)
+	require.Equal(t, 2, rule)
+	allowed, _ = p.allows(laptopID, testNATPacket(t, laptopAddr, netip.MustParseAddrPort("203.0.113.7:443"), &layers.TCP{}), targetEgress)
+	require.True(t, allowed)
+
+	allowed, _ = p.allows(laptopID, testNATPacket(t, laptopAddr, netip.MustParseAddrPort("192.168.50.1:53"), &layers.UDP{}), targetServer)
+	require.False(t, allowed)
+
+	// the laptop reaches the admin only on some ports, so they don't get a direct path
+	require.True(t, p.allowsAll(adminID, []netip.Addr{laptopAddr.Addr()}))
+	require.False(t, p.allowsAll(laptopID, []netip.Addr{adminAddr.Addr()}))
+	require.False(t, p.permitsPath(&peer{identity: adminID, peerAddress: adminAddr.Addr()}, &peer{identity: laptopID, peerAddress: laptopAddr.Addr()}))
+}
+
+func TestPolicyErrors(t *testing.T) {
+	peers, err := newPeerRegistry(nil)
+	require.NoError(t, err)
+
+	p, err := newPolicy(PolicyConfig{}, peers)
+	require.NoError(t, err)
+	require.Nil(t, p)
+
+	for _, rule := range []RuleConfig{
+		{Action: "reject", From: "*", To: "*"},
+		{Action: "allow", From: "nobody", To: "*"},
+		{Action: "allow", From: "group:nobody", To: "*"},
+		{Action: "allow", From: "*", To: "internet"},
+		{Action: "allow", From: "*", To: "*", Proto: "sctp"},
+		{Action: "allow", From: "*", To: "*", Proto: "icmp", Ports: "1"},
+		{Action: "allow", From: "*", To: "*", Proto: "tcp", Ports: "80-22"},
+	} {
+		_, err := newPolicy(PolicyConfig{Rules: []RuleConfig{rule}}, peers)
+		require.Error(t, err, "%+v", rule)
+	}
+
+	_, err = ReadPolicy(strings.NewReader("allow *"))
+	require.Error(t, err)
+}
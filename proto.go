@@ -1,6 +1,7 @@
 package stun
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
@@ -14,9 +15,22 @@ const (
 	msgTypeData      msgType = 1
 	msgTypeAck       msgType = 2
 	msgTypeKeepAlive msgType = 3
+	// msgTypeDisconnect payload is a human readable reason.
+	msgTypeDisconnect msgType = 4
+	// msgTypeError payload is a RejectError.
+	msgTypeError msgType = 5
+	// msgTypePeer introduces the peer with the address to the client, payload is a
+	// peerOffer.
+	msgTypePeer msgType = 6
+	// msgTypeUnpeer withdraws the direct path to the peer with the address, payload is
+	// the session of the path.
+	msgTypeUnpeer msgType = 7
 )
 
-const tmsgMaxHeaderSize = 1 /*cmd*/ + net.IPv6len /* max ip size */
+const (
+	tmsgMinHeaderSize = 1 /*cmd*/ + 1 /*ip size*/ + net.IPv4len
+	tmsgMaxHeaderSize = 1 /*cmd*/ + 1 /*ip size*/ + net.IPv6len
+)
 
 type tmsg struct {
 	tp      msgType
@@ -24,45 +38,171 @@ type tmsg struct {
 	payload []byte
 }
 
-func (t tmsg) MarshalBinary() ([]byte, error) {
-	const byteSize = 8
-	l := len(t.payload)
-	if !t.addr.IsValid() {
-		t.addr = netip.IPv4Unspecified()
-	}
-	res := make([]byte, 0, l+t.addr.BitLen()/byteSize+1+1)
+var errMalformedMessage = errors.New("malformed message")
 
-	res = append(res, byte(t.tp))
+func (t tmsg) headerSize() int {
+	if t.addr.Is6() {
+		return tmsgMaxHeaderSize
+	}
+	return tmsgMinHeaderSize
+}
 
-	res = append(res, byte(t.addr.BitLen()/byteSize))
-	addr, err := t.addr.MarshalBinary()
-	if err != nil {
-		return nil, err
+// putHeader writes the message header into dst, which must be at least headerSize long.
+// Invalid address is written as unspecified IPv4 address.
+func (t tmsg) putHeader(dst []byte) {
+	dst[0] = byte(t.tp)
+	if t.addr.Is6() {
+		addr := t.addr.As16()
+		dst[1] = net.IPv6len
+		copy(dst[2:], addr[:])
+		return
 	}
+	var addr [net.IPv4len]byte
+	if t.addr.Is4() {
+		addr = t.addr.As4()
+	}
+	dst[1] = net.IPv4len
+	copy(dst[2:], addr[:])
+}
 
-	res = append(res, addr...)
-	res = append(res, t.payload...)
+func (t tmsg) AppendBinary(dst []byte) ([]byte, error) {
+	n := len(dst)
+	dst = append(dst, make([]byte, t.headerSize())...)
+	t.putHeader(dst[n:])
+	return append(dst, t.payload...), nil
+}
 
-	return res, nil
+func (t tmsg) MarshalBinary() ([]byte, error) {
+	return t.AppendBinary(make([]byte, 0, t.headerSize()+len(t.payload)))
 }
 
+// UnmarshalBinary doesn't copy, payload shares memory with bts.
 func (t *tmsg) UnmarshalBinary(bts []byte) error {
-	const minHeaderSize = 6
-	if len(bts) < minHeaderSize {
-		return errors.New(fmt.Sprintf("slice length %d less than minimum size %d", len(bts), minHeaderSize))
+	if len(bts) < tmsgMinHeaderSize {
+		return fmt.Errorf("%w: length %d less than minimum size %d", errMalformedMessage, len(bts), tmsgMinHeaderSize)
 	}
-	t.tp = msgType(bts[0])
-	ipLen := bts[1]
-	if 2+int(ipLen) > len(bts) {
-		return errors.New(fmt.Sprintf("ip length %d greater than input slice length %d", ipLen, len(bts)))
+	ipLen := int(bts[1])
+	if ipLen != net.IPv4len && ipLen != net.IPv6len {
+		return fmt.Errorf("%w: unexpected ip length %d", errMalformedMessage, ipLen)
 	}
-
-	ip, ok := netip.AddrFromSlice(bts[2 : 2+ipLen])
-	if !ok {
-		return errors.New(fmt.Sprintf("can't parse bytes as ip address %+v", bts[2:2+bts[1]]))
+	if 2+ipLen > len(bts) {
+		return fmt.Errorf("%w: ip length %d greater than input length %d", errMalformedMessage, ipLen, len(bts))
 	}
 
+	ip, _ := netip.AddrFromSlice(bts[2 : 2+ipLen])
+	t.tp = msgType(bts[0])
 	t.addr = ip
 	t.payload = bts[2+ipLen:]
 	return nil
 }
+
+// capabilities is a bitmap of optional protocol features. Client sends supported
+// capabilities in connect, server answers with the enabled subset in ack.
+type capabilities uint32
+
+const (
+	// capIPv6 enables IPv6 inside the tunnel, ack carries the IPv6 lease.
+	capIPv6 capabilities = 1 << iota
+	// capDirect enables direct paths between clients, server sends peer offers.
+	capDirect
+)
+
+// supportedCapabilities are implemented by this build, bits are assigned as features land.
+const supportedCapabilities = capIPv6 | capDirect
+
+func (c capabilities) has(o capabilities) bool {
+	return c&o == o
+}
+
+const helloSize = 4 /*capabilities*/ + 1 /*prefix bits*/
+
+// helloIPv6Size is the size of the optional IPv6 address with its prefix length.
+const helloIPv6Size = net.IPv6len + 1
+
+// hello is the payload of connect and ack messages.
+type hello struct {
+	capabilities capabilities
+	// prefixBits is the network prefix length of the leased address in ack.
+	prefixBits uint8
+	// addr6 is the requested IPv6 address in connect and the IPv6 lease in ack.
+	// It is optional and appended only if valid.
+	addr6       netip.Addr
+	prefixBits6 uint8
+}
+
+func (h hello) MarshalBinary() ([]byte, error) {
+	res := make([]byte, helloSize, helloSize+helloIPv6Size)
+	binary.BigEndian.PutUint32(res, uint32(h.capabilities))
+	res[4] = h.prefixBits
+	if h.addr6.IsValid() {
+		addr := h.addr6.As16()
+		res = append(res, addr[:]...)
+		res = append(res, h.prefixBits6)
+	}
+	return res, nil
+}
+
+// UnmarshalBinary ignores trailing bytes, so new fields can be appended without a version change.
+func (h *hello) UnmarshalBinary(bts []byte) error {
+	if len(bts) < helloSize {
+		return fmt.Errorf("hello length %d less than %d", len(bts), helloSize)
+	}
+	h.capabilities = capabilities(binary.BigEndian.Uint32(bts))
+	h.prefixBits = bts[4]
+	if len(bts) >= helloSize+helloIPv6Size {
+		h.addr6 = netip.AddrFrom16([16]byte(bts[helloSize : helloSize+net.IPv6len]))
+		h.prefixBits6 = bts[helloSize+net.IPv6len]
+	}
+	return nil
+}
+
+const peerOfferSize = 4 /*session*/ + 2 /*port*/ + 1 /*ip size*/ + 2*keySize
+
+// peerOffer is the rendezvous of two clients. Both get the observed internet address
+// of each other and keys of the direct session, which the server generates.
+type peerOffer struct {
+	session  uint32
+	endpoint netip.AddrPort
+	sendKey  [keySize]byte
+	recvKey  [keySize]byte
+	// addr6 is the IPv6 overlay address of the peer, it is optional.
+	addr6 netip.Addr
+}
+
+func (o peerOffer) MarshalBinary() ([]byte, error) {
+	res := make([]byte, 0, peerOfferSize+2*net.IPv6len)
+	res = binary.BigEndian.AppendUint32(res, o.session)
+	res = binary.BigEndian.AppendUint16(res, o.endpoint.Port())
+	ip := o.endpoint.Addr().AsSlice()
+	res = append(res, byte(len(ip)))
+	res = append(res, ip...)
+	res = append(res, o.sendKey[:]...)
+	res = append(res, o.recvKey[:]...)
+	if o.addr6.IsValid() {
+		addr := o.addr6.As16()
+		res = append(res, addr[:]...)
+	}
+	return res, nil
+}
+
+func (o *peerOffer) UnmarshalBinary(bts []byte) error {
+	if len(bts) < peerOfferSize {
+		return fmt.Errorf("%w: peer offer length %d less than %d", errMalformedMessage, len(bts), peerOfferSize)
+	}
+	o.session = binary.BigEndian.Uint32(bts)
+	port := binary.BigEndian.Uint16(bts[4:])
+	ipLen := int(bts[6])
+	if ipLen != net.IPv4len && ipLen != net.IPv6len || len(bts) < peerOfferSize+ipLen {
+		return fmt.Errorf("%w: peer offer ip length %d", errMalformedMessage, ipLen)
+	}
+	ip, _ := netip.AddrFromSlice(bts[7 : 7+ipLen])
+	o.endpoint = netip.AddrPortFrom(ip, port)
+	bts = bts[7+ipLen:]
+	copy(o.sendKey[:], bts)
+	copy(o.recvKey[:], bts[keySize:])
+	bts = bts[2*keySize:]
+	if len(bts) >= net.IPv6len {
+		o.addr6 = netip.AddrFrom16([16]byte(bts[:net.IPv6len]))
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package stun
 
 import (
+	"fmt"
 	"net/netip"
 	"testing"
 
@@ -22,3 +23,133 @@ func TestMarshal(t *testing.T) {
 
 	require.Equal(t, expected, actual)
 }
+
+func TestUnmarshalMalformedAddress(t *testing.T) {
+	var actual tmsg
+	require.Error(t, actual.UnmarshalBinary([]byte{byte(msgTypeData), 5, 1, 2, 3, 4, 5}))
+	require.Error(t, actual.UnmarshalBinary([]byte{byte(msgTypeData), 16, 1, 2, 3, 4}))
+	require.Error(t, actual.UnmarshalBinary([]byte{byte(msgTypeData), 4}))
+}
+
+func TestHello(t *testing.T) {
+	expected := hello{
+		capabilities: 1<<31 | 1,
+		prefixBits:   24,
+	}
+
+	bts, err := expected.MarshalBinary()
+	require.NoError(t, err)
+
+	var actual hello
+	require.NoError(t, actual.UnmarshalBinary(append(bts, 0xff)))
+	require.Equal(t, expected, actual)
+}
+
+func TestRejectError(t *testing.T) {
+	expected := rejection(fmt.Errorf("%w: 10.0.0.2", errAddressInUse))
+	require.Equal(t, ErrorAddressInUse, expected.Code)
+
+	bts, err := expected.MarshalBinary()
+	require.NoError(t, err)
+
+	var actual *RejectError
+	require.ErrorAs(t, parseReject(bts), &actual)
+	require.Equal(t, expected, actual)
+	require.Equal(t, "server rejected connection: address in use: 10.0.0.2", actual.Error())
+
+	require.Error(t, parseReject(nil))
+}
+
+func TestAppendBinary(t *testing.T) {
+	for _, addr := range []netip.Addr{{}, netip.MustParseAddr("192.168.4.1"), netip.MustParseAddr("fd00::1")} {
+		msg := tmsg{tp: msgTypeData, addr: addr, payload: []byte{1, 2, 3}}
+		bts, err := msg.AppendBinary([]byte{0xff})
+		require.NoError(t, err)
+		require.Len(t, bts, 1+msg.headerSize()+len(msg.payload))
+
+		var actual tmsg
+		require.NoError(t, actual.UnmarshalBinary(bts[1:]))
+		if !addr.IsValid() {
+			addr = netip.IPv4Unspecified()
+		}
+		require.Equal(t, addr, actual.addr)
+		require.Equal(t, msg.payload, actual.payload)
+	}
+
+	msg := tmsg{tp: msgTypeData, addr: netip.MustParseAddr("192.168.4.1"), payload: make([]byte, 1280)}
+	buf := make([]byte, 0, 2048)
+	allocs := testing.AllocsPerRun(100, func() {
+		bts, _ := msg.AppendBinary(buf)
+		_ = msg.UnmarshalBinary(bts)
+	})
+	require.Zero(t, allocs)
+}
+
+func FuzzTmsgUnmarshal(f *testing.F) {
+	for _, msg := range []tmsg{
+		{tp: msgTypeData, addr: netip.MustParseAddr("192.168.4.1"), payload: []byte{1, 2, 3}},
+		{tp: msgTypeKeepAlive, addr: netip.MustParseAddr("fd00::1")},
+	} {
+		bts, err := msg.MarshalBinary()
+		require.NoError(f, err)
+		f.Add(bts)
+	}
+	f.Add([]byte{byte(msgTypeData), 5, 1, 2, 3, 4, 5})
+	f.Add([]byte{byte(msgTypeData), 16, 1, 2, 3, 4})
+
+	f.Fuzz(func(t *testing.T, bts []byte) {
+		var msg tmsg
+		if err := msg.UnmarshalBinary(bts); err != nil {
+			require.ErrorIs(t, err, errMalformedMessage)
+			return
+		}
+		actual, err := msg.MarshalBinary()
+		require.NoError(t, err)
+		require.Equal(t, bts, actual)
+	})
+}
+
+func TestHelloIPv6(t *testing.T) {
+	expected := hello{
+		capabilities: capIPv6,
+		prefixBits:   24,
+		addr6:        netip.MustParseAddr("fd00::2"),
+		prefixBits6:  64,
+	}
+
+	bts, err := expected.MarshalBinary()
+	require.NoError(t, err)
+
+	var actual hello
+	require.NoError(t, actual.UnmarshalBinary(bts))
+	require.Equal(t, expected, actual)
+
+	actual = hello{}
+	require.NoError(t, actual.UnmarshalBinary(bts[:helloSize]))
+	require.False(t, actual.addr6.IsValid())
+}
+
+func TestPeerOffer(t *testing.T) {
+	expected := peerOffer{
+		session:  7,
+		endpoint: netip.MustParseAddrPort("[2001:db8::1]:4000"),
+		addr6:    netip.MustParseAddr("fd00::3"),
+	}
+	expected.sendKey[0], expected.recvKey[0] = 1, 2
+
+	bts, err := expected.MarshalBinary()
+	require.NoError(t, err)
+
+	var actual peerOffer
+	require.NoError(t, actual.UnmarshalBinary(bts))
+	require.Equal(t, expected, actual)
+
+	expected.endpoint, expected.addr6 = netip.MustParseAddrPort("203.0.113.5:4000"), netip.Addr{}
+	bts, err = expected.MarshalBinary()
+	require.NoError(t, err)
+	actual = peerOffer{}
+	require.NoError(t, actual.UnmarshalBinary(bts))
+	require.Equal(t, expected, actual)
+
+	require.ErrorIs(t, actual.UnmarshalBinary(bts[:peerOfferSize-1]), errMalformedMessage)
+}
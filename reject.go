@@ -0,0 +1,82 @@
+package stun
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrorCode tells the client why the server refused the connection.
+type ErrorCode uint8
+
+const (
+	ErrorUnknown               ErrorCode = 0
+	ErrorAddressOutsideNetwork ErrorCode = 1
+	ErrorAddressInUse          ErrorCode = 2
+	ErrorAddressNotAllowed     ErrorCode = 3
+	ErrorNoFreeAddress         ErrorCode = 4
+	ErrorUnauthorized          ErrorCode = 5
+	ErrorUnsupportedVersion    ErrorCode = 6
+)
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrorUnknown:               "unknown",
+	ErrorAddressOutsideNetwork: "address outside network",
+	ErrorAddressInUse:          "address in use",
+	ErrorAddressNotAllowed:     "address not allowed",
+	ErrorNoFreeAddress:         "no free address",
+	ErrorUnauthorized:          "unauthorized",
+	ErrorUnsupportedVersion:    "unsupported version",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("code %d", uint8(c))
+}
+
+// RejectError is returned by the client when the server refused the connection.
+// It is also the payload of msgTypeError: code followed by the reason text.
+type RejectError struct {
+	Code   ErrorCode
+	Reason string
+}
+
+func (e *RejectError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("server rejected connection: %s", e.Code)
+	}
+	return fmt.Sprintf("server rejected connection: %s", e.Reason)
+}
+
+func (e *RejectError) MarshalBinary() ([]byte, error) {
+	res := make([]byte, 0, 1+len(e.Reason))
+	res = append(res, byte(e.Code))
+	res = append(res, e.Reason...)
+	return res, nil
+}
+
+func (e *RejectError) UnmarshalBinary(bts []byte) error {
+	if len(bts) < 1 {
+		return errors.New("empty error message")
+	}
+	e.Code = ErrorCode(bts[0])
+	e.Reason = string(bts[1:])
+	return nil
+}
+
+// rejection maps server errors to the error reported to the client.
+func rejection(err error) *RejectError {
+	res := &RejectError{Code: ErrorUnknown, Reason: err.Error()}
+	switch {
+	case errors.Is(err, errAddressOutsideNetwork):
+		res.Code = ErrorAddressOutsideNetwork
+	case errors.Is(err, errAddressInUse):
+		res.Code = ErrorAddressInUse
+	case errors.Is(err, errAddressNotAllowed):
+		res.Code = ErrorAddressNotAllowed
+	case errors.Is(err, errNoFreeAddress):
+		res.Code = ErrorNoFreeAddress
+	}
+	return res
+}
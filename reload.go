@@ -0,0 +1,66 @@
+package stun
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+
+	"github.com/charmbracelet/log"
+)
+
+// setPolicy replaces the policy, flows tracked by the previous one are forgotten.
+func (s *server) setPolicy(ctx context.Context, p *policy) {
+	if p != nil {
+		p.run(ctx)
+		log.Infof("forward traffic of clients by %d policy rules", len(p.rules))
+	}
+	if prev := s.policy.Swap(p); prev != nil {
+		prev.stop()
+		if p == nil {
+			log.Info("policy removed, forward all traffic of clients")
+		}
+	}
+}
+
+// reload applies peers and the policy of the config. Connected peers which were removed
+// or whose settings changed are disconnected, so they connect again with new settings.
+func (s *server) reload(ctx context.Context, config ServerConfig) error {
+	peers, err := newPeerRegistry(config.Peers)
+	if err != nil {
+		return err
+	}
+	peers.keep(s.peers.Load())
+	rules, err := newPolicy(config.Policy, peers)
+	if err != nil {
+		return fmt.Errorf("policy: %w", err)
+	}
+
+	s.peers.Store(peers)
+	s.leases.setPeers(peers)
+	if s.leases6 != nil {
+		s.leases6.setPeers(peers)
+	}
+	s.setPolicy(ctx, rules)
+	if rules != nil {
+		// traffic of direct paths doesn't pass the policy, so paths between clients it
+		// restricts are withdrawn
+		s.withdrawPaths(func(ends pathEnds) bool { return !rules.permitsPath(ends.a, ends.b) })
+	}
+
+	for _, p := range s.connectedPeers() {
+		switch id := peers.lookup(p.identity.publicKey); {
+		case id == nil:
+			s.kick(p, "peer removed")
+		case id != p.identity:
+			s.kick(p, "peer settings changed")
+		}
+	}
+
+	prev, cur := s.config, config
+	prev.Peers, prev.Policy, cur.Peers, cur.Policy = nil, PolicyConfig{}, nil, PolicyConfig{}
+	if !reflect.DeepEqual(prev, cur) {
+		log.Warn("only peers and policy are reloaded, other settings are applied after restart")
+	}
+	log.Infof("reloaded %d peers", len(peers.byKey))
+	return nil
+}
@@ -0,0 +1,90 @@
+package stun
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerReload(t *testing.T) {
+	laptop, phone := testPrivateKey(t).PublicKey(), testPrivateKey(t).PublicKey()
+	config := ServerConfig{Peers: []PeerConfig{
+		{Name: "laptop", PublicKey: encodeKey(laptop.Bytes())},
+		{Name: "phone", PublicKey: encodeKey(phone.Bytes()), AllowedIPs: []string{"192.168.50.3"}},
+	}}
+	registry, err := newPeerRegistry(config.Peers)
+	require.NoError(t, err)
+
+	conn, err := net.ListenUDP("udp4", net.UDPAddrFromAddrPort(netip.MustParseAddrPort("127.0.0.1:0")))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	s := &server{
+		conn:            conn,
+		config:          config,
+		leases:          newLeases(netip.MustParsePrefix("192.168.50.1/24"), registry),
+		knownLocalPeers: ttlcache.New[netip.Addr, *peer](),
+		knownSessions:   ttlcache.New[uint32, *peer](),
+	}
+	s.peers.Store(registry)
+	connect := func(pub []byte, id uint32, addr string) *peer {
+		sess, err := newSession(id, make([]byte, keySize), make([]byte, keySize))
+		require.NoError(t, err)
+		p := &peer{peerAddress: netip.MustParseAddr(addr), identity: s.peers.Load().byKey[[keySize]byte(pub)], session: sess}
+		p.roam(conn.LocalAddr().(*net.UDPAddr).AddrPort())
+		s.knownLocalPeers.Set(p.peerAddress, p, KeepAliveMaxDuration)
+		s.knownSessions.Set(sess.id, p, KeepAliveMaxDuration)
+		return p
+	}
+	laptopPeer := connect(laptop.Bytes(), 1, "192.168.50.2")
+	phonePeer := connect(phone.Bytes(), 2, "192.168.50.3")
+	s.paths = map[uint32]pathEnds{9: {laptopPeer, phonePeer}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloaded := config
+	reloaded.Peers = []PeerConfig{config.Peers[0], {Name: "phone", PublicKey: encodeKey(phone.Bytes()), AllowedIPs: []string{"192.168.50.4"}}}
+	reloaded.Policy = PolicyConfig{Rules: []RuleConfig{{Action: "allow", From: "laptop", To: "*"}}}
+	require.NoError(t, s.reload(ctx, reloaded))
+
+	// the laptop keeps its session, the phone connects again with the new address
+	require.Equal(t, []*peer{laptopPeer}, s.connectedPeers())
+	require.Same(t, laptopPeer.identity, s.peers.Load().lookup(laptop))
+	allowed, _ := s.policy.Load().allows(laptopPeer.identity, testNATPacket(t, netip.MustParseAddrPort("192.168.50.2:1000"), netip.MustParseAddrPort("203.0.113.7:443"), &layers.TCP{}), targetEgress)
+	require.True(t, allowed)
+
+	// the policy withdraws the direct path from both clients
+	require.Empty(t, s.paths)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	withdrawn := map[netip.Addr]netip.Addr{}
+	for len(withdrawn) < 2 {
+		buf := make([]byte, DeviceBufferSize)
+		n, err := conn.Read(buf)
+		require.NoError(t, err)
+		var e envelope
+		require.NoError(t, e.UnmarshalBinary(buf[:n]))
+		p := map[uint32]*peer{1: laptopPeer, 2: phonePeer}[e.session]
+		msg, err := p.session.open(e)
+		require.NoError(t, err)
+		if msg.tp == msgTypeUnpeer {
+			require.Equal(t, []byte{0, 0, 0, 9}, msg.payload)
+			withdrawn[p.peerAddress] = msg.addr
+		}
+	}
+	require.Equal(t, map[netip.Addr]netip.Addr{laptopPeer.peerAddress: phonePeer.peerAddress, phonePeer.peerAddress: laptopPeer.peerAddress}, withdrawn)
+
+	reloaded.Peers, reloaded.Policy = reloaded.Peers[1:], PolicyConfig{}
+	require.NoError(t, s.reload(ctx, reloaded))
+	require.Empty(t, s.connectedPeers())
+	require.Nil(t, s.policy.Load())
+
+	reloaded.Peers = append(reloaded.Peers, reloaded.Peers[0])
+	require.Error(t, s.reload(ctx, reloaded))
+	require.Nil(t, s.peers.Load().lookup(laptop))
+}
@@ -0,0 +1,60 @@
+package stun
+
+import "sync"
+
+const (
+	replayBlockBits  = 64
+	replayRingBlocks = 128
+	replayWindowSize = (replayRingBlocks - 1) * replayBlockBits
+)
+
+// replayFilter is the sliding window of received message counters, see RFC 6479.
+type replayFilter struct {
+	mu   sync.Mutex
+	last uint64
+	ring [replayRingBlocks]uint64
+}
+
+// seen reports whether the counter was already received or is too old, it doesn't
+// change the window.
+func (f *replayFilter) seen(counter uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.last > replayWindowSize && counter < f.last-replayWindowSize {
+		return true
+	}
+	if counter > f.last {
+		return false
+	}
+	return f.ring[(counter/replayBlockBits)%replayRingBlocks]&(uint64(1)<<(counter%replayBlockBits)) != 0
+}
+
+// accept marks the counter as received and reports whether it was seen for the first time.
+func (f *replayFilter) accept(counter uint64) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.last > replayWindowSize && counter < f.last-replayWindowSize {
+		return false
+	}
+
+	block := counter / replayBlockBits
+	if counter > f.last {
+		current := f.last / replayBlockBits
+		diff := block - current
+		if diff > replayRingBlocks {
+			diff = replayRingBlocks
+		}
+		for i := current + 1; i <= current+diff; i++ {
+			f.ring[i%replayRingBlocks] = 0
+		}
+		f.last = counter
+	}
+
+	block %= replayRingBlocks
+	bit := uint64(1) << (counter % replayBlockBits)
+	seen := f.ring[block]&bit != 0
+	f.ring[block] |= bit
+	return !seen
+}
@@ -0,0 +1,45 @@
+package stun
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplayFilter(t *testing.T) {
+	var f replayFilter
+
+	require.True(t, f.accept(0))
+	require.False(t, f.accept(0))
+	require.True(t, f.accept(2))
+	require.True(t, f.accept(1), "out of order inside window")
+	require.False(t, f.accept(1))
+
+	require.True(t, f.accept(replayWindowSize+10))
+	require.False(t, f.accept(5), "behind window")
+	require.True(t, f.accept(11))
+	require.False(t, f.accept(11))
+
+	require.True(t, f.accept(10*replayWindowSize))
+	require.False(t, f.accept(replayWindowSize+10))
+	require.True(t, f.accept(10*replayWindowSize-1))
+}
+
+func TestSessionReplay(t *testing.T) {
+	sessions, err := testHandshake(t, nil, nil)
+	require.NoError(t, err)
+
+	bts, err := sessions.client.seal(tmsg{tp: msgTypeKeepAlive})
+	require.NoError(t, err)
+
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(bts))
+	_, err = sessions.server.open(e)
+	require.NoError(t, err)
+
+	// the counter of the replay isn't authenticated, so it isn't counted
+	before := Drops()[dropReasonNames[dropReasonReplay]]
+	_, err = sessions.server.open(e)
+	require.ErrorIs(t, err, errReplay)
+	require.Equal(t, before, Drops()[dropReasonNames[dropReasonReplay]])
+}
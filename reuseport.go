@@ -0,0 +1,43 @@
+//go:build linux || freebsd || darwin
+
+package stun
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenReusePort opens the number of sockets bound to the same address, the kernel
+// spreads incoming datagrams over them by the source address.
+func listenReusePort(addr netip.AddrPort, n int) ([]*net.UDPConn, error) {
+	lc := net.ListenConfig{
+		Control: func(_, _ string, c syscall.RawConn) error {
+			var err error
+			if cerr := c.Control(func(fd uintptr) {
+				err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			}); cerr != nil {
+				return cerr
+			}
+			return err
+		},
+	}
+
+	var res []*net.UDPConn
+	for i := 0; i < n || i == 0; i++ {
+		conn, err := lc.ListenPacket(context.Background(), "udp", addr.String())
+		if err != nil {
+			for _, c := range res {
+				c.Close()
+			}
+			return nil, err
+		}
+		res = append(res, conn.(*net.UDPConn))
+		// the port is known after the first socket is bound
+		addr = conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	}
+	return res, nil
+}
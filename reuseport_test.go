@@ -0,0 +1,32 @@
+//go:build linux || freebsd || darwin
+
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenReusePort(t *testing.T) {
+	conns, err := listenReusePort(netip.MustParseAddrPort("127.0.0.1:0"), 3)
+	require.NoError(t, err)
+	require.Len(t, conns, 3)
+	for _, c := range conns {
+		defer c.Close()
+		require.Equal(t, conns[0].LocalAddr(), c.LocalAddr())
+	}
+
+	// any of the sockets sends from the shared address
+	client, err := net.DialUDP("udp4", nil, conns[0].LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = conns[2].WriteToUDPAddrPort([]byte{1}, client.LocalAddr().(*net.UDPAddr).AddrPort())
+	require.NoError(t, err)
+	buf := make([]byte, 1)
+	_, addr, err := client.ReadFromUDPAddrPort(buf)
+	require.NoError(t, err)
+	require.Equal(t, conns[0].LocalAddr().(*net.UDPAddr).AddrPort(), addr)
+}
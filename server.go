@@ -2,61 +2,239 @@ package stun
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"net"
 	"net/netip"
 	"runtime"
+	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/charmbracelet/log"
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 	"github.com/jellydator/ttlcache/v3"
+	"golang.org/x/net/ipv6"
 )
 
 type server struct {
-	conn               *net.UDPConn
-	tun                TunDevice
-	network            atomic.Pointer[net.IPNet]
-	deviceInfo         atomic.Pointer[Device]
-	config             ServerConfig
-	knownLocalPeers    *ttlcache.Cache[netip.Addr, peer]
-	knownInetAddresses *ttlcache.Cache[netip.Addr, peer]
+	conn            *net.UDPConn
+	tun             TunDevice
+	network         atomic.Pointer[net.IPNet]
+	deviceInfo      atomic.Pointer[Device]
+	config          ServerConfig
+	privateKey      *ecdh.PrivateKey
+	peers           atomic.Pointer[peerRegistry]
+	leases          *leases
+	leases6         *leases
+	knownLocalPeers *ttlcache.Cache[netip.Addr, *peer]
+	knownSessions   *ttlcache.Cache[uint32, *peer]
+	nat             *nat
+	policy          atomic.Pointer[policy]
+	connWorkers     *workerPool[connReadResult]
+	tunWorkers      *workerPool[packetBuf]
+	// rendezvous are pairs of sessions introduced to each other recently, paths are
+	// direct paths offered to clients by session of the path
+	rendezvousMu sync.Mutex
+	rendezvous   *ttlcache.Cache[peerPair, struct{}]
+	paths        map[uint32]pathEnds
+	// versionReplied is the time of the last version reply in unix nanoseconds
+	versionReplied atomic.Int64
 }
 
 type peer struct {
-	peerAddress netip.Addr
-	inetAddress netip.AddrPort
+	peerAddress  netip.Addr
+	peerAddress6 netip.Addr
+	endpoint     atomic.Pointer[netip.AddrPort]
+	identity     *identity
+	session      *session
+	capabilities capabilities
+	// ephemeral is the key of the handshake init answered with the response
+	ephemeral *ecdh.PublicKey
+	response  []byte
+	// lastSeen is the time of the last message in unix nanoseconds
+	lastSeen  atomic.Int64
+	rxPackets atomic.Uint64
+	txPackets atomic.Uint64
+	rxBytes   atomic.Uint64
+	txBytes   atomic.Uint64
 }
 
-func RunServer(ctx context.Context, tun TunDevice, config ServerConfig) error {
-	var err error
+// answered reports whether the session of the peer was created for the handshake init of
+// the identity with the ephemeral key.
+func (p *peer) answered(id *identity, ephemeral *ecdh.PublicKey) bool {
+	return p.identity == id && p.ephemeral != nil && p.ephemeral.Equal(ephemeral)
+}
+
+func (p *peer) inetAddress() netip.AddrPort {
+	return *p.endpoint.Load()
+}
+
+func (p *peer) event(tp PeerEventType, reason string) PeerEvent {
+	return PeerEvent{
+		Type:        tp,
+		Peer:        p.identity.String(),
+		Address:     p.peerAddress,
+		InetAddress: p.inetAddress(),
+		Reason:      reason,
+	}
+}
+
+// owns reports whether the peer may send packets from the address.
+func (p *peer) owns(addr netip.Addr) bool {
+	return addr == p.peerAddress || addr == p.peerAddress6 || p.identity.allows(addr)
+}
+
+// overlayAddresses returns the leased addresses of the peer.
+func (p *peer) overlayAddresses() []netip.Addr {
+	res := []netip.Addr{p.peerAddress}
+	if p.peerAddress6.IsValid() {
+		res = append(res, p.peerAddress6)
+	}
+	return res
+}
+
+// roam updates internet address of the peer, it returns false if address is the same.
+func (p *peer) roam(addr netip.AddrPort) bool {
+	prev := p.endpoint.Swap(&addr)
+	return prev == nil || *prev != addr
+}
+
+// RunServer serves clients until ctx is done. The returned reload applies changed peers
+// and policy of the config, sessions of peers whose settings didn't change survive it.
+func RunServer(ctx context.Context, tun TunDevice, config ServerConfig) (reload func(ServerConfig) error, err error) {
+	privateKey, err := parsePrivateKey(config.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("private key: %w", err)
+	}
+
+	peers, err := newPeerRegistry(config.Peers)
+	if err != nil {
+		return nil, err
+	}
+
+	network, err := netip.ParsePrefix(config.NetworkCIDR)
+	if err != nil {
+		return nil, err
+	}
+
+	var leases6 *leases
+	if config.NetworkCIDR6 != "" {
+		network6, err := netip.ParsePrefix(config.NetworkCIDR6)
+		if err != nil {
+			return nil, err
+		}
+		if !network6.Addr().Is6() {
+			return nil, fmt.Errorf("network %s is not IPv6", network6)
+		}
+		leases6 = newLeases(network6, peers)
+	}
+
 	err = configureServerTunnelDevice(tun, config)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	peersByLocalAddress := ttlcache.New[netip.Addr, peer]()
-	peersByInetAddress := ttlcache.New[netip.Addr, peer]()
+	peersByLocalAddress := ttlcache.New[netip.Addr, *peer]()
+	peersBySession := ttlcache.New[uint32, *peer]()
+	peersBySession.OnEviction(func(_ context.Context, reason ttlcache.EvictionReason, item *ttlcache.Item[uint32, *peer]) {
+		if reason == ttlcache.EvictionReasonExpired {
+			p := item.Value()
+			log.Infof("peer %s (%s) expired", p.peerAddress, p.identity)
+			publishPeerEvent(p.event(PeerDisconnected, "keep alive timeout"))
+		}
+	})
+	rendezvous := ttlcache.New[peerPair, struct{}]()
+	go peersBySession.Start()
+	go rendezvous.Start()
+	go func() {
+		<-ctx.Done()
+		peersBySession.Stop()
+		rendezvous.Stop()
+	}()
 
-	addressChanges, err := NotifyNetworkAddressesChanges(ctx)
+	addressChanges, err := NotifyNetworkAddressesChanges(ctx, tun.LinkName())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	var conn *net.UDPConn
-	conn, err = net.ListenUDP("udp",
-		net.UDPAddrFromAddrPort(netip.AddrPortFrom(netip.MustParseAddr("0.0.0.0"), uint16(config.ServerPort))))
+	// a socket is paired with every device queue, unspecified IPv6 address listens both
+	// IPv4 and IPv6
+	devices := tun.Queues()
+	conns, err := listenReusePort(netip.AddrPortFrom(netip.IPv6Unspecified(), uint16(config.ServerPort)), len(devices))
 	if err != nil {
-		return err
+		return nil, err
+	}
+	go func() {
+		<-ctx.Done()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+	queues := make([]deviceQueue, len(conns))
+	for i, c := range conns {
+		queues[i] = deviceQueue{conn: c, batch: newBatchConn(c), device: devices[i]}
 	}
 
 	deviceInfo := tun.LookupDeviceInfo()
 
 	srv := server{
-		conn:               conn,
-		tun:                tun,
-		knownLocalPeers:    peersByLocalAddress,
-		knownInetAddresses: peersByInetAddress,
+		conn:            conns[0],
+		tun:             tun,
+		config:          config,
+		privateKey:      privateKey,
+		leases:          newLeases(network, peers),
+		leases6:         leases6,
+		knownLocalPeers: peersByLocalAddress,
+		knownSessions:   peersBySession,
+		rendezvous:      rendezvous,
+	}
+
+	// paths of the session are gone with it, kicked peers withdraw them before
+	peersBySession.OnEviction(func(_ context.Context, _ ttlcache.EvictionReason, item *ttlcache.Item[uint32, *peer]) {
+		srv.forgetPaths(item.Value())
+	})
+
+	rules, err := newPolicy(config.Policy, peers)
+	if err != nil {
+		return nil, fmt.Errorf("policy: %w", err)
+	}
+	srv.peers.Store(peers)
+	srv.setPolicy(ctx, rules)
+
+	if config.ControlSocket != "" {
+		if err := serveControl(ctx, config.ControlSocket, srv.controlHandler()); err != nil {
+			return nil, fmt.Errorf("control api: %w", err)
+		}
+	}
+
+	if config.MetricsAddress != "" {
+		if err := serveMetrics(ctx, config.MetricsAddress, srv.writeMetrics); err != nil {
+			return nil, fmt.Errorf("metrics: %w", err)
+		}
+	}
+
+	if config.NAT {
+		egress, err := egressAddress(config.EgressAddress)
+		if err != nil {
+			return nil, err
+		}
+		transport, err := openNATEgress(egress)
+		if err != nil {
+			return nil, fmt.Errorf("nat: %w", err)
+		}
+		log.Infof("masquerade clients with %s", egress)
+		srv.nat = newNAT(egress, transport)
+		go srv.nat.run(ctx, func(p packetBuf) {
+			if err := srv.send(p, ipDst(p.payload()), nil); err != nil {
+				log.Warn("nat send error", "error", err)
+			}
+			putPacketBuf(p)
+		})
 	}
 
 	srv.network.Store(&net.IPNet{
@@ -76,50 +254,122 @@ func RunServer(ctx context.Context, tun TunDevice, config ServerConfig) error {
 		}
 	}()
 
-	go func() {
-		for b := range srv.readConnLoop(ctx, runtime.NumCPU()) {
-			go srv.receiveClientPacket(b.buf, b.netAddr)
-		}
-	}()
+	// packets from the socket are dropped when workers don't keep up, packets from the
+	// device wait, so the device queue fills up instead
+	// every worker batches its datagrams until its queue gets empty and writes them to
+	// the socket of a device queue
+	workers := runtime.NumCPU()
+	connOutputs, tunOutputs := make([]*output, workers), make([]*output, workers)
+	for i := 0; i < workers; i++ {
+		q := queues[i%len(queues)]
+		connOutputs[i] = &output{datagrams: newBatchWriter(q.batch), device: q.device}
+		tunOutputs[i] = &output{datagrams: newBatchWriter(q.batch), device: q.device}
+	}
+	srv.connWorkers = newWorkerPool(ctx, workers, false, func(w int, b connReadResult) {
+		srv.receiveClientPacket(b.buf, b.netAddr, connOutputs[w])
+		connOutputs[w].datagrams.release(b.buf)
+	}, func(w int) {
+		connOutputs[w].flush()
+	})
+	srv.tunWorkers = newWorkerPool(ctx, workers, true, func(w int, p packetBuf) {
+		srv.receiveDevicePacket(p, tunOutputs[w])
+		tunOutputs[w].datagrams.release(p.buf)
+	}, func(w int) {
+		tunOutputs[w].flush()
+	})
 
-	go func() {
-		for b := range srv.readTunLoop(ctx, runtime.NumCPU()) {
-			go srv.receiveDevicePacket(b)
-		}
-	}()
+	for _, q := range queues {
+		q := q
+		go func() {
+			for b := range srv.readConnLoop(ctx, q.batch, runtime.NumCPU()) {
+				if !srv.connWorkers.submit(ctx, b.flow(), b) {
+					putBuffer(b.buf)
+				}
+			}
+		}()
 
-	return nil
+		go func() {
+			for p := range srv.readTunLoop(ctx, q.device, runtime.NumCPU()) {
+				if !srv.tunWorkers.submit(ctx, flowHash(p.payload()), p) {
+					putPacketBuf(p)
+				}
+			}
+		}()
+	}
+
+	return func(config ServerConfig) error {
+		return srv.reload(ctx, config)
+	}, nil
 }
 
-func (s *server) send(payload []byte, dst net.IP) error {
+// deviceQueue is a device queue with the socket paired to it.
+type deviceQueue struct {
+	conn   *net.UDPConn
+	batch  batchConn
+	device TunQueue
+}
+
+// output is where a worker sends packets.
+type output struct {
+	datagrams *batchWriter
+	device    TunQueue
+}
+
+func (o *output) flush() {
+	o.datagrams.flush()
+	if err := o.device.Flush(); err != nil {
+		log.Warn("device write error", "error", err)
+	}
+}
+
+// send routes the packet, it is sent to out if it's not nil.
+func (s *server) send(pkt packetBuf, dst netip.Addr, out *output) error {
 	switch {
 	case s.isLocal(dst):
-		return s.handleSelf(payload)
+		return s.handleSelf(pkt.payload())
 	case s.isPrivateNetwork(dst):
-		ip, _ := netip.AddrFromSlice(dst)
-		p := s.knownLocalPeers.Get(ip.Unmap())
+		p := s.knownLocalPeers.Get(dst)
 		if p == nil {
-			if err := s.handleUnknownHost(payload); err != nil {
+			if err := s.handleUnknownHost(pkt.payload()); err != nil {
 				return err
 			}
 			return nil
 		}
-		bts, err := tmsg{
-			tp:      msgTypeData,
-			addr:    p.Value().peerAddress,
-			payload: payload,
-		}.MarshalBinary()
+		p.Value().txPackets.Add(1)
+		p.Value().txBytes.Add(uint64(len(pkt.payload())))
+		bts, err := p.Value().session.sealPacket(pkt, msgTypeData, p.Value().peerAddress)
 		if err != nil {
 			return err
 		}
-		log.Debugf("send data to %s", p.Value().inetAddress)
-		_, err = s.conn.WriteToUDPAddrPort(bts, p.Value().inetAddress)
+		log.Debugf("send data to %s", p.Value().inetAddress())
+		if out != nil {
+			out.datagrams.write(bts, p.Value().inetAddress())
+			return nil
+		}
+		_, err = s.conn.WriteToUDPAddrPort(bts, p.Value().inetAddress())
 		return err
 	default:
+		if s.nat != nil {
+			if ok, err := s.nat.translateOut(pkt.payload()); ok {
+				return err
+			}
+		}
 		log.Debugf("write data in device to %s", dst)
-		_, err := s.tun.Write(tunFrameEncode(payload))
+		return s.writeDevice(pkt.frame(), out)
+	}
+}
+
+// writeDevice writes the frame to the device queue of out, or to the device right away
+// if out is nil.
+func (s *server) writeDevice(frame []byte, out *output) error {
+	if out != nil {
+		_, err := out.device.Write(frame)
+		return err
+	}
+	if _, err := s.tun.Write(frame); err != nil {
 		return err
 	}
+	return s.tun.Flush()
 }
 
 type connReadResult struct {
@@ -127,35 +377,41 @@ type connReadResult struct {
 	buf     []byte
 }
 
-func (s *server) readConnLoop(ctx context.Context, nQueue int) <-chan connReadResult {
+// flow is the session of the datagram, so messages of one client are handled in order.
+// Handshakes don't have a session yet and are spread by the client address.
+func (b connReadResult) flow() uint32 {
+	if len(b.buf) >= envelopeHeaderSize && envelopeKind(b.buf[1]) == envelopeTransport {
+		return binary.LittleEndian.Uint32(b.buf[2:6])
+	}
+	addr := b.netAddr.Addr().As16()
+	return binary.LittleEndian.Uint32(addr[12:]) ^ uint32(b.netAddr.Port())
+}
+
+func (s *server) readConnLoop(ctx context.Context, conn batchConn, nQueue int) <-chan connReadResult {
 	res := make(chan connReadResult, nQueue)
 
 	go func() {
 		log.Infof("start listen connections")
 
+		reader := newBatchReader(DeviceBufferSize)
 		for {
 			select {
 			case <-ctx.Done():
 				return
 			default:
 			}
-			buf := make([]byte, DeviceBufferSize)
-			var n int
-			var netAddr netip.AddrPort
-			n, netAddr, err := s.conn.ReadFromUDPAddrPort(buf)
+			err := reader.read(conn, func(buf []byte, netAddr netip.AddrPort) {
+				select {
+				case res <- connReadResult{
+					buf:     buf,
+					netAddr: netAddr,
+				}:
+				case <-ctx.Done():
+					putBuffer(buf)
+				}
+			})
 			if err != nil {
 				log.Warn("connection read error", "error", err)
-				continue
-			}
-			buf = buf[:n:n]
-
-			select {
-			case res <- connReadResult{
-				buf:     buf,
-				netAddr: netAddr,
-			}:
-			case <-ctx.Done():
-				return
 			}
 		}
 	}()
@@ -163,8 +419,8 @@ func (s *server) readConnLoop(ctx context.Context, nQueue int) <-chan connReadRe
 	return res
 }
 
-func (s *server) readTunLoop(ctx context.Context, nQueue int) <-chan []byte {
-	res := make(chan []byte, nQueue)
+func (s *server) readTunLoop(ctx context.Context, device TunQueue, nQueue int) <-chan packetBuf {
+	res := make(chan packetBuf, nQueue)
 	go func() {
 		log.Infof("start device read loop")
 		for {
@@ -175,17 +431,23 @@ func (s *server) readTunLoop(ctx context.Context, nQueue int) <-chan []byte {
 			}
 
 			di := s.deviceInfo.Load()
-			buf := make([]byte, di.MTU+tunFrameHeaderSize)
-			n, err := s.tun.Read(buf)
+			p := getPacketBuf(di.MTU)
+			// frame header is read into the headroom
+			n, err := device.Read(p.buf[p.off-tunFrameHeaderSize:])
 			if err != nil {
+				putPacketBuf(p)
 				log.Warn("device read error", "error", err)
 				continue
 			}
-
-			buf = buf[tunFrameHeaderSize:n:n]
+			if n < tunFrameHeaderSize {
+				putPacketBuf(p)
+				continue
+			}
+			p = p.truncate(n - tunFrameHeaderSize)
+			capturePacket(captureDevice, p.payload())
 
 			select {
-			case res <- buf:
+			case res <- p:
 			case <-ctx.Done():
 				return
 			}
@@ -197,14 +459,22 @@ func (s *server) readTunLoop(ctx context.Context, nQueue int) <-chan []byte {
 type packet struct {
 	ip      layers.IPv4
 	icmp    layers.ICMPv4
+	ip6     layers.IPv6
+	icmp6   layers.ICMPv6
+	echo6   layers.ICMPv6Echo
 	payload gopacket.Payload
 }
 
 func (s *server) decode(buf []byte) (packet, error) {
 	var packet packet
-	parser := gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &packet.ip, &packet.icmp, &packet.payload)
+	var parser *gopacket.DecodingLayerParser
+	if ipVersion(buf) == 6 {
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv6, &packet.ip6, &packet.icmp6, &packet.echo6, &packet.payload)
+	} else {
+		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeIPv4, &packet.ip, &packet.icmp, &packet.payload)
+	}
 	parser.IgnoreUnsupported = true
-	decodedLayers := make([]gopacket.LayerType, 0, 3)
+	decodedLayers := make([]gopacket.LayerType, 0, 4)
 	if err := parser.DecodeLayers(buf, &decodedLayers); err != nil {
 		return packet, err
 	}
@@ -212,71 +482,72 @@ func (s *server) decode(buf []byte) (packet, error) {
 	return packet, nil
 }
 
-func (s *server) receiveDevicePacket(buf []byte) {
-	dstIP := ipv4Dst(buf)
-	log.Debugf("receive %d bytes to %s", len(buf), dstIP)
-	if err := s.send(buf, dstIP); err != nil {
+func (s *server) receiveDevicePacket(p packetBuf, out *output) {
+	if !validIPPacket(p.payload()) {
+		log.Debugf("drop malformed packet from device")
+		return
+	}
+	dstIP := ipDst(p.payload())
+	log.Debugf("receive %d bytes to %s", len(p.payload()), dstIP)
+	if err := s.send(p, dstIP, out); err != nil {
 		log.Warn("can't route payload with error %s", err)
 	}
 }
 
-func (s *server) receiveClientPacket(buf []byte, netAddr netip.AddrPort) {
+func (s *server) receiveClientPacket(buf []byte, netAddr netip.AddrPort, out *output) {
 	log.Debugf("read packet (%d size)", len(buf))
 
-	proto := tmsg{}
-	if err := proto.UnmarshalBinary(buf); err != nil {
-		log.Warnf("can't unmarshal %s", err)
+	var e envelope
+	if err := e.UnmarshalBinary(buf); err != nil {
+		log.Debugf("can't unmarshal %s", err)
+		// only clients starting a handshake are told the version, so the server doesn't
+		// answer arbitrary datagrams
+		if errors.As(err, &versionError{}) && isHandshakeInit(buf) {
+			s.replyVersion(netAddr)
+		}
 		return
 	}
 
-	switch proto.tp {
-	case msgTypeConnect:
-		if proto.addr.IsUnspecified() {
-			log.Debugf("drop connect from with empty ip peer and net address %s", netAddr)
-			return
-		}
-
-		ipNet := *s.network.Load()
-
-		if !ipNet.Contains(proto.addr.AsSlice()) {
-			log.Debugf("drop connect from with unexpected network in address %s. Only %s allowed", proto.addr, ipNet)
-			return
-		}
+	if e.kind == envelopeHandshakeInit {
+		countHandshake(s.handshake(e, netAddr))
+		return
+	}
 
-		p := peer{
-			peerAddress: proto.addr,
-			inetAddress: netAddr,
-		}
+	known := s.knownSessions.Get(e.session)
+	if known == nil {
+		log.Debugf("drop packet from %s with unknown session %d", netAddr, e.session)
+		return
+	}
 
-		bts, err := tmsg{tp: msgTypeAck}.MarshalBinary()
-		if err != nil {
-			log.Warn("can't marshal ack response", "error", err)
-			return
-		}
+	proto, err := known.Value().session.open(e)
+	if err != nil {
+		log.Debugf("drop packet from %s: %s", netAddr, err)
+		return
+	}
 
-		if _, err := s.conn.WriteToUDPAddrPort(bts, netAddr); err != nil {
-			log.Warn("send handshake response error", "error", err)
-			return
-		}
+	if proto.addr != known.Value().peerAddress {
+		log.Warnf("drop packet from peer %s with foreign address %s", known.Value().identity, proto.addr)
+		return
+	}
 
-		s.knownLocalPeers.Set(p.peerAddress, p, KeepAliveMaxDuration)
-		s.knownInetAddresses.Set(p.inetAddress.Addr(), p, KeepAliveMaxDuration)
+	if known.Value().roam(netAddr) {
+		log.Infof("peer %s roamed to inet address %s", proto.addr, netAddr)
+	}
+	known.Value().lastSeen.Store(time.Now().UnixNano())
 
-		log.Infof("connect peer %s, inet address %s", proto.addr, netAddr)
+	switch proto.tp {
 	case msgTypeKeepAlive:
 		log.Debugf("keep alive")
 
-		p := peer{
-			peerAddress: proto.addr,
-			inetAddress: netAddr,
-		}
-		if s.knownInetAddresses.Get(netAddr.Addr()) == nil {
-			return
+		s.knownLocalPeers.Touch(proto.addr)
+		s.knownSessions.Touch(e.session)
+		s.leases.renew(known.Value().identity)
+		if addr6 := known.Value().peerAddress6; addr6.IsValid() {
+			s.knownLocalPeers.Touch(addr6)
+			s.leases6.renew(known.Value().identity)
 		}
-		s.knownLocalPeers.Touch(p.peerAddress)
-		s.knownInetAddresses.Touch(p.inetAddress.Addr())
 
-		bts, err := tmsg{tp: msgTypeAck}.MarshalBinary()
+		bts, err := known.Value().session.seal(tmsg{tp: msgTypeAck})
 		if err != nil {
 			log.Warn("can't marshal ack response", "error", err)
 			return
@@ -288,12 +559,31 @@ func (s *server) receiveClientPacket(buf []byte, netAddr netip.AddrPort) {
 			return
 		}
 
+	case msgTypeDisconnect:
+		p := known.Value()
+		s.evict(p)
+		log.Infof("disconnect peer %s (%s): %s", p.peerAddress, p.identity, proto.payload)
+		publishPeerEvent(p.event(PeerDisconnected, string(proto.payload)))
+
 	default:
-		if proto.addr.IsUnspecified() {
-			log.Warnf("empty address in packet from %s", netAddr)
+		if !validIPPacket(proto.payload) {
+			log.Debugf("drop malformed packet from %s", netAddr)
+			return
+		}
+		if src := ipSrc(proto.payload); !known.Value().owns(src) {
+			log.Warnf("drop packet from peer %s with foreign source address %s", known.Value().identity, src)
+			return
+		}
+		capturePacket(captureTunnel, proto.payload)
+		dst := ipDst(proto.payload)
+		if !s.permits(known.Value(), proto.payload, dst) {
 			return
 		}
-		if err := s.send(proto.payload, ipv4Dst(proto.payload)); err != nil {
+		// traffic of the peer counts packets which are forwarded
+		known.Value().rxPackets.Add(1)
+		known.Value().rxBytes.Add(uint64(len(proto.payload)))
+		s.introduce(known.Value(), dst)
+		if err := s.send(receivedPacket(buf, proto), dst, out); err != nil {
 			log.Warn("write error", err)
 			return
 		}
@@ -301,6 +591,218 @@ func (s *server) receiveClientPacket(buf []byte, netAddr netip.AddrPort) {
 
 }
 
+// handshake answers the handshake init, it returns false if the init isn't answered with
+// a session.
+func (s *server) handshake(e envelope, netAddr netip.AddrPort) bool {
+	hs := newResponderHandshake(s.privateKey)
+	proto, err := hs.consumeInit(e)
+	if err != nil {
+		log.Debugf("drop handshake from %s: %s", netAddr, err)
+		return false
+	}
+
+	id := s.peers.Load().lookup(hs.rs)
+	if id == nil {
+		log.Warnf("drop handshake from %s with unknown public key %s", netAddr, encodeKey(hs.rs.Bytes()))
+		s.reject(netAddr, &RejectError{Code: ErrorUnauthorized, Reason: "unknown public key"})
+		return false
+	}
+
+	if proto.tp != msgTypeConnect {
+		log.Debugf("drop handshake from %s with message type %d", netAddr, proto.tp)
+		return false
+	}
+
+	// the last accepted init may come again as a copy sent to another server address
+	if hs.timestamp < id.initTimestamp.Load() {
+		log.Debugf("drop replayed handshake of peer %s from %s", id, netAddr)
+		return false
+	}
+
+	var request hello
+	if err := request.UnmarshalBinary(proto.payload); err != nil {
+		log.Warnf("drop connect from peer %s: %s", id, err)
+		return false
+	}
+
+	addr, err := s.leases.acquire(id, proto.addr)
+	if err != nil {
+		log.Warnf("drop connect from peer %s: %s", id, err)
+		s.rejectHandshake(hs, id, netAddr, proto.addr, rejection(err))
+		return false
+	}
+
+	// the client sends the same init to every server address, the copies get the
+	// response of the first one instead of replacing its session
+	if prev := s.knownLocalPeers.Get(addr, ttlcache.WithDisableTouchOnHit[netip.Addr, *peer]()); prev != nil && prev.Value().answered(id, hs.re) {
+		if _, err := s.conn.WriteToUDPAddrPort(prev.Value().response, netAddr); err != nil {
+			log.Warn("send handshake response error", "error", err)
+			return false
+		}
+		return true
+	}
+	if !id.acceptInit(hs.timestamp) {
+		log.Debugf("drop replayed handshake of peer %s from %s", id, netAddr)
+		return false
+	}
+
+	response := hello{
+		capabilities: request.capabilities & supportedCapabilities,
+		prefixBits:   uint8(s.leases.network.Bits()),
+	}
+	if s.leases6 == nil {
+		response.capabilities &^= capIPv6
+	}
+	if response.capabilities.has(capIPv6) {
+		addr6, err := s.leases6.acquire(id, request.addr6)
+		if err != nil {
+			log.Warnf("drop connect from peer %s: %s", id, err)
+			s.rejectHandshake(hs, id, netAddr, proto.addr, rejection(err))
+			return false
+		}
+		response.addr6 = addr6
+		response.prefixBits6 = uint8(s.leases6.network.Bits())
+	}
+	payload, err := response.MarshalBinary()
+	if err != nil {
+		log.Warn("can't marshal ack response", "error", err)
+		return false
+	}
+
+	hs.psk = id.psk
+	sess, bts, err := hs.responseEnvelope(s.newSessionID(), tmsg{
+		tp:      msgTypeAck,
+		addr:    addr,
+		payload: payload,
+	})
+	if err != nil {
+		log.Warn("can't marshal ack response", "error", err)
+		return false
+	}
+
+	p := &peer{
+		peerAddress:  addr,
+		peerAddress6: response.addr6,
+		identity:     id,
+		session:      sess,
+		capabilities: response.capabilities,
+		ephemeral:    hs.re,
+		response:     bts,
+	}
+	p.roam(netAddr)
+	p.lastSeen.Store(time.Now().UnixNano())
+
+	if _, err := s.conn.WriteToUDPAddrPort(bts, netAddr); err != nil {
+		log.Warn("send handshake response error", "error", err)
+		return false
+	}
+
+	// reconnect replaces the previous session of the peer
+	if prev := s.knownLocalPeers.Get(addr, ttlcache.WithDisableTouchOnHit[netip.Addr, *peer]()); prev != nil && prev.Value().identity == id {
+		s.evict(prev.Value())
+	}
+	s.knownLocalPeers.Set(p.peerAddress, p, KeepAliveMaxDuration)
+	if p.peerAddress6.IsValid() {
+		s.knownLocalPeers.Set(p.peerAddress6, p, KeepAliveMaxDuration)
+	}
+	s.knownSessions.Set(sess.id, p, KeepAliveMaxDuration)
+
+	if p.peerAddress6.IsValid() {
+		log.Infof("connect peer %s %s (%s), inet address %s", addr, p.peerAddress6, id, netAddr)
+	} else {
+		log.Infof("connect peer %s (%s), inet address %s", addr, id, netAddr)
+	}
+	publishPeerEvent(p.event(PeerConnected, ""))
+	return true
+}
+
+// evict forgets the peer session, the lease of the peer address is kept.
+func (s *server) evict(p *peer) {
+	s.knownSessions.Delete(p.session.id)
+	for _, addr := range []netip.Addr{p.peerAddress, p.peerAddress6} {
+		if current := s.knownLocalPeers.Get(addr, ttlcache.WithDisableTouchOnHit[netip.Addr, *peer]()); current != nil && current.Value() == p {
+			s.knownLocalPeers.Delete(addr)
+		}
+	}
+}
+
+func (s *server) newSessionID() uint32 {
+	var buf [4]byte
+	for {
+		if _, err := rand.Read(buf[:]); err != nil {
+			panic(err)
+		}
+		id := binary.LittleEndian.Uint32(buf[:])
+		if id != 0 && s.knownSessions.Get(id, ttlcache.WithDisableTouchOnHit[uint32, *peer]()) == nil {
+			return id
+		}
+	}
+}
+
+// rejectHandshake answers with an error instead of ack, the response is authenticated
+// but no session is kept.
+func (s *server) rejectHandshake(hs *handshakeState, id *identity, netAddr netip.AddrPort, addr netip.Addr, reason *RejectError) {
+	payload, err := reason.MarshalBinary()
+	if err != nil {
+		log.Warn("can't marshal error response", "error", err)
+		return
+	}
+	hs.psk = id.psk
+	_, bts, err := hs.responseEnvelope(0, tmsg{
+		tp:      msgTypeError,
+		addr:    addr,
+		payload: payload,
+	})
+	if err != nil {
+		log.Warn("can't marshal error response", "error", err)
+		return
+	}
+	if _, err := s.conn.WriteToUDPAddrPort(bts, netAddr); err != nil {
+		log.Warn("send error response error", "error", err)
+	}
+}
+
+// reject answers with a cleartext error to a handshake which can't be answered with a
+// handshake response.
+func (s *server) reject(netAddr netip.AddrPort, reason *RejectError) {
+	payload, err := reason.MarshalBinary()
+	if err != nil {
+		log.Warn("can't marshal error response", "error", err)
+		return
+	}
+	body, err := tmsg{tp: msgTypeError, payload: payload}.MarshalBinary()
+	if err != nil {
+		log.Warn("can't marshal error response", "error", err)
+		return
+	}
+	bts, err := envelope{kind: envelopeReject, body: body}.MarshalBinary()
+	if err != nil {
+		log.Warn("can't marshal error response", "error", err)
+		return
+	}
+	if _, err := s.conn.WriteToUDPAddrPort(bts, netAddr); err != nil {
+		log.Warn("send error response error", "error", err)
+	}
+}
+
+// replyVersion tells a peer with another protocol version which version the server speaks,
+// at most one reply is sent every VersionReplyInterval.
+func (s *server) replyVersion(netAddr netip.AddrPort) {
+	now := time.Now().UnixNano()
+	last := s.versionReplied.Load()
+	if now-last < int64(VersionReplyInterval) || !s.versionReplied.CompareAndSwap(last, now) {
+		return
+	}
+	bts, err := envelope{kind: envelopeHandshakeResponse}.MarshalBinary()
+	if err != nil {
+		log.Warn("can't marshal version response", "error", err)
+		return
+	}
+	if _, err := s.conn.WriteToUDPAddrPort(bts, netAddr); err != nil {
+		log.Warn("send version response error", "error", err)
+	}
+}
+
 func (s *server) gopacketOptions() gopacket.SerializeOptions {
 	return gopacket.SerializeOptions{
 		ComputeChecksums: true,
@@ -308,12 +810,18 @@ func (s *server) gopacketOptions() gopacket.SerializeOptions {
 	}
 }
 
-func (s *server) isPrivateNetwork(ip net.IP) bool {
-	return s.network.Load().Contains(ip)
+func (s *server) isPrivateNetwork(ip netip.Addr) bool {
+	if ip.Is6() {
+		return s.leases6 != nil && s.leases6.network.Contains(ip)
+	}
+	return s.network.Load().Contains(ip.AsSlice())
 }
 
-func (s *server) isLocal(ip net.IP) bool {
-	return s.network.Load().IP.Equal(ip)
+func (s *server) isLocal(ip netip.Addr) bool {
+	if ip.Is6() {
+		return s.leases6 != nil && s.leases6.network.Addr() == ip
+	}
+	return s.network.Load().IP.Equal(ip.AsSlice())
 }
 
 func (s *server) handleUnknownHost(buf []byte) error {
@@ -322,6 +830,10 @@ func (s *server) handleUnknownHost(buf []byte) error {
 		return err
 	}
 
+	if ipVersion(buf) == 6 {
+		return s.handleUnknownHost6(buf, input)
+	}
+
 	addr := *s.network.Load()
 
 	ipvh := layers.IPv4{
@@ -343,16 +855,56 @@ func (s *server) handleUnknownHost(buf []byte) error {
 	if err != nil {
 		return err
 	}
+	unknownHostReplies.Add(1)
+
+	return s.send(packetBuf{buf: sbuf.Bytes()}, ipSrc(buf), nil)
+}
+
+// handleUnknownHost6 answers with address unreachable, the message quotes the original
+// packet as much as fits into the minimum IPv6 MTU.
+func (s *server) handleUnknownHost6(buf []byte, input packet) error {
+	if input.icmp6.TypeCode.Type() == layers.ICMPv6TypeDestinationUnreachable {
+		return nil
+	}
+
+	ipvh := layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolICMPv6,
+		DstIP:      input.ip6.SrcIP,
+		SrcIP:      s.leases6.network.Addr().AsSlice(),
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6CodeAddressUnreachable),
+	}
+	if err := icmp.SetNetworkLayerForChecksum(&ipvh); err != nil {
+		return err
+	}
+
+	const minMTU6 = 1280
+	const maxQuote = minMTU6 - ipv6.HeaderLen - 8 /*icmp header*/
+	if len(buf) > maxQuote {
+		buf = buf[:maxQuote]
+	}
+	// 4 unused bytes precede the quoted packet
+	quote := append(make([]byte, 4, 4+len(buf)), buf...)
+
+	sbuf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(sbuf, s.gopacketOptions(), &ipvh, icmp, gopacket.Payload(quote)); err != nil {
+		return err
+	}
+	unknownHostReplies.Add(1)
 
-	return s.send(sbuf.Bytes(), input.ip.SrcIP)
+	return s.send(packetBuf{buf: sbuf.Bytes()}, ipSrc(buf), nil)
 }
 
 func (s *server) handleSelf(raw []byte) error {
-	if ipv4Proto(raw) != layers.IPProtocolICMPv4 {
-		_, err := s.tun.Write(raw)
-		if err != nil {
-			return err
-		}
+	if ipVersion(raw) == 6 {
+		return s.handleSelf6(raw)
+	}
+
+	if ipProto(raw) != layers.IPProtocolICMPv4 {
+		return s.writeDevice(tunFrameEncode(raw), nil)
 	}
 
 	originalPacket, err := s.decode(raw)
@@ -385,5 +937,46 @@ func (s *server) handleSelf(raw []byte) error {
 		return err
 	}
 
-	return s.send(buf.Bytes(), ip.DstIP)
+	return s.send(packetBuf{buf: buf.Bytes()}, ipSrc(raw), nil)
+}
+
+func (s *server) handleSelf6(raw []byte) error {
+	if ipProto(raw) != layers.IPProtocolICMPv6 {
+		return s.writeDevice(tunFrameEncode(raw), nil)
+	}
+
+	originalPacket, err := s.decode(raw)
+	if err != nil {
+		return err
+	}
+
+	if originalPacket.icmp6.TypeCode.Type() != layers.ICMPv6TypeEchoRequest {
+		return nil
+	}
+
+	ip := layers.IPv6{
+		Version:    6,
+		HopLimit:   64,
+		NextHeader: layers.IPProtocolICMPv6,
+		DstIP:      originalPacket.ip6.SrcIP,
+		SrcIP:      originalPacket.ip6.DstIP,
+	}
+	icmp := &layers.ICMPv6{
+		TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeEchoReply, 0),
+	}
+	if err := icmp.SetNetworkLayerForChecksum(&ip); err != nil {
+		return err
+	}
+	echo := &layers.ICMPv6Echo{
+		Identifier: originalPacket.echo6.Identifier,
+		SeqNumber:  originalPacket.echo6.SeqNumber,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, s.gopacketOptions(), &ip, icmp, echo, originalPacket.payload)
+	if err != nil {
+		return err
+	}
+
+	return s.send(packetBuf{buf: buf.Bytes()}, ipSrc(raw), nil)
 }
@@ -0,0 +1,92 @@
+package stun
+
+import (
+	"crypto/ecdh"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jellydator/ttlcache/v3"
+	"github.com/stretchr/testify/require"
+)
+
+// testHandshakeServer answers handshakes of the client on a loopback socket.
+func testHandshakeServer(t *testing.T, clientKey, serverKey *ecdh.PrivateKey) *server {
+	registry, err := newPeerRegistry([]PeerConfig{{Name: "laptop", PublicKey: encodeKey(clientKey.PublicKey().Bytes())}})
+	require.NoError(t, err)
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	s := &server{
+		conn:            conn,
+		privateKey:      serverKey,
+		leases:          newLeases(netip.MustParsePrefix("192.168.50.1/24"), registry),
+		knownLocalPeers: ttlcache.New[netip.Addr, *peer](),
+		knownSessions:   ttlcache.New[uint32, *peer](),
+	}
+	s.peers.Store(registry)
+	return s
+}
+
+func TestServerRepeatedHandshake(t *testing.T) {
+	clientKey, serverKey := testPrivateKey(t), testPrivateKey(t)
+	s := testHandshakeServer(t, clientKey, serverKey)
+	conn := s.conn
+
+	payload, err := hello{}.MarshalBinary()
+	require.NoError(t, err)
+	hs := newInitiatorHandshake(clientKey, serverKey.PublicKey(), nil)
+	init, err := hs.initEnvelope(tmsg{tp: msgTypeConnect, payload: payload})
+	require.NoError(t, err)
+	var e envelope
+	require.NoError(t, e.UnmarshalBinary(init))
+
+	// the copy sent to another server address gets the same session
+	client := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	require.True(t, s.handshake(e, client))
+	require.True(t, s.handshake(e, client))
+	require.Equal(t, 1, s.knownSessions.Len())
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	responses := make([][]byte, 2)
+	for i := range responses {
+		buf := make([]byte, DeviceBufferSize)
+		n, _, err := conn.ReadFromUDPAddrPort(buf)
+		require.NoError(t, err)
+		responses[i] = buf[:n]
+	}
+	require.Equal(t, responses[0], responses[1])
+
+	require.NoError(t, e.UnmarshalBinary(responses[0]))
+	sess, ack, err := hs.consumeResponse(e)
+	require.NoError(t, err)
+	require.Equal(t, msgTypeAck, ack.tp)
+	require.NotNil(t, s.knownSessions.Get(sess.id))
+}
+
+func TestServerReplayedHandshake(t *testing.T) {
+	clientKey, serverKey := testPrivateKey(t), testPrivateKey(t)
+	s := testHandshakeServer(t, clientKey, serverKey)
+	conn := s.conn
+
+	payload, err := hello{}.MarshalBinary()
+	require.NoError(t, err)
+	inits := make([]envelope, 2)
+	for i := range inits {
+		init, err := newInitiatorHandshake(clientKey, serverKey.PublicKey(), nil).initEnvelope(tmsg{tp: msgTypeConnect, payload: payload})
+		require.NoError(t, err)
+		require.NoError(t, inits[i].UnmarshalBinary(init))
+	}
+
+	client := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	require.True(t, s.handshake(inits[1], client))
+	live := s.knownLocalPeers.Get(netip.MustParseAddr("192.168.50.2")).Value()
+
+	// the older init is a replay from another address, the session survives
+	require.False(t, s.handshake(inits[0], netip.MustParseAddrPort("198.51.100.7:1300")))
+	require.Same(t, live, s.knownLocalPeers.Get(netip.MustParseAddr("192.168.50.2")).Value())
+	require.Equal(t, client, live.inetAddress())
+	require.Equal(t, 1, s.knownSessions.Len())
+}
@@ -9,25 +9,46 @@ import (
 	"os"
 )
 
-type TunDevice interface {
+// TunQueue reads and writes packets prefixed with the tun frame header.
+type TunQueue interface {
 	io.Reader
 	io.Writer
 	io.Closer
+	// Flush writes packets buffered by Write.
+	Flush() error
+}
+
+type TunDevice interface {
+	TunQueue
 	LookupDeviceInfo() Device
 	LinkName() string
+	// Queues returns the device queues, the device reads and writes the first one.
+	Queues() []TunQueue
 }
 
 type Device struct {
 	Addr netip.Addr
 	Mask net.IPMask
-	MTU  int
-	FD   uintptr
+	// Prefix6 is the IPv6 overlay address of the device, invalid if there is none.
+	Prefix6 netip.Prefix
+	MTU     int
+	FD      uintptr
 }
 
 var _ TunDevice = (*tun)(nil)
 
 type tun struct {
 	*os.File
+	queues []TunQueue
+}
+
+// fileQueue is a queue without offloads, it writes packets immediately.
+type fileQueue struct {
+	*os.File
+}
+
+func (fileQueue) Flush() error {
+	return nil
 }
 
 func (t tun) LookupDeviceInfo() Device {
@@ -43,11 +64,19 @@ func (t tun) LookupDeviceInfo() Device {
 	var res Device
 	for _, a := range addrs {
 		ipaddr, ok := a.(*net.IPNet)
-		if ok && len(ipaddr.IP.To4()) == net.IPv4len {
-			res.Addr, _ = netip.AddrFromSlice(ipaddr.IP)
-			res.Addr = res.Addr.Unmap()
+		if !ok {
+			continue
+		}
+		addr, _ := netip.AddrFromSlice(ipaddr.IP)
+		addr = addr.Unmap()
+		switch {
+		case addr.Is4():
+			res.Addr = addr
 			res.Mask = ipaddr.Mask
 			res.MTU = in.MTU
+		case addr.Is6() && !addr.IsLinkLocalUnicast():
+			bits, _ := ipaddr.Mask.Size()
+			res.Prefix6 = netip.PrefixFrom(addr, bits)
 		}
 	}
 	res.FD = t.File.Fd()
@@ -57,3 +86,29 @@ func (t tun) LookupDeviceInfo() Device {
 func (t tun) LinkName() string {
 	return t.File.Name()
 }
+
+func (t tun) Queues() []TunQueue {
+	return t.queues
+}
+
+func (t tun) Read(p []byte) (int, error) {
+	return t.queues[0].Read(p)
+}
+
+func (t tun) Write(p []byte) (int, error) {
+	return t.queues[0].Write(p)
+}
+
+func (t tun) Flush() error {
+	return t.queues[0].Flush()
+}
+
+func (t tun) Close() error {
+	var err error
+	for _, q := range t.queues {
+		if qerr := q.Close(); err == nil {
+			err = qerr
+		}
+	}
+	return err
+}
@@ -9,6 +9,7 @@ import (
 	"net/netip"
 	"os"
 	"reflect"
+	"strconv"
 	"syscall"
 	"unsafe"
 
@@ -42,6 +43,7 @@ func ioctlMacrosIO[T any](op int, subsystem byte, command int, dataType T) uintp
 var (
 	ioctlCTLIOCGINFO  = ioctlMacrosIO(IOCTL_W|IOCTL_R, 'N', 3, ctl_info{})
 	ioctlSIOCSKEVFILT = ioctlMacrosIO(IOCTL_W, 'e', 2, kev_request{})
+	ioctlSIOCAIFADDR6 = ioctlMacrosIO(IOCTL_W, 'i', 26, in6_aliasreq{})
 )
 
 type ifreq_addr struct {
@@ -49,6 +51,23 @@ type ifreq_addr struct {
 	in_addr unix.RawSockaddrInet4
 }
 
+// bsd/netinet6/in6_var.h
+type in6_addrlifetime struct {
+	expire    int64
+	preferred int64
+	vltime    uint32
+	pltime    uint32
+}
+
+type in6_aliasreq struct {
+	name       [16]byte
+	addr       unix.RawSockaddrInet6
+	dstaddr    unix.RawSockaddrInet6
+	prefixmask unix.RawSockaddrInet6
+	flags      int32
+	lifetime   in6_addrlifetime
+}
+
 type ifreq_flags struct {
 	name  [16]byte
 	flags uint16
@@ -75,7 +94,8 @@ type kev_request struct {
 	kev_subclass uint32
 }
 
-func InitTunDevice(tunNumber int) (TunDevice, error) {
+// InitTunDevice opens the utun device, it has a single queue.
+func InitTunDevice(tunNumber int, _ int) (TunDevice, error) {
 	fd, err := syscall.Socket(syscall.AF_SYSTEM, syscall.SOCK_DGRAM, AF_SYS_CONTROL)
 	if err != nil {
 		return nil, err
@@ -131,10 +151,12 @@ func InitTunDevice(tunNumber int) (TunDevice, error) {
 
 	log.Infof("tunnel device %s is ready", string(name[:]))
 
-	return tun{f}, nil
+	return tun{File: f, queues: []TunQueue{fileQueue{f}}}, nil
 }
 
-func NotifyNetworkAddressesChanges(ctx context.Context) (<-chan any, error) {
+// NotifyNetworkAddressesChanges signals changes of addresses of links except the
+// ignored one, which is the tunnel device, and wake ups of the system.
+func NotifyNetworkAddressesChanges(ctx context.Context, ignore string) (<-chan any, error) {
 	// bsd/sys/kern_event.h
 	type kern_event_msg struct {
 		total_size   uint32
@@ -145,6 +167,13 @@ func NotifyNetworkAddressesChanges(ctx context.Context) (<-chan any, error) {
 		event_code   uint32
 		event_data   uint32
 	}
+	// bsd/netinet/in_var.h, the data of inet events starts with the address and the link
+	type kev_in_data struct {
+		ia_addr   [4]byte
+		if_family uint32
+		if_unit   uint32
+		if_name   [16]byte
+	}
 
 	fd, err := syscall.Socket(syscall.AF_SYSTEM, syscall.SOCK_RAW, SYSPROTO_EVENT)
 	if err != nil {
@@ -172,7 +201,7 @@ func NotifyNetworkAddressesChanges(ctx context.Context) (<-chan any, error) {
 			}
 			buf := make([]byte, 1024)
 
-			_, err := unix.Read(fd, buf)
+			n, err := unix.Read(fd, buf)
 			if err != nil {
 				log.Warn("can't read network event", "error", err)
 				continue
@@ -183,6 +212,15 @@ func NotifyNetworkAddressesChanges(ctx context.Context) (<-chan any, error) {
 
 			log.Debug("receive event", "id", msg.id)
 
+			dataOffset := int(unsafe.Offsetof(msg.event_data))
+			if n >= dataOffset+int(unsafe.Sizeof(kev_in_data{})) {
+				data := (*kev_in_data)(unsafe.Pointer(&buf[dataOffset]))
+				name := string(bytes.Trim(data.if_name[:], "\x00")) + strconv.Itoa(int(data.if_unit))
+				if name == ignore {
+					continue
+				}
+			}
+
 			netEvents <- struct{}{}
 		}
 	}()
@@ -209,12 +247,13 @@ func NotifyNetworkAddressesChanges(ctx context.Context) (<-chan any, error) {
 
 }
 
-func configureClientTunnelDevice(device TunDevice, config ClientConfig) error {
+// configureClientTunnelDevice sets the leased addresses, lease6 is optional.
+func configureClientTunnelDevice(device TunDevice, lease, lease6 netip.Prefix) error {
 	sockfd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.AF_UNSPEC)
 	if err != nil {
 		return err
 	}
-	addr, mask, err := net.ParseCIDR(config.NetworkCIDR)
+	addr, mask, err := net.ParseCIDR(lease.String())
 	if err != nil {
 		return err
 	}
@@ -300,9 +339,43 @@ func configureClientTunnelDevice(device TunDevice, config ClientConfig) error {
 	if err != nil {
 		return err
 	}
+
+	if lease6.IsValid() {
+		return addAddress6(device, lease6)
+	}
 	return nil
 }
 
+func addAddress6(device TunDevice, lease6 netip.Prefix) error {
+	sockfd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_DGRAM, syscall.AF_UNSPEC)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(sockfd)
+
+	const infiniteLifetime = 0xffffffff
+	sockaddr := func(addr netip.Addr) unix.RawSockaddrInet6 {
+		return unix.RawSockaddrInet6{
+			Len:    unix.SizeofSockaddrInet6,
+			Family: unix.AF_INET6,
+			Addr:   addr.As16(),
+		}
+	}
+	mask, _ := netip.AddrFromSlice(net.CIDRMask(lease6.Bits(), net.IPv6len*8))
+
+	log.Debugf("set address %s", lease6)
+	req := in6_aliasreq{
+		addr:       sockaddr(lease6.Addr()),
+		prefixmask: sockaddr(mask),
+		lifetime: in6_addrlifetime{
+			vltime: infiniteLifetime,
+			pltime: infiniteLifetime,
+		},
+	}
+	copy(req.name[:], device.LinkName())
+	return ioctl(uintptr(sockfd), ioctlSIOCAIFADDR6, uintptr(unsafe.Pointer(&req)))
+}
+
 func configureServerTunnelDevice(_ TunDevice, _ ServerConfig) error {
 	panic(errors.New("server mode not allowed for darwin"))
 }
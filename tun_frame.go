@@ -13,22 +13,44 @@ const (
 	tunFrameHeaderSize = 4
 )
 
-var tunFrameIPV4Header = func() []byte {
+var (
+	tunFrameIPV4Header = tunFrameHeader(4)
+	tunFrameIPV6Header = tunFrameHeader(6)
+)
+
+func tunFrameHeader(ipVersion int) []byte {
 	var res [tunFrameHeaderSize]byte
 
 	switch runtime.GOOS {
 	case "darwin":
-		res[3] = 2
+		// address family
+		if ipVersion == 6 {
+			res[3] = 30
+		} else {
+			res[3] = 2
+		}
 	default:
-		binary.BigEndian.PutUint16(res[2:], uint16(layers.EthernetTypeIPv4)) // set IPv4 protocol
+		// set protocol
+		if ipVersion == 6 {
+			binary.BigEndian.PutUint16(res[2:], uint16(layers.EthernetTypeIPv6))
+		} else {
+			binary.BigEndian.PutUint16(res[2:], uint16(layers.EthernetTypeIPv4))
+		}
 	}
 	return res[:]
-}()
+}
+
+func tunFrameHeaderOf(payload []byte) []byte {
+	if ipVersion(payload) == 6 {
+		return tunFrameIPV6Header
+	}
+	return tunFrameIPV4Header
+}
 
 // https://docs.kernel.org/networking/tuntap.html#frame-format
 func tunFrameEncode(payload []byte) []byte {
 	res := make([]byte, tunFrameHeaderSize+len(payload))
-	copy(res, tunFrameIPV4Header)
+	copy(res, tunFrameHeaderOf(payload))
 	copy(res[tunFrameHeaderSize:], payload)
 	return res
 }
@@ -3,6 +3,7 @@ package stun
 import (
 	"context"
 	"net"
+	"net/netip"
 	"os"
 	"strconv"
 	"strings"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/charmbracelet/log"
 	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
 const (
@@ -18,23 +20,57 @@ const (
 	cIFFTAP        = 0x0002
 	cIFFNOPI       = 0x1000
 	cIFFMULTIQUEUE = 0x0100
+	cIFFVNETHDR    = 0x4000
 )
 
-func InitTunDevice(n int) (ifce TunDevice, err error) {
+// InitTunDevice opens the device with the number of queues, packets of a flow are
+// always read from the same queue. The device segments and coalesces tcp packets with
+// the virtio header, see offloadQueue.
+func InitTunDevice(n int, queues int) (TunDevice, error) {
+	f, err := openTunQueue("tun" + strconv.Itoa(n))
+	if err != nil {
+		return nil, err
+	}
+
+	offloads := unix.TUN_F_CSUM | unix.TUN_F_TSO4 | unix.TUN_F_TSO6
+	if err := ioctl(f.Fd(), unix.TUNSETOFFLOAD, uintptr(offloads)); err != nil {
+		log.Warn("tcp segmentation offload is not supported", "error", err)
+	}
+
+	res := tun{File: f}
+	for i := 0; i < queues || i == 0; i++ {
+		qf := f
+		if i > 0 {
+			if qf, err = openTunQueue(f.Name()); err != nil {
+				res.Close()
+				return nil, err
+			}
+		}
+		q, err := newOffloadQueue(qf)
+		if err != nil {
+			qf.Close()
+			res.Close()
+			return nil, err
+		}
+		res.queues = append(res.queues, q)
+	}
+
+	return res, nil
+}
+
+func openTunQueue(name string) (*os.File, error) {
 	type ifReq struct {
 		Name  [0x10]byte
 		Flags uint16
 		pad   [0x28 - 0x10 - 2]byte
 	}
 
-	var fd int
-	if fd, err = syscall.Open(
-		"/dev/net/tun", os.O_RDWR|syscall.O_NONBLOCK, 0); err != nil {
+	fd, err := syscall.Open("/dev/net/tun", os.O_RDWR|syscall.O_NONBLOCK, 0)
+	if err != nil {
 		return nil, err
 	}
 
-	var flags uint16 = cIFFTUN | cIFFMULTIQUEUE
-	name := "tun" + strconv.Itoa(n)
+	var flags uint16 = cIFFTUN | cIFFMULTIQUEUE | cIFFVNETHDR
 
 	var req ifReq
 	req.Flags = flags
@@ -42,14 +78,13 @@ func InitTunDevice(n int) (ifce TunDevice, err error) {
 
 	err = ioctl(uintptr(fd), syscall.TUNSETIFF, uintptr(unsafe.Pointer(&req)))
 	if err != nil {
-		return
+		syscall.Close(fd)
+		return nil, err
 	}
 
 	name = strings.Trim(string(req.Name[:]), "\x00")
 
-	return &tun{
-		File: os.NewFile(uintptr(fd), name),
-	}, nil
+	return os.NewFile(uintptr(fd), name), nil
 }
 
 func configureServerTunnelDevice(device TunDevice, config ServerConfig) error {
@@ -63,7 +98,7 @@ func configureServerTunnelDevice(device TunDevice, config ServerConfig) error {
 		return err
 	}
 
-	mtu := link.Attrs().MTU - tmsgMaxHeaderSize
+	mtu := link.Attrs().MTU - tunnelOverhead
 	log.Debugf("set link mtu %d", mtu)
 	if err := netlink.LinkSetMTU(link, mtu); err != nil {
 		return err
@@ -96,10 +131,24 @@ func configureServerTunnelDevice(device TunDevice, config ServerConfig) error {
 		return err
 	}
 
+	if config.NetworkCIDR6 != "" {
+		ip, ipNet, err := net.ParseCIDR(config.NetworkCIDR6)
+		if err != nil {
+			return err
+		}
+		ipNet.IP = ip
+
+		log.Debugf("add address %s", ipNet)
+		if err := netlink.AddrAdd(link, &netlink.Addr{IPNet: ipNet}); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func configureClientTunnelDevice(device TunDevice, config ClientConfig) error {
+// configureClientTunnelDevice sets the leased addresses, lease6 is optional.
+func configureClientTunnelDevice(device TunDevice, lease, lease6 netip.Prefix) error {
 	link, err := netlink.LinkByName(device.LinkName())
 	if err != nil {
 		return err
@@ -115,16 +164,22 @@ func configureClientTunnelDevice(device TunDevice, config ClientConfig) error {
 		return err
 	}
 
-	ip, mask, err := net.ParseCIDR(config.NetworkCIDR)
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
 	if err != nil {
 		return err
 	}
+	for _, a := range addrs {
+		log.Debugf("remove link address %s", a.IPNet)
+		if err := netlink.AddrDel(link, &a); err != nil {
+			return err
+		}
+	}
 
-	log.Debugf("set link address %s", mask)
+	log.Debugf("set link address %s", lease)
 
 	if err := netlink.AddrAdd(link, &netlink.Addr{
 		IPNet: &net.IPNet{
-			IP:   ip,
+			IP:   lease.Addr().AsSlice(),
 			Mask: net.IPMask{255, 255, 255, 255},
 		},
 		Scope: int(netlink.SCOPE_UNIVERSE),
@@ -132,19 +187,68 @@ func configureClientTunnelDevice(device TunDevice, config ClientConfig) error {
 		return err
 	}
 
+	if !lease6.IsValid() {
+		return nil
+	}
+
+	addrs, err = netlink.AddrList(link, netlink.FAMILY_V6)
+	if err != nil {
+		return err
+	}
+	for _, a := range addrs {
+		if a.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		log.Debugf("remove link address %s", a.IPNet)
+		if err := netlink.AddrDel(link, &a); err != nil {
+			return err
+		}
+	}
+
+	log.Debugf("set link address %s", lease6)
+
+	// on-link route to the overlay network comes with the prefix
+	if err := netlink.AddrAdd(link, &netlink.Addr{
+		IPNet: &net.IPNet{
+			IP:   lease6.Addr().AsSlice(),
+			Mask: net.CIDRMask(lease6.Bits(), net.IPv6len*8),
+		},
+	}); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func NotifyNetworkAddressesChanges(ctx context.Context) (<-chan any, error) {
+// NotifyNetworkAddressesChanges signals changes of addresses of links except the
+// ignored one, which is the tunnel device.
+func NotifyNetworkAddressesChanges(ctx context.Context, ignore string) (<-chan any, error) {
+	link, err := netlink.LinkByName(ignore)
+	if err != nil {
+		return nil, err
+	}
 	changes := make(chan netlink.AddrUpdate)
 
-	if err := netlink.AddrSubscribe(changes, nil); err != nil {
+	if err := netlink.AddrSubscribe(changes, ctx.Done()); err != nil {
 		return nil, err
 	}
 	res := make(chan any)
 	go func() {
-		c := <-changes
-		res <- c
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case c := <-changes:
+				if c.LinkIndex == link.Attrs().Index {
+					continue
+				}
+				select {
+				case res <- c:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
 	}()
 	return res, nil
 }
@@ -0,0 +1,161 @@
+package stun
+
+import (
+	"io"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/charmbracelet/log"
+	"golang.org/x/sys/unix"
+)
+
+var _ TunQueue = (*offloadQueue)(nil)
+
+// offloadQueue is a queue of the device opened with IFF_VNET_HDR. The device reads tcp
+// super packets, they are split into segments of the device MTU. Written tcp segments
+// are coalesced into super packets until Flush.
+type offloadQueue struct {
+	file *os.File
+	rc   syscall.RawConn
+
+	readMu sync.Mutex
+	rhdr   [virtioNetHdrSize]byte
+	// in holds the super packet which is split from the offset next
+	in      []byte
+	inPkt   []byte
+	inHdr   virtioNetHdr
+	inFrame [tunFrameHeaderSize]byte
+	next    int
+
+	writeMu   sync.Mutex
+	whdr      [tunFrameHeaderSize + virtioNetHdrSize]byte
+	coalescer *tcpCoalescer
+}
+
+func newOffloadQueue(f *os.File) (*offloadQueue, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	q := &offloadQueue{
+		file: f,
+		rc:   rc,
+		in:   make([]byte, maxGSOSize),
+	}
+	q.coalescer = newTCPCoalescer(q.write)
+	return q, nil
+}
+
+// Read reads a packet prefixed with the tun frame header.
+func (q *offloadQueue) Read(p []byte) (int, error) {
+	q.readMu.Lock()
+	defer q.readMu.Unlock()
+
+	if len(p) <= tunFrameHeaderSize {
+		return 0, io.ErrShortBuffer
+	}
+	if q.next != 0 {
+		return q.segment(p)
+	}
+
+	// packets that fit are read in place, super packets overflow to in
+	overflow := q.in[:0]
+	if len(p)-tunFrameHeaderSize < len(q.in) {
+		overflow = q.in[len(p)-tunFrameHeaderSize:]
+	}
+	iovs := [][]byte{p[:tunFrameHeaderSize], q.rhdr[:], p[tunFrameHeaderSize:], overflow}
+	var n int
+	var err error
+	if rerr := q.rc.Read(func(fd uintptr) bool {
+		n, err = unix.Readv(int(fd), iovs)
+		return err != unix.EAGAIN
+	}); rerr != nil {
+		return 0, rerr
+	}
+	if err != nil {
+		return 0, err
+	}
+	if n < tunFrameHeaderSize+virtioNetHdrSize {
+		return 0, nil
+	}
+	n -= virtioNetHdrSize
+
+	var h virtioNetHdr
+	h.decode(q.rhdr[:])
+	if h.gsoType&^virtioNetHdrGSOECN == virtioNetHdrGSONone {
+		if n > len(p) {
+			return 0, io.ErrShortBuffer
+		}
+		if h.flags&virtioNetHdrFNeedsCsum != 0 {
+			if err := completeChecksum(p[tunFrameHeaderSize:n], h); err != nil {
+				return 0, err
+			}
+		}
+		return n, nil
+	}
+
+	if h.gsoType&^virtioNetHdrGSOECN != virtioNetHdrGSOTCPv4 && h.gsoType&^virtioNetHdrGSOECN != virtioNetHdrGSOTCPv6 {
+		log.Debugf("drop gso packet of type %d", h.gsoType)
+		return 0, nil
+	}
+	copy(q.inFrame[:], p[:tunFrameHeaderSize])
+	if n > len(p) {
+		copy(q.in, p[tunFrameHeaderSize:])
+	} else {
+		copy(q.in, p[tunFrameHeaderSize:n])
+	}
+	q.inPkt = q.in[:n-tunFrameHeaderSize]
+	q.inHdr = h
+	return q.segment(p)
+}
+
+func (q *offloadQueue) segment(p []byte) (int, error) {
+	n, next, err := gsoSegment(p[tunFrameHeaderSize:], q.inPkt, q.inHdr, q.next)
+	q.next = next
+	if err != nil {
+		q.next = 0
+		return 0, err
+	}
+	copy(p, q.inFrame[:])
+	return tunFrameHeaderSize + n, nil
+}
+
+// Write writes a packet prefixed with the tun frame header, tcp segments are written
+// on Flush.
+func (q *offloadQueue) Write(p []byte) (int, error) {
+	if len(p) < tunFrameHeaderSize {
+		return 0, io.ErrShortBuffer
+	}
+
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+	if err := q.coalescer.add(p[tunFrameHeaderSize:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (q *offloadQueue) Flush() error {
+	q.writeMu.Lock()
+	defer q.writeMu.Unlock()
+	return q.coalescer.flush()
+}
+
+func (q *offloadQueue) write(h virtioNetHdr, pkt []byte) error {
+	copy(q.whdr[:], tunFrameHeaderOf(pkt))
+	h.encode(q.whdr[tunFrameHeaderSize:])
+	iovs := [][]byte{q.whdr[:], pkt}
+	var err error
+	if werr := q.rc.Write(func(fd uintptr) bool {
+		_, err = unix.Writev(int(fd), iovs)
+		return err != unix.EAGAIN
+	}); werr != nil {
+		return werr
+	}
+	return err
+}
+
+func (q *offloadQueue) Close() error {
+	return q.file.Close()
+}
@@ -50,7 +50,23 @@ type domainEntity struct {
 
 var _ heap.Interface = (*queue)(nil)
 
-func KeepRoutesToDomains(ctx context.Context, tunDevice TunDevice, dnsServer string, domainsReader io.ReadCloser) error {
+// replace keeps state of domains which are in the new list, new domains are resolved
+// first.
+func (q *queue) replace(domains []domainEntity) {
+	current := make(map[string]domainEntity, len(q.domains))
+	for _, d := range q.domains {
+		current[d.domain] = d
+	}
+	for i, d := range domains {
+		if prev, ok := current[d.domain]; ok {
+			domains[i] = prev
+		}
+	}
+	q.domains = domains
+	heap.Init(q)
+}
+
+func readDomains(domainsReader io.Reader) ([]domainEntity, error) {
 	csvReader := csv.NewReader(domainsReader)
 	var domains []domainEntity
 	for {
@@ -59,25 +75,36 @@ func KeepRoutesToDomains(ctx context.Context, tunDevice TunDevice, dnsServer str
 			break
 		}
 		if err != nil {
-			return err
+			return nil, err
 		}
 		domain := row[0]
 		domains = append(domains, domainEntity{
 			domain: domain,
 		})
 	}
+	return domains, nil
+}
+
+// KeepRoutesToDomains routes addresses of the domains through the tunnel. The returned
+// reload replaces the domains, routes already added are kept.
+func KeepRoutesToDomains(ctx context.Context, tunDevice TunDevice, dnsServer string, domainsReader io.ReadCloser) (reload func(io.Reader) error, err error) {
+	domains, err := readDomains(domainsReader)
+	if err != nil {
+		return nil, err
+	}
 
 	router, err := newRouter()
 	if err != nil {
 		log.Warn("can't init route", err)
-		return err
+		return nil, err
 	}
-	networkChanges, err := NotifyNetworkAddressesChanges(ctx)
+	networkChanges, err := NotifyNetworkAddressesChanges(ctx, tunDevice.LinkName())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	q := queue{domains: domains}
+	reloads := make(chan []domainEntity, 1)
 	c := dns.Client{
 		Timeout: RetryDelay,
 	}
@@ -95,12 +122,31 @@ func KeepRoutesToDomains(ctx context.Context, tunDevice TunDevice, dnsServer str
 					q.domains[i].ttl = 0
 				}
 				heap.Init(&q)
+			case domains := <-reloads:
+				q.replace(domains)
 			default:
 
+			}
+			if q.Len() == 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case domains := <-reloads:
+					q.replace(domains)
+				}
+				continue
 			}
 			domainEntity := heap.Pop(&q).(domainEntity)
 			if !domainEntity.updateTime.IsZero() {
-				time.Sleep(domainEntity.updateTime.Sub(time.Now()))
+				wait := time.NewTimer(domainEntity.updateTime.Sub(time.Now()))
+				select {
+				case <-wait.C:
+				case domains := <-reloads:
+					wait.Stop()
+					heap.Push(&q, domainEntity)
+					q.replace(domains)
+					continue
+				}
 			}
 
 			m := dns.Msg{}
@@ -148,9 +194,24 @@ func KeepRoutesToDomains(ctx context.Context, tunDevice TunDevice, dnsServer str
 					log.Warn("add route", "error", err)
 					continue
 				}
+				addInstalledRoute(netIP, domainEntity.domain)
+				routesAdded.Add(1)
 			}
 			heap.Push(&q, domainEntity)
 		}
 	}()
-	return nil
+	return func(domainsReader io.Reader) error {
+		domains, err := readDomains(domainsReader)
+		if err != nil {
+			return err
+		}
+		log.Infof("reload %d domains", len(domains))
+		// a pending list which wasn't picked up yet is replaced
+		select {
+		case <-reloads:
+		default:
+		}
+		reloads <- domains
+		return nil
+	}, nil
 }
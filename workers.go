@@ -0,0 +1,70 @@
+package stun
+
+import "context"
+
+const workerQueueSize = 256
+
+// workerPool handles items on a fixed number of workers. Items of one flow go to the
+// same worker, so they are handled in the order of submission. Worker index is passed
+// to handle and idle, idle is called when the worker queue gets empty.
+type workerPool[T any] struct {
+	queues []chan T
+	// block makes submit wait for room in the queue instead of dropping the item.
+	block bool
+}
+
+func newWorkerPool[T any](ctx context.Context, workers int, block bool, handle func(int, T), idle func(int)) *workerPool[T] {
+	p := &workerPool[T]{
+		queues: make([]chan T, workers),
+		block:  block,
+	}
+	for i := range p.queues {
+		i, q := i, make(chan T, workerQueueSize)
+		p.queues[i] = q
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case item := <-q:
+					handle(i, item)
+					if idle != nil && len(q) == 0 {
+						idle(i)
+					}
+				}
+			}
+		}()
+	}
+	return p
+}
+
+// depth returns the number of items waiting in all queues.
+func (p *workerPool[T]) depth() int {
+	res := 0
+	for _, q := range p.queues {
+		res += len(q)
+	}
+	return res
+}
+
+// submit queues the item to the worker of the flow, it returns false if the item was
+// dropped because the queue is full or the context is done.
+func (p *workerPool[T]) submit(ctx context.Context, flow uint32, item T) bool {
+	q := p.queues[flow%uint32(len(p.queues))]
+	if p.block {
+		select {
+		case q <- item:
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	select {
+	case q <- item:
+		return true
+	default:
+		countDrop(dropReasonQueueFull)
+		return false
+	}
+}
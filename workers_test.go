@@ -0,0 +1,46 @@
+package stun
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerPoolOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const n = 1000
+	handled := make(chan int, n)
+	p := newWorkerPool(ctx, 4, true, func(_ int, i int) {
+		handled <- i
+	}, nil)
+	for i := 0; i < n; i++ {
+		require.True(t, p.submit(ctx, 7, i))
+	}
+	for i := 0; i < n; i++ {
+		require.Equal(t, i, <-handled)
+	}
+}
+
+func TestWorkerPoolDrop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	release := make(chan struct{})
+	defer close(release)
+	p := newWorkerPool(ctx, 1, false, func(int, int) {
+		<-release
+	}, nil)
+
+	before := Drops()[dropReasonNames[dropReasonQueueFull]]
+	var dropped int
+	for i := 0; i < workerQueueSize+2; i++ {
+		if !p.submit(ctx, 0, i) {
+			dropped++
+		}
+	}
+	require.NotZero(t, dropped)
+	require.Equal(t, before+uint64(dropped), Drops()[dropReasonNames[dropReasonQueueFull]])
+}